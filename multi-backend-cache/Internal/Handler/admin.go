@@ -0,0 +1,170 @@
+package handler
+
+import (
+	utils "multi-backend-cache/packageUtils/Utils"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// @Summary Snapshot the in-memory caches
+// @Description Write a snapshot of every in-memory tenant cache to the snapshot directory
+// @ID take-snapshot
+// @Produce  json
+// @Success 200  "time of the snapshot"
+// @Failure 400  "Snapshots are not configured"
+// @Failure 500  "Internal Server Error"
+// @Router /admin/snapshot [post]
+func (s *Server) SnapshotHandler(c *gin.Context) {
+	if s.tenantCaches == nil {
+		utils.RespondError(c.Writer, http.StatusBadRequest, "In-memory cache is not enabled")
+		return
+	}
+	takenAt, err := s.tenantCaches.SaveSnapshots()
+	if err != nil {
+		logrus.Errorf("Error while taking snapshot: %v", err)
+		if !s.tenantCaches.SnapshotsEnabled() {
+			utils.RespondError(c.Writer, http.StatusBadRequest, err.Error())
+			return
+		}
+		utils.RespondError(c.Writer, http.StatusInternalServerError, "Failed to take snapshot")
+		return
+	}
+	utils.RespondJSON(c.Writer, http.StatusOK, map[string]interface{}{"last_snapshot": takenAt})
+}
+
+// @Summary Get the last snapshot time
+// @Description Report when the in-memory caches were last snapshotted, null if never
+// @ID get-snapshot
+// @Produce  json
+// @Success 200  "time of the last snapshot"
+// @Failure 400  "Bad Request"
+// @Router /admin/snapshot [get]
+func (s *Server) SnapshotStatusHandler(c *gin.Context) {
+	if s.tenantCaches == nil {
+		utils.RespondError(c.Writer, http.StatusBadRequest, "In-memory cache is not enabled")
+		return
+	}
+	var lastSnapshot *time.Time
+	if takenAt := s.tenantCaches.LastSnapshot(); !takenAt.IsZero() {
+		lastSnapshot = &takenAt
+	}
+	utils.RespondJSON(c.Writer, http.StatusOK, map[string]interface{}{
+		"enabled":       s.tenantCaches.SnapshotsEnabled(),
+		"last_snapshot": lastSnapshot,
+	})
+}
+
+type TenantPayload struct {
+	TenantID string `json:"tenantID" example:"tenant4"`
+	Capacity int    `json:"capacity" example:"1048576"` // in bytes, 0 shares the memory left by the other tenants
+}
+
+/* Maps the errors of the tenant operations to status codes
+ */
+func respondTenantError(c *gin.Context, err error) {
+	logrus.Error(err)
+	switch err {
+	case utils.TenantNotFound:
+		utils.RespondError(c.Writer, http.StatusNotFound, err.Error())
+	case utils.TenantExists:
+		utils.RespondError(c.Writer, http.StatusConflict, err.Error())
+	default:
+		utils.RespondError(c.Writer, http.StatusBadRequest, err.Error())
+	}
+}
+
+// @Summary List tenants
+// @Description List the in-memory tenants with their capacity and usage
+// @ID list-tenants
+// @Produce  json
+// @Success 200  "tenants"
+// @Failure 400  "Bad Request"
+// @Router /admin/tenants [get]
+func (s *Server) ListTenantsHandler(c *gin.Context) {
+	if s.tenantCaches == nil {
+		utils.RespondError(c.Writer, http.StatusBadRequest, "In-memory cache is not enabled")
+		return
+	}
+	utils.RespondJSON(c.Writer, http.StatusOK, map[string]interface{}{"tenants": s.tenantCaches.Tenants()})
+}
+
+// @Summary Create a tenant
+// @Description Create an in-memory tenant, with an explicit capacity or sharing the memory left by the others, and rebalance the existing tenants
+// @ID create-tenant
+// @Accept  json
+// @Produce  json
+// @Param   payload body handler.TenantPayload true "Tenant to create"
+// @Success 201  "status: ok"
+// @Failure 400  "Bad Request"
+// @Failure 409  "Tenant already exists"
+// @Router /admin/tenants [post]
+func (s *Server) CreateTenantHandler(c *gin.Context) {
+	var payload TenantPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		logrus.Error("Invalid request payload", err)
+		utils.RespondError(c.Writer, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if s.tenantCaches == nil {
+		utils.RespondError(c.Writer, http.StatusBadRequest, "In-memory cache is not enabled")
+		return
+	}
+	if err := s.tenantCaches.AddTenant(payload.TenantID, payload.Capacity); err != nil {
+		respondTenantError(c, err)
+		return
+	}
+	utils.RespondJSON(c.Writer, http.StatusCreated, map[string]string{"status": "ok"})
+}
+
+// @Summary Resize a tenant
+// @Description Give a tenant an explicit capacity, or 0 to share the memory left by the others again, and rebalance the other tenants
+// @ID resize-tenant
+// @Accept  json
+// @Produce  json
+// @Param   tenantID   path    string  true  "Tenant ID"
+// @Param   payload body handler.TenantPayload true "New capacity"
+// @Success 200  "status: ok"
+// @Failure 400  "Bad Request"
+// @Failure 404  "Tenant Not Found"
+// @Router /admin/tenants/{tenantID} [put]
+func (s *Server) ResizeTenantHandler(c *gin.Context) {
+	var payload TenantPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		logrus.Error("Invalid request payload", err)
+		utils.RespondError(c.Writer, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if s.tenantCaches == nil {
+		utils.RespondError(c.Writer, http.StatusBadRequest, "In-memory cache is not enabled")
+		return
+	}
+	if err := s.tenantCaches.ResizeTenant(c.Param("tenantID"), payload.Capacity); err != nil {
+		respondTenantError(c, err)
+		return
+	}
+	utils.RespondJSON(c.Writer, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// @Summary Delete a tenant
+// @Description Delete an in-memory tenant with its data, snapshot and append-only log, and give its memory back to the other tenants
+// @ID delete-tenant
+// @Produce  json
+// @Param   tenantID   path    string  true  "Tenant ID"
+// @Success 200  "status: ok"
+// @Failure 400  "Bad Request"
+// @Failure 404  "Tenant Not Found"
+// @Router /admin/tenants/{tenantID} [delete]
+func (s *Server) DeleteTenantHandler(c *gin.Context) {
+	if s.tenantCaches == nil {
+		utils.RespondError(c.Writer, http.StatusBadRequest, "In-memory cache is not enabled")
+		return
+	}
+	if err := s.tenantCaches.RemoveTenant(c.Param("tenantID")); err != nil {
+		respondTenantError(c, err)
+		return
+	}
+	utils.RespondJSON(c.Writer, http.StatusOK, map[string]string{"status": "ok"})
+}
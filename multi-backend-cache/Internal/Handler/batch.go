@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"fmt"
+	"multi-backend-cache/Internal/cache"
+	utils "multi-backend-cache/packageUtils/Utils"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Upper bound on the number of keys accepted by a single batch request.
+const maxBatchSize = 1000
+
+type BatchKeysPayload struct {
+	Keys []string `json:"keys" example:"1,2,3"`
+}
+
+type BatchSetPayload struct {
+	Items []cache.CacheData `json:"items"`
+}
+
+/* Validates the size of a batch and that none of its keys is empty or reserved.
+ */
+func validateBatchKeys(keys []string) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("At least one key must be provided")
+	}
+	if len(keys) > maxBatchSize {
+		return fmt.Errorf("A batch can hold at most %d keys", maxBatchSize)
+	}
+	for _, key := range keys {
+		if key == "" {
+			return fmt.Errorf("Key must not be null")
+		}
+		if cache.IsReservedKey(key) {
+			return fmt.Errorf("Key %s is reserved by the cache", key)
+		}
+	}
+	return nil
+}
+
+// @Summary Get multiple values from cache
+// @Description Retrieve the values of several keys in one request. Keys that do not exist are listed under "missing"
+// @ID batch-get-cache
+// @Accept  json
+// @Produce  json
+// @Param   system      query   string  true  "Cache Type"
+// @Param   payload body handler.BatchKeysPayload true "Keys to fetch"
+// @Success 200  "values and missing keys"
+// @Failure 400  "Bad Request"
+// @Failure 500  "Internal Server Error"
+// @Router /cache/batch/get [post]
+func (s *Server) BatchGetCacheHandler(c *gin.Context) {
+	var payload BatchKeysPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		logrus.Error("Invalid request payload", err)
+		utils.RespondError(c.Writer, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if err := validateBatchKeys(payload.Keys); err != nil {
+		logrus.Error(err)
+		utils.RespondError(c.Writer, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	cache := s.determineCacheLibraryType(c.Query("system"), c.Query("tenantID"))
+	if cache == nil {
+		logrus.Error("Unsupported cache type, please provide supported cache System", cache)
+		utils.RespondError(c.Writer, http.StatusBadRequest, "Unsupported cache type")
+		return
+	}
+
+	ctx, cancel := operationContext(c)
+	defer cancel()
+	values, err := cache.GetMany(ctx, payload.Keys)
+	if err != nil {
+		logrus.Errorf("Error while getting %d keys: %v", len(payload.Keys), err)
+		if respondContextError(c, err) {
+			return
+		}
+		utils.RespondError(c.Writer, http.StatusInternalServerError, "Failed to get cache")
+		return
+	}
+
+	missing := []string{}
+	for _, key := range payload.Keys {
+		if _, found := values[key]; !found {
+			missing = append(missing, key)
+		}
+	}
+	logrus.Infof("Batch get returned %d of %d keys", len(values), len(payload.Keys))
+	utils.RespondJSON(c.Writer, http.StatusOK, map[string]interface{}{
+		"values":  values,
+		"missing": missing,
+	})
+}
+
+// @Summary Set multiple values in cache
+// @Description Set several key/value pairs in one request, each with its own TTL
+// @ID batch-set-cache
+// @Accept  json
+// @Produce  json
+// @Param   system      query   string  true  "Cache Type"
+// @Param   payload body handler.BatchSetPayload true "Items to store"
+// @Success 200  "status: ok"
+// @Failure 400  "Bad Request"
+// @Failure 413  "Entry exceeds the cache capacity"
+// @Failure 500  "Internal Server Error"
+// @Router /cache/batch/set [post]
+func (s *Server) BatchSetCacheHandler(c *gin.Context) {
+	var payload BatchSetPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		logrus.Error("Invalid request payload", err)
+		utils.RespondError(c.Writer, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	keys := make([]string, len(payload.Items))
+	for i, item := range payload.Items {
+		keys[i] = item.Key
+		if len(item.Tags) > 0 {
+			logrus.Errorf("Batch item %s has tags", item.Key)
+			utils.RespondError(c.Writer, http.StatusBadRequest, "Tags can only be set with POST /cache")
+			return
+		}
+	}
+	if err := validateBatchKeys(keys); err != nil {
+		logrus.Error(err)
+		utils.RespondError(c.Writer, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	cache := s.determineCacheLibraryType(c.Query("system"), c.Query("tenantID"))
+	if cache == nil {
+		logrus.Error("Unsupported cache type, please provide supported cache System", cache)
+		utils.RespondError(c.Writer, http.StatusBadRequest, "Unsupported cache type")
+		return
+	}
+
+	ctx, cancel := operationContext(c)
+	defer cancel()
+	if err := cache.SetMany(ctx, payload.Items); err != nil {
+		logrus.Errorf("Error while setting %d keys: %v", len(payload.Items), err)
+		if err == utils.TooLarge {
+			utils.RespondError(c.Writer, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		if respondContextError(c, err) {
+			return
+		}
+		utils.RespondError(c.Writer, http.StatusInternalServerError, "Failed to set cache")
+		return
+	}
+
+	logrus.Infof("Batch set stored %d keys", len(payload.Items))
+	utils.RespondJSON(c.Writer, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// @Summary Delete multiple values from cache
+// @Description Delete several keys in one request and report how many of them existed
+// @ID batch-delete-cache
+// @Accept  json
+// @Produce  json
+// @Param   system      query   string  true  "Cache Type"
+// @Param   payload body handler.BatchKeysPayload true "Keys to delete"
+// @Success 200  "number of deleted keys"
+// @Failure 400  "Bad Request"
+// @Failure 500  "Internal Server Error"
+// @Router /cache/batch/delete [post]
+func (s *Server) BatchDeleteCacheHandler(c *gin.Context) {
+	var payload BatchKeysPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		logrus.Error("Invalid request payload", err)
+		utils.RespondError(c.Writer, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if err := validateBatchKeys(payload.Keys); err != nil {
+		logrus.Error(err)
+		utils.RespondError(c.Writer, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	cache := s.determineCacheLibraryType(c.Query("system"), c.Query("tenantID"))
+	if cache == nil {
+		logrus.Error("Unsupported cache type")
+		utils.RespondError(c.Writer, http.StatusBadRequest, "Unsupported cache type")
+		return
+	}
+
+	ctx, cancel := operationContext(c)
+	defer cancel()
+	deleted, err := cache.DeleteMany(ctx, payload.Keys)
+	if err != nil {
+		logrus.Errorf("Error while deleting %d keys: %v", len(payload.Keys), err)
+		if respondContextError(c, err) {
+			return
+		}
+		utils.RespondError(c.Writer, http.StatusInternalServerError, "Failed to delete cache")
+		return
+	}
+
+	logrus.Infof("Batch delete removed %d of %d keys", deleted, len(payload.Keys))
+	utils.RespondJSON(c.Writer, http.StatusOK, map[string]int{"deleted": deleted})
+}
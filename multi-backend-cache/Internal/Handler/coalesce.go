@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"multi-backend-cache/Internal/metrices"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// flight is a call shared by the concurrent requests for one key
+type flight struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// coalescer runs one call at a time per key. Requests arriving while a call is in flight wait
+// for its result instead of starting their own.
+type coalescer struct {
+	lock    sync.Mutex
+	flights map[string]*flight
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{flights: make(map[string]*flight)}
+}
+
+// do returns the result of call for the key of the cache system, sharing it with the concurrent
+// callers, who are counted as coalesced requests. The call is detached from the cancellation of
+// the request that started it, so that a client going away does not fail the others; each
+// caller still stops waiting when its own context ends.
+func (g *coalescer) do(ctx context.Context, system string, key string, call func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	key = system + "\x00" + key
+	g.lock.Lock()
+	f, shared := g.flights[key]
+	if shared {
+		metrices.CoalescedRequests.WithLabelValues(system).Inc()
+	} else {
+		f = &flight{done: make(chan struct{})}
+		g.flights[key] = f
+		go g.run(context.WithoutCancel(ctx), key, f, call)
+	}
+	g.lock.Unlock()
+
+	select {
+	case <-f.done:
+		return f.value, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (g *coalescer) run(ctx context.Context, key string, f *flight, call func(ctx context.Context) (interface{}, error)) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logrus.Errorf("Coalesced call for %q panicked: %v", key, recovered)
+			f.err = fmt.Errorf("coalesced call panicked: %v", recovered)
+		}
+		g.lock.Lock()
+		delete(g.flights, key)
+		g.lock.Unlock()
+		close(f.done)
+	}()
+	f.value, f.err = call(ctx)
+}
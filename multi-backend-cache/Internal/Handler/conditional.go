@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"fmt"
+	"multi-backend-cache/Internal/cache"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// formatETag returns the entity tag of a version, empty when the version is unknown
+func formatETag(version uint64) string {
+	if version == 0 {
+		return ""
+	}
+	return `"` + strconv.FormatUint(version, 36) + `"`
+}
+
+// setETag sets the ETag header of the response when the version is known
+func setETag(c *gin.Context, version uint64) {
+	if etag := formatETag(version); etag != "" {
+		c.Header("ETag", etag)
+	}
+}
+
+// parseCondition reads the If-Match and If-None-Match headers of a write. Both take "*" or a
+// comma separated list of entity tags; weak tags never match, as writes compare strongly.
+func parseCondition(c *gin.Context) (cache.Condition, error) {
+	var condition cache.Condition
+	var err error
+	if header := c.GetHeader("If-Match"); header != "" {
+		condition.IfExists, condition.IfMatch, err = parseETags(header)
+		if err != nil {
+			return cache.Condition{}, err
+		}
+		if !condition.IfExists && len(condition.IfMatch) == 0 {
+			condition.IfMatch = []uint64{0} // only weak tags, which no entry matches
+		}
+	}
+	if header := c.GetHeader("If-None-Match"); header != "" {
+		condition.IfAbsent, condition.IfNoneMatch, err = parseETags(header)
+		if err != nil {
+			return cache.Condition{}, err
+		}
+	}
+	return condition, nil
+}
+
+// parseWriteCondition returns the condition of a set: its write mode, or else its If-Match
+// and If-None-Match headers, which cannot be combined with a mode
+func parseWriteCondition(c *gin.Context, mode string) (cache.Condition, error) {
+	condition, err := parseCondition(c)
+	if err != nil || mode == "" {
+		return condition, err
+	}
+	if !condition.IsZero() {
+		return cache.Condition{}, fmt.Errorf("mode cannot be combined with If-Match or If-None-Match")
+	}
+	return cache.ConditionForMode(mode)
+}
+
+// parseETags returns whether the header is "*", or else the versions of its strong tags
+func parseETags(header string) (bool, []uint64, error) {
+	if strings.TrimSpace(header) == "*" {
+		return true, nil, nil
+	}
+	var versions []uint64
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if strings.HasPrefix(tag, "W/") {
+			continue
+		}
+		if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			return false, nil, fmt.Errorf("malformed entity tag %q", tag)
+		}
+		version, err := strconv.ParseUint(tag[1:len(tag)-1], 36, 64)
+		if err != nil || version == 0 {
+			return false, nil, fmt.Errorf("unknown entity tag %q", tag)
+		}
+		versions = append(versions, version)
+	}
+	return false, versions, nil
+}
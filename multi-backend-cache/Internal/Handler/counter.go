@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"io"
+	utils "multi-backend-cache/packageUtils/Utils"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+type IncrPayload struct {
+	Delta   *int64        `json:"delta" example:"1"` // 1 when omitted, negative to decrement
+	Initial int64         `json:"initial" example:"0"`
+	TTL     time.Duration `json:"ttl" example:"100"` // only applied when the counter is created
+}
+
+// @Summary Increment a counter
+// @Description Atomically add delta (1 by default, negative to decrement) to the integer stored at the key. A missing key is created as initial + delta with the TTL; an existing counter keeps its expiry. Memcache counters never go below 0
+// @ID incr-cache
+// @Accept  json
+// @Produce  json
+// @Param   key        path    string  true  "Cache Key"
+// @Param   system      query   string  true  "Cache Type"
+// @Param   payload body handler.IncrPayload false "Delta, initial value and TTL"
+// @Success 200  "value of the counter"
+// @Failure 400  "Bad Request"
+// @Failure 409  "Value is not an integer or the result overflows"
+// @Failure 500  "Internal Server Error"
+// @Router /cache/{key}/incr [post]
+func (s *Server) IncrCacheHandler(c *gin.Context) {
+	var payload IncrPayload
+	if err := c.ShouldBindJSON(&payload); err != nil && err != io.EOF {
+		logrus.Error("Invalid request payload", err)
+		utils.RespondError(c.Writer, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	delta := int64(1)
+	if payload.Delta != nil {
+		delta = *payload.Delta
+	}
+
+	key := c.Param("key")
+	if rejectReservedKey(c, key) {
+		return
+	}
+	cache := s.determineCacheLibraryType(c.Query("system"), c.Query("tenantID"))
+	if cache == nil {
+		logrus.Error("Unsupported cache type, please provide supported cache System", cache)
+		utils.RespondError(c.Writer, http.StatusBadRequest, "Unsupported cache type")
+		return
+	}
+
+	ctx, cancel := operationContext(c)
+	defer cancel()
+	value, err := cache.Incr(ctx, key, delta, payload.Initial, payload.TTL)
+	if err != nil {
+		logrus.Errorf("Error while incrementing key %s: %v", key, err)
+		if err == utils.NotInteger {
+			utils.RespondError(c.Writer, http.StatusConflict, err.Error())
+			return
+		}
+		if err == utils.TooLarge {
+			utils.RespondError(c.Writer, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		if respondContextError(c, err) {
+			return
+		}
+		utils.RespondError(c.Writer, http.StatusInternalServerError, "Failed to increment cache")
+		return
+	}
+
+	logrus.Infof("Counter %s incremented by %d to %d", key, delta, value)
+	utils.RespondJSON(c.Writer, http.StatusOK, map[string]int64{"value": value})
+}
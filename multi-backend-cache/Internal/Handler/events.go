@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"io"
+	"multi-backend-cache/Internal/cache"
+	utils "multi-backend-cache/packageUtils/Utils"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Interval of the comments that keep an idle event stream open through proxies
+const eventKeepAlive = 15 * time.Second
+
+// @Summary Stream change events
+// @Description Stream the set, delete, expire, evict and clear events of the cache system as Server-Sent Events, named after their type, with the key and time as JSON data. match filters the keys with a glob pattern (Redis syntax: *, ?, [a-z], \ to escape). Redis events come from its keyspace notifications, which need notify-keyspace-events to include K$gxe, and do not include clears. A client that falls behind misses events. Memcache cannot stream its changes
+// @ID stream-events
+// @Produce  text/event-stream
+// @Param   system      query   string  true  "Cache Type"
+// @Param   match       query   string  false "Glob pattern, all keys by default"
+// @Success 200  {object} cache.Event
+// @Failure 400  "Bad Request"
+// @Failure 500  "Internal Server Error"
+// @Failure 501  "Not Implemented"
+// @Router /events [get]
+func (s *Server) EventsHandler(c *gin.Context) {
+	cacheSystem := s.determineCacheLibraryType(c.Query("system"), c.Query("tenantID"))
+	if cacheSystem == nil {
+		logrus.Error("Unsupported cache type")
+		utils.RespondError(c.Writer, http.StatusBadRequest, "Unsupported cache type")
+		return
+	}
+	watcher, ok := cacheSystem.(cache.Watcher)
+	if !ok {
+		logrus.Warnf("Cache system %s cannot stream its changes", c.Query("system"))
+		utils.RespondError(c.Writer, http.StatusNotImplemented, utils.NotSupported.Error())
+		return
+	}
+
+	// The stream lasts as long as the request, without the operation timeout
+	events, err := watcher.Watch(c.Request.Context(), c.Query("match"))
+	if err != nil {
+		logrus.Errorf("Error watching cache system %s: %v", c.Query("system"), err)
+		if err == utils.NotSupported {
+			utils.RespondError(c.Writer, http.StatusNotImplemented, err.Error())
+			return
+		}
+		if respondContextError(c, err) {
+			return
+		}
+		utils.RespondError(c.Writer, http.StatusInternalServerError, "Failed to watch cache")
+		return
+	}
+
+	logrus.Infof("Streaming the events of cache system %s", c.Query("system"))
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			c.SSEvent(event.Type, event)
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		}
+		return true
+	})
+	logrus.Infof("Event stream of cache system %s ended", c.Query("system"))
+}
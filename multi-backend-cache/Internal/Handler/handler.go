@@ -1,11 +1,13 @@
 package handler
 
 import (
+	"context"
+	"errors"
 	"multi-backend-cache/Internal/cache"
 	"multi-backend-cache/Internal/config"
 	utils "multi-backend-cache/packageUtils/Utils"
 	"net/http"
-	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -17,8 +19,10 @@ type Server struct {
 	tenantCaches  *cache.FixedTenantsCaches // Use FixedTenantsCaches for multi-tenant support
 	redisCache    cache.CacheSystem
 	memCache      cache.CacheSystem
+	loaders       *cache.Loaders // read-through origins, by key prefix
+	flights       *coalescer     // concurrent reads of the same key
+	jobs          *jobRegistry   // deletes by pattern running in the background
 	// inmemoryCache cache.CacheSystem
-	mu            sync.Mutex
 }
 
 // /* Structure for multiple Cache System
@@ -37,10 +41,19 @@ func NewServer(tenantCaches *cache.FixedTenantsCaches, redisCache cache.CacheSys
 		tenantCaches:  tenantCaches,
 		redisCache:    redisCache,
 		memCache:      memCache,
+		loaders:       cache.NewLoaders(config.AppConfig.Loaders),
+		flights:       newCoalescer(),
+		jobs:          newJobRegistry(),
 		// inmemoryCache: inmemoryCache,
 	}
 }
 
+/* Stop the background jobs on shutdown, marking those interrupted as cancelled.
+ */
+func (s *Server) Shutdown() {
+	s.jobs.stop()
+}
+
 // /* Creating a New server
 //  */
 //  func NewServer(tenantCaches *cache.FixedTenantsCaches, redisCache cache.CacheSystem, memCache cache.CacheSystem) *Server {
@@ -51,28 +64,120 @@ func NewServer(tenantCaches *cache.FixedTenantsCaches, redisCache cache.CacheSys
 // 	}
 // }
 
+// Non-standard status used when the client goes away before the backend call completes.
+const statusClientClosedRequest = 499
+
+/* Derive the context for a backend call from the incoming request, bounded by the
+configured per-operation timeout.
+*/
+func operationContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	return withOperationTimeout(c.Request.Context())
+}
+
+func withOperationTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := time.Duration(config.AppConfig.OperationTimeout) * time.Millisecond
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// originError is a failed read-through load, answered with 502 rather than 500
+type originError struct {
+	err error
+}
+
+func (e originError) Error() string { return e.err.Error() }
+func (e originError) Unwrap() error { return e.err }
+
+/* Responds with the matching status when a backend call failed because of its context.
+Returns false when the error has another cause.
+*/
+func respondContextError(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		utils.RespondError(c.Writer, http.StatusGatewayTimeout, "Cache operation timed out")
+	case errors.Is(err, context.Canceled):
+		utils.RespondError(c.Writer, statusClientClosedRequest, "Request cancelled")
+	default:
+		return false
+	}
+	return true
+}
+
+/* Answers 400 when the key is one the cache keeps for itself, like the leases of the locks.
+Returns false when the key is free for the users.
+*/
+func rejectReservedKey(c *gin.Context, key string) bool {
+	if !cache.IsReservedKey(key) {
+		return false
+	}
+	logrus.Errorf("Key %s is reserved", key)
+	utils.RespondError(c.Writer, http.StatusBadRequest, utils.ReservedKey.Error())
+	return true
+}
+
 /* Determine the cache Library Type based on URI Param.
  */
 func (s *Server) determineCacheLibraryType(cacheType string, tenantID string) cache.CacheSystem {
 	//cacheType := mux.Vars(r)["cacheType"]
 	switch cacheType {
 	case "redis":
-		return s.redisCache
+		return forTenant(s.redisCache, tenantID)
 	case "memcache":
-		return s.memCache
+		return forTenant(s.memCache, tenantID)
 	case "inmemory":
-		if config.AppConfig.IsTenantBased {
-			return s.tenantCaches.GetCache(tenantID)
-		} else {
-			return s.tenantCaches.GetCache(cache.DefaultTenant)
+		// Avoid wrapping a nil *LRUCache in a non-nil interface
+		if tenantCache := s.inMemoryCache(tenantID); tenantCache != nil {
+			return tenantCache
+		}
+		return nil
+	case "tiered":
+		redisCache := forTenant(s.redisCache, tenantID)
+		if s.tenantCaches == nil || redisCache == nil {
+			return nil
 		}
+		if !config.AppConfig.IsTenantBased {
+			tenantID = cache.DefaultTenant
+		}
+		l1 := s.tenantCaches.TieredL1(tenantID)
+		if l1 == nil {
+			return nil
+		}
+		l1TTL := time.Duration(config.AppConfig.TieredL1TTL) * time.Second
+		return cache.NewTieredCache(tenantID, l1, redisCache, l1TTL)
 	default:
 		return nil
 	}
 }
 
+/* In-memory cache of the tenant, nil if there is none.
+ */
+func (s *Server) inMemoryCache(tenantID string) *cache.LRUCache {
+	if s.tenantCaches == nil {
+		return nil
+	}
+	if !config.AppConfig.IsTenantBased {
+		tenantID = cache.DefaultTenant
+	}
+	return s.tenantCaches.GetCache(tenantID)
+}
+
+/* Scope a remote backend to the tenant, so that tenants sharing a server cannot see or clear
+each other's keys.
+*/
+func forTenant(backend cache.CacheSystem, tenantID string) cache.CacheSystem {
+	if backend == nil || !config.AppConfig.IsTenantBased || tenantID == "" {
+		return backend
+	}
+	if scoped, ok := backend.(cache.TenantScoped); ok {
+		return scoped.ForTenant(tenantID)
+	}
+	return backend
+}
+
 // @Summary Get value from cache by key
-// @Description Retrieve a value from the cache using the provided key and cache type
+// @Description Retrieve a value from the cache using the provided key and cache type. The X-Cache-Status header tells whether it was a HIT, a STALE value being refreshed, or a MISS loaded from the origin
 // @ID get-cache-by-key
 // @Accept  json
 // @Produce  json
@@ -82,9 +187,13 @@ func (s *Server) determineCacheLibraryType(cacheType string, tenantID string) ca
 // @Failure 400  "Bas Request"
 // @Failure 404  "Not Found"
 // @Failure 500  "Internal Server Error"
+// @Failure 502  "Read-through origin failed"
 // @Router /cache/{key} [get]
 func (s *Server) GetCacheHandler(c *gin.Context) {
 	key := c.Param("key")
+	if rejectReservedKey(c, key) {
+		return
+	}
 	tenantID := c.Query("tenantID")
 	CacheLibraryType := c.Query("system")
 	cache := s.determineCacheLibraryType(CacheLibraryType, tenantID)
@@ -95,7 +204,10 @@ func (s *Server) GetCacheHandler(c *gin.Context) {
 		return
 	}
 
-	value, err := cache.Get(key)
+	// Concurrent reads of the key share one backend call and one load
+	result, err := s.flights.do(c.Request.Context(), CacheLibraryType, tenantID+"\x00"+key, func(ctx context.Context) (interface{}, error) {
+		return s.getOrLoad(ctx, CacheLibraryType, cache, key, tenantID)
+	})
 	if err != nil {
 
 		if err.Error() == utils.NotFound.Error() {
@@ -104,37 +216,185 @@ func (s *Server) GetCacheHandler(c *gin.Context) {
 			return
 		}
 		logrus.Errorf("Error while getting cache for key %s: %v", key, err)
+		if respondContextError(c, err) {
+			return
+		}
+		var loadErr originError
+		if errors.As(err, &loadErr) {
+			utils.RespondError(c.Writer, http.StatusBadGateway, "Failed to load from origin")
+			return
+		}
 		utils.RespondError(c.Writer, http.StatusInternalServerError, err.Error())
 		return
 	}
-	logrus.Infof("Cache retrieved for key %s: %v", key, value)
-	utils.RespondJSON(c.Writer, http.StatusOK, value)
+	read := result.(readResult)
+	logrus.Infof("Cache retrieved for key %s: %v", key, read.value)
+	c.Header(cacheStatusHeader, read.status)
+	setETag(c, read.version)
+	utils.RespondJSON(c.Writer, http.StatusOK, read.value)
 }
 
-// func (s *Server) GetCacheWithTTLHandler(c *gin.Context) {
-// 	key := c.Param("key")
-// 	tenantID := c.Query("tenantID")
-// 	CacheLibraryType := c.Query("system")
-// 	cache := s.determineCacheLibraryType(CacheLibraryType, tenantID)
+// Response header telling how a read was served.
+const (
+	cacheStatusHeader = "X-Cache-Status"
+	cacheStatusHit    = "HIT"   // fresh value from the cache
+	cacheStatusStale  = "STALE" // value past its soft TTL, refreshed in the background, or in its grace period while the origin fails
+	cacheStatusMiss   = "MISS"  // value loaded from the origin
+)
 
-// 	if cache == nil {
-// 		utils.RespondError(c.Writer, http.StatusBadRequest, "Unsupported cache type")
-// 		return
-// 	}
+// readResult is shared by the coalesced reads of a key
+type readResult struct {
+	value   interface{}
+	status  string
+	version uint64 // 0 when the backend does not tell it
+}
 
-// 	value, ttl, expiryTime, err := cache.GetWithTTL(key)
-// 	if err != nil {
-// 		utils.LogError("Error while getting cache with TTL", err)
-// 		utils.RespondError(c.Writer, http.StatusInternalServerError, "Failed to get cache with TTL")
-// 		return
-// 	}
+/* Get the key from the backend, or on a miss load it from the origin of its loader and cache it.
+A stale value is returned as is while it is reloaded in the background. A value past its TTL,
+kept for the grace period of its loader, is reloaded first and only returned when that fails.
+*/
+func (s *Server) getOrLoad(ctx context.Context, system string, cacheSystem cache.CacheSystem, key string, tenantID string) (interface{}, error) {
+	getCtx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+	item, err := cacheSystem.GetItem(getCtx, key)
+	if err == nil {
+		if !item.Stale() {
+			return readResult{value: item.Value, status: cacheStatusHit, version: item.Version}, nil
+		}
+		stale := readResult{value: item.Value, status: cacheStatusStale, version: item.Version}
+		loader := s.loaders.For(key)
+		if loader == nil {
+			return stale, nil
+		}
+		if !loader.Expired(item) {
+			go s.refresh(system, cacheSystem, loader, key, tenantID)
+			return stale, nil
+		}
+		result, err := s.load(ctx, cacheSystem, loader, key, tenantID)
+		var loadErr originError
+		switch {
+		case err == utils.NotFound:
+			s.drop(cacheSystem, key)
+		case errors.As(err, &loadErr):
+			logrus.Warnf("Serving key %s past its TTL, its reload failed: %v", key, err)
+			return stale, nil
+		}
+		return result, err
+	}
+	if err.Error() != utils.NotFound.Error() {
+		return nil, err
+	}
+	loader := s.loaders.For(key)
+	if loader == nil {
+		return nil, err
+	}
+	return s.load(ctx, cacheSystem, loader, key, tenantID)
+}
 
-// 	utils.RespondJSON(c.Writer, http.StatusOK, map[string]interface{}{
-// 		"value":       value,
-// 		"ttl":         ttl.Seconds(),
-// 		"expiry_time": expiryTime,
-// 	})
-// }
+/* Load the key from the origin of its loader and cache it with the loader TTLs.
+ */
+func (s *Server) load(ctx context.Context, cacheSystem cache.CacheSystem, loader *cache.Loader, key string, tenantID string) (interface{}, error) {
+	value, err := s.loaders.Load(ctx, loader, key, tenantID)
+	if err == utils.NotFound {
+		return nil, err
+	}
+	if err != nil {
+		return nil, originError{err: err}
+	}
+	setCtx, cancel := withOperationTimeout(ctx)
+	defer cancel()
+	version, err := cacheSystem.SetIf(setCtx, key, value, loader.SoftTTL(), loader.TTL(), cache.Condition{})
+	if err != nil {
+		// The value is still served, the next read loads it again
+		logrus.Errorf("Error while caching loaded key %s: %v", key, err)
+	}
+	logrus.Infof("Cache loaded for key %s", key)
+	return readResult{value: value, status: cacheStatusMiss, version: version}, nil
+}
+
+/* Reload a stale key in the background, once for all the reads that saw it stale. When the
+origin fails the stale value keeps being served until its TTL runs out, or its grace period
+with a loader that has one; when the origin no longer has the key it is dropped.
+*/
+func (s *Server) refresh(system string, cacheSystem cache.CacheSystem, loader *cache.Loader, key string, tenantID string) {
+	_, err := s.flights.do(context.Background(), system, "refresh\x00"+tenantID+"\x00"+key, func(ctx context.Context) (interface{}, error) {
+		return s.load(ctx, cacheSystem, loader, key, tenantID)
+	})
+	switch {
+	case err == utils.NotFound:
+		s.drop(cacheSystem, key)
+	case err != nil:
+		logrus.Warnf("Serving key %s stale, its refresh failed: %v", key, err)
+	}
+}
+
+/* Delete a key the origin no longer has.
+ */
+func (s *Server) drop(cacheSystem cache.CacheSystem, key string) {
+	ctx, cancel := withOperationTimeout(context.Background())
+	defer cancel()
+	if err := cacheSystem.Delete(ctx, key); err != nil && err != utils.NotFound {
+		logrus.Errorf("Error while dropping key %s gone from the origin: %v", key, err)
+	}
+}
+
+// @Summary Get value from cache by key along with its TTL
+// @Description Retrieve a value, its remaining TTL in seconds and its absolute expiry time. Entries without an expiry report a TTL of -1
+// @ID get-cache-with-ttl-by-key
+// @Accept  json
+// @Produce  json
+// @Param   key        path    string  true  "Cache Key"
+// @Param   system      query   string  true  "Cache Type"
+// @Success 200  "value, ttl and expiry_time"
+// @Failure 400  "Bad Request"
+// @Failure 404  "Not Found"
+// @Failure 500  "Internal Server Error"
+// @Router /cache/TTL/{key} [get]
+func (s *Server) GetCacheWithTTLHandler(c *gin.Context) {
+	key := c.Param("key")
+	if rejectReservedKey(c, key) {
+		return
+	}
+	tenantID := c.Query("tenantID")
+	CacheLibraryType := c.Query("system")
+	cache := s.determineCacheLibraryType(CacheLibraryType, tenantID)
+
+	if cache == nil {
+		logrus.Error("Unsupported cache type, please provide supported cache System", cache)
+		utils.RespondError(c.Writer, http.StatusBadRequest, "Unsupported cache type")
+		return
+	}
+
+	ctx, cancel := operationContext(c)
+	defer cancel()
+	value, ttl, expiryTime, err := cache.GetWithTTL(ctx, key)
+	if err != nil {
+		if err.Error() == utils.NotFound.Error() {
+			logrus.Errorf("Error: key %s: %v", key, err)
+			utils.RespondError(c.Writer, http.StatusNotFound, err.Error())
+			return
+		}
+		logrus.Errorf("Error while getting cache with TTL for key %s: %v", key, err)
+		if respondContextError(c, err) {
+			return
+		}
+		utils.RespondError(c.Writer, http.StatusInternalServerError, "Failed to get cache with TTL")
+		return
+	}
+
+	response := map[string]interface{}{
+		"key":   key,
+		"value": value,
+		"ttl":   ttl.Seconds(),
+	}
+	if ttl < 0 { // cache.NoExpiry
+		response["ttl"] = -1
+	} else {
+		response["expiry_time"] = expiryTime
+	}
+	logrus.Infof("Cache with TTL retrieved for key %s: %v", key, value)
+	utils.RespondJSON(c.Writer, http.StatusOK, response)
+}
 
 //	type SetCachePayload struct {
 //		Key        string        `json:"key"`
@@ -144,16 +404,23 @@ func (s *Server) GetCacheHandler(c *gin.Context) {
 //	}
 
 // @Summary Set value in cache
-// @Description Set a value in the cache with a specified key and TTL (Time-To-Live)
+// @Description Set a value in the cache with a specified key, TTL (Time-To-Live) and optional soft TTL after which it is served as stale. Tags group entries that DELETE /cache/tags/{tag} invalidates together. With If-Match or If-None-Match the write only applies when the current entry matches, the ETag of the new entry is returned when the backend knows it
 // @ID set-cache-value
 // @Accept json
 // @Produce json
 // @Param system query string true "Cache Type"
+// @Param mode query string false "upsert (default), add to only create the entry or replace to only update it"
+// @Param If-Match header string false "Write only if the entry has one of these ETags, * if it exists"
+// @Param If-None-Match header string false "Write only if the entry has none of these ETags, * if it does not exist"
 // @Param payload body cache.CacheData true "Cache Payload"
 // @Success 200  "status: ok"
 // @Failure 400  "Bad Request"
 // @Failure 404  "Not Found"
+// @Failure 409  "Entry exists in add mode, or is missing in replace mode"
+// @Failure 412  "Entry does not match the expected version"
+// @Failure 413  "Entry exceeds the cache capacity"
 // @Failure 500  "Internal Server Error"
+// @Failure 501  "Cache system cannot tag entries"
 // @Router /cache [post]
 func (s *Server) SetCacheHandler(c *gin.Context) {
 	var payload cache.CacheData
@@ -170,6 +437,14 @@ func (s *Server) SetCacheHandler(c *gin.Context) {
 		utils.RespondError(c.Writer, http.StatusNotFound, "Key must not be null")
 		return
 	}
+	if rejectReservedKey(c, payload.Key) {
+		return
+	}
+	if err := validateTags(payload.Tags); err != nil {
+		logrus.Error(err)
+		utils.RespondError(c.Writer, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	CacheLibraryType := c.Query("system")
 	tenantID := c.Query("tenantID")
@@ -180,33 +455,68 @@ func (s *Server) SetCacheHandler(c *gin.Context) {
 		return
 	}
 
+	mode := c.Query("mode")
+	condition, err := parseWriteCondition(c, mode)
+	if err != nil {
+		logrus.Error("Invalid precondition", err)
+		utils.RespondError(c.Writer, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	logrus.Debugf("Setting cache for key %s with TTL %s", payload.Key, payload.TTL)
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if err := cache.Set(payload.Key, payload.Value, payload.TTL); err != nil {
+	ctx, cancel := operationContext(c)
+	defer cancel()
+	version, err := setEntry(ctx, cache, payload, condition)
+	if err != nil {
 		logrus.Errorf("Error while setting cache for key %s: %v", payload.Key, err)
+		if err == utils.NotSupported {
+			utils.RespondError(c.Writer, http.StatusNotImplemented, "Cache system cannot tag entries")
+			return
+		}
+		if err == utils.TooLarge {
+			utils.RespondError(c.Writer, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		if err == utils.PreconditionFailed && mode != "" {
+			utils.RespondError(c.Writer, http.StatusConflict, "Key "+payload.Key+" not written in "+mode+" mode")
+			return
+		}
+		if err == utils.PreconditionFailed {
+			utils.RespondError(c.Writer, http.StatusPreconditionFailed, err.Error())
+			return
+		}
+		if respondContextError(c, err) {
+			return
+		}
 		utils.RespondError(c.Writer, http.StatusInternalServerError, "Failed to set cache")
 		return
 	}
 
 	logrus.Infof("Cache set for key %s", payload.Key)
+	setETag(c, version)
 	utils.RespondJSON(c.Writer, http.StatusOK, map[string]string{"status": "ok"})
 }
 
 // @Summary Delete value from cache by key
-// @Description Delete a value from the cache using the provided key and cache type
+// @Description Delete a value from the cache using the provided key and cache type. With If-Match or If-None-Match the delete only applies when the current entry matches
 // @ID delete-cache-by-key
 // @Accept  json
 // @Produce  json
 // @Param   key        path    string  true  "Cache Key"
 // @Param   system      query   string  true  "Cache Type"
+// @Param   If-Match    header  string  false "Delete only if the entry has one of these ETags"
+// @Param   If-None-Match header string false "Delete only if the entry has none of these ETags"
 // @Success 200  "status: ok"
 // @Failure 400  "Bad Request"
 // @Failure 404  "Not Found"
+// @Failure 412  "Entry does not match the expected version"
 // @Failure 500  "Internal Server Error"
 // @Router /cache/{key} [delete]
 func (s *Server) DeleteCacheHandler(c *gin.Context) {
 	key := c.Param("key")
+	if rejectReservedKey(c, key) {
+		return
+	}
 	CacheLibraryType := c.Query("system")
 	tenantID := c.Query("tenantID")
 
@@ -218,16 +528,31 @@ func (s *Server) DeleteCacheHandler(c *gin.Context) {
 		return
 	}
 
+	condition, err := parseCondition(c)
+	if err != nil {
+		logrus.Error("Invalid precondition", err)
+		utils.RespondError(c.Writer, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	logrus.Debugf("Deleting cache for key %s", key)
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if err := cache.Delete(key); err != nil {
+	ctx, cancel := operationContext(c)
+	defer cancel()
+	if err := cache.DeleteIf(ctx, key, condition); err != nil {
 		if err.Error() == utils.NotFound.Error() {
 			logrus.Errorf("Error for key %s: %v", key, err)
 			utils.RespondError(c.Writer, http.StatusNotFound, "Cache not Found - Failed to delete cache")
 			return
 		}
+		if err == utils.PreconditionFailed {
+			logrus.Warnf("Precondition failed deleting key %s", key)
+			utils.RespondError(c.Writer, http.StatusPreconditionFailed, err.Error())
+			return
+		}
 		logrus.Errorf("Error while deleting cache for key %s: %v", key, err)
+		if respondContextError(c, err) {
+			return
+		}
 		utils.RespondError(c.Writer, http.StatusInternalServerError, "Failed to delete cache")
 		return
 	}
@@ -237,11 +562,12 @@ func (s *Server) DeleteCacheHandler(c *gin.Context) {
 }
 
 // @Summary Clear all caches
-// @Description clear caches for the provided cache type
+// @Description clear caches for the provided cache type. When tenants are enabled only the keys of the tenant are removed
 // @ID clear-cache
 // @Accept  json
 // @Produce  json
 // @Param   system      query   string  true  "Cache Type"
+// @Param   tenantID    query   string  false "Tenant ID"
 // @Success 200  "status: ok"
 // @Failure 400  "Bad Request"
 // @Failure 404  "Not Found"
@@ -257,10 +583,13 @@ func (s *Server) ClearCacheHandler(c *gin.Context) {
 		return
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if err := cache.Clear(); err != nil {
+	ctx, cancel := operationContext(c)
+	defer cancel()
+	if err := cache.Clear(ctx); err != nil {
 		utils.LogError("Error while clearing cache", err)
+		if respondContextError(c, err) {
+			return
+		}
 		utils.RespondError(c.Writer, http.StatusInternalServerError, "Failed to clear cache")
 		return
 	}
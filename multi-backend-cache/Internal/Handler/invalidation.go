@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"multi-backend-cache/Internal/cache"
+	"multi-backend-cache/Internal/config"
+	utils "multi-backend-cache/packageUtils/Utils"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// @Summary Apply an invalidation of another replica
+// @Description Drop the keys, the tag or the whole in-memory cache or tiered L1 of a tenant changed by another replica. Posted by the peers when the replicas share invalidations without Redis, with the secret they share
+// @ID apply-invalidation
+// @Accept  json
+// @Produce  json
+// @Param   X-Invalidation-Secret header string true "Secret shared by the peers"
+// @Param   payload body cache.Invalidation true "Invalidation"
+// @Success 200  "status: ok"
+// @Failure 400  "Bad Request"
+// @Failure 401  "Unauthorized"
+// @Router /internal/invalidations [post]
+func (s *Server) InvalidationHandler(c *gin.Context) {
+	if !validInvalidationSecret(c.GetHeader(cache.InvalidationSecretHeader)) {
+		utils.RespondError(c.Writer, http.StatusUnauthorized, "Invalid invalidation secret")
+		return
+	}
+	if s.tenantCaches == nil {
+		utils.RespondError(c.Writer, http.StatusBadRequest, "In-memory cache is not enabled")
+		return
+	}
+	var invalidation cache.Invalidation
+	if err := c.ShouldBindJSON(&invalidation); err != nil {
+		logrus.Error("Invalid invalidation payload", err)
+		utils.RespondError(c.Writer, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if invalidation.Origin == "" || invalidation.TenantID == "" {
+		utils.RespondError(c.Writer, http.StatusBadRequest, "Origin and tenantID must not be null")
+		return
+	}
+	s.tenantCaches.ApplyInvalidation(invalidation)
+	utils.RespondJSON(c.Writer, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// validInvalidationSecret reports whether the secret is the one the peers share. Without a
+// configured secret no invalidation is accepted.
+func validInvalidationSecret(secret string) bool {
+	expected := config.AppConfig.Invalidation.Secret
+	return expected != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) == 1
+}
@@ -0,0 +1,229 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"multi-backend-cache/Internal/cache"
+	utils "multi-backend-cache/packageUtils/Utils"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Keys deleted per round trip by a delete job
+const deleteJobBatch = 500
+
+// How long a finished job can still be looked up
+const jobRetention = time.Hour
+
+// Status of a job
+const (
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled" // interrupted by the shutdown of the server
+)
+
+// Job is a delete by pattern running in the background
+type Job struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status" example:"running"`
+	Match      string     `json:"match" example:"session:*"`
+	Deleted    int        `json:"deleted"` // keys deleted so far
+	Batches    int        `json:"batches"` // pages of the key space done so far
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"` // nil while the job runs
+
+	system   string // the job is only visible to requests for the same system and tenant
+	tenantID string
+}
+
+// jobRegistry keeps the running jobs, and the finished ones for jobRetention. The jobs run on
+// the context of the registry, cancelled when the server shuts down.
+type jobRegistry struct {
+	lock    sync.Mutex
+	jobs    map[string]*Job
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+}
+
+func newJobRegistry() *jobRegistry {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobRegistry{jobs: make(map[string]*Job), ctx: ctx, cancel: cancel}
+}
+
+// start registers a new running job, dropping the jobs that finished long ago. It fails with
+// utils.ShuttingDown once the registry is stopped.
+func (r *jobRegistry) start(system string, tenantID string, match string) (Job, error) {
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return Job{}, err
+	}
+	job := &Job{ID: hex.EncodeToString(token), Status: JobRunning, Match: match, StartedAt: time.Now(), system: system, tenantID: tenantID}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.ctx.Err() != nil {
+		return Job{}, utils.ShuttingDown
+	}
+	for id, finished := range r.jobs {
+		if finished.Status != JobRunning && time.Since(*finished.FinishedAt) > jobRetention {
+			delete(r.jobs, id)
+		}
+	}
+	r.jobs[job.ID] = job
+	r.running.Add(1) // under the lock, so that stop waits for every job it did not refuse
+	return *job, nil
+}
+
+// stop cancels the running jobs and waits until they recorded how far they got
+func (r *jobRegistry) stop() {
+	r.lock.Lock()
+	r.cancel()
+	r.lock.Unlock()
+	r.running.Wait()
+}
+
+// get returns a copy of the job
+func (r *jobRegistry) get(id string) (Job, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	job, found := r.jobs[id]
+	if !found {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// update changes the job under the lock of the registry
+func (r *jobRegistry) update(id string, change func(job *Job)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if job, found := r.jobs[id]; found {
+		change(job)
+	}
+}
+
+// runDeleteJob deletes the keys matching the pattern of the job page by page, recording its
+// progress after every page. Each page gets the operation timeout of its own. A job interrupted
+// by the shutdown of the server is cancelled, with the keys it deleted so far.
+func (r *jobRegistry) runDeleteJob(job Job, deleter cache.MatchDeleter) {
+	defer r.running.Done()
+	cursor, total := "", 0
+	for {
+		ctx, cancel := withOperationTimeout(r.ctx)
+		deleted, next, err := deleter.DeleteMatching(ctx, cursor, job.Match, deleteJobBatch)
+		cancel()
+		total += deleted
+		if err == nil && next != "" && r.ctx.Err() != nil {
+			err = utils.ShuttingDown
+		}
+		interrupted := err != nil && r.ctx.Err() != nil
+		r.update(job.ID, func(job *Job) {
+			job.Deleted += deleted
+			job.Batches++
+			now := time.Now()
+			switch {
+			case interrupted:
+				job.Status, job.Error, job.FinishedAt = JobCancelled, utils.ShuttingDown.Error(), &now
+			case err != nil:
+				job.Status, job.Error, job.FinishedAt = JobFailed, err.Error(), &now
+			case next == "":
+				job.Status, job.FinishedAt = JobDone, &now
+			}
+		})
+		if interrupted {
+			logrus.Warnf("Job %s cancelled by the shutdown after deleting %d keys matching %s", job.ID, total, job.Match)
+			return
+		}
+		if err != nil {
+			logrus.Errorf("Job %s failed deleting keys matching %s: %v", job.ID, job.Match, err)
+			return
+		}
+		if next == "" {
+			logrus.Infof("Job %s deleted the keys matching %s", job.ID, job.Match)
+			return
+		}
+		cursor = next
+	}
+}
+
+// @Summary Delete keys by pattern
+// @Description Start a job deleting every key matching a glob pattern (Redis syntax: *, ?, [a-z], \ to escape) in the background. The keys are deleted in batches, Redis unlinks the keys of each SCAN page. The job and its progress are read from the Location header. Memcache cannot list its keys
+// @ID delete-cache-by-pattern
+// @Produce  json
+// @Param   system      query   string  true  "Cache Type"
+// @Param   match       query   string  true  "Glob pattern"
+// @Success 202  {object} handler.Job
+// @Failure 400  "Bad Request"
+// @Failure 500  "Internal Server Error"
+// @Failure 501  "Not Implemented"
+// @Failure 503  "Server is shutting down"
+// @Router /cache [delete]
+func (s *Server) DeleteMatchingHandler(c *gin.Context) {
+	match := c.Query("match")
+	if match == "" {
+		logrus.Error("Pattern must not be null")
+		utils.RespondError(c.Writer, http.StatusBadRequest, "match must not be null, PUT /cache/clear deletes every key")
+		return
+	}
+	system, tenantID := c.Query("system"), c.Query("tenantID")
+	cacheSystem := s.determineCacheLibraryType(system, tenantID)
+	if cacheSystem == nil {
+		logrus.Error("Unsupported cache type")
+		utils.RespondError(c.Writer, http.StatusBadRequest, "Unsupported cache type")
+		return
+	}
+	deleter := cache.MatchDeleterFor(cacheSystem)
+	if deleter == nil {
+		logrus.Warnf("Cache system %s cannot list its keys", system)
+		utils.RespondError(c.Writer, http.StatusNotImplemented, utils.NotSupported.Error())
+		return
+	}
+
+	job, err := s.jobs.start(system, tenantID, match)
+	if err == utils.ShuttingDown {
+		utils.RespondError(c.Writer, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Error starting the job deleting keys matching %s: %v", match, err)
+		utils.RespondError(c.Writer, http.StatusInternalServerError, "Failed to start job")
+		return
+	}
+	go s.jobs.runDeleteJob(job, deleter)
+
+	logrus.Infof("Job %s started deleting keys matching %s", job.ID, match)
+	query := url.Values{"system": {system}}
+	if tenantID != "" {
+		query.Set("tenantID", tenantID)
+	}
+	c.Header("Location", "/cache/jobs/"+job.ID+"?"+query.Encode())
+	utils.RespondJSON(c.Writer, http.StatusAccepted, job)
+}
+
+// @Summary Get a job
+// @Description Read the status and progress of a job started by DELETE /cache. Finished jobs are kept for an hour
+// @ID get-job
+// @Produce  json
+// @Param   id          path    string  true  "Job ID"
+// @Param   system      query   string  true  "Cache Type"
+// @Success 200  {object} handler.Job
+// @Failure 404  "Not Found"
+// @Router /cache/jobs/{id} [get]
+func (s *Server) GetJobHandler(c *gin.Context) {
+	job, found := s.jobs.get(c.Param("id"))
+	if !found || job.system != c.Query("system") || job.tenantID != c.Query("tenantID") {
+		logrus.Warnf("Job %s not found", c.Param("id"))
+		utils.RespondError(c.Writer, http.StatusNotFound, "Job not found")
+		return
+	}
+	utils.RespondJSON(c.Writer, http.StatusOK, job)
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"multi-backend-cache/Internal/cache"
+	utils "multi-backend-cache/packageUtils/Utils"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Keys returned by a scan page unless the request asks for another count
+const defaultScanCount = 100
+
+// @Summary List keys
+// @Description Page through the keys matching a glob pattern (Redis syntax: *, ?, [a-z], \ to escape). Pass the returned cursor to get the next page; an empty cursor means the scan is complete. Keys that exist for the whole scan are listed at least once, Redis may list a key twice. Memcache cannot list its keys
+// @ID list-cache-keys
+// @Produce  json
+// @Param   system      query   string  true  "Cache Type"
+// @Param   match       query   string  false "Glob pattern, all keys by default"
+// @Param   cursor      query   string  false "Cursor returned by the previous page"
+// @Param   count       query   int     false "Keys per page, 100 by default"
+// @Success 200  "keys and next cursor"
+// @Failure 400  "Bad Request"
+// @Failure 500  "Internal Server Error"
+// @Failure 501  "Not Implemented"
+// @Router /cache/keys [get]
+func (s *Server) ListKeysHandler(c *gin.Context) {
+	count := defaultScanCount
+	if value := c.Query("count"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxBatchSize {
+			logrus.Errorf("Invalid scan count %q", value)
+			utils.RespondError(c.Writer, http.StatusBadRequest, "count must be between 1 and "+strconv.Itoa(maxBatchSize))
+			return
+		}
+		count = parsed
+	}
+
+	cacheSystem := s.determineCacheLibraryType(c.Query("system"), c.Query("tenantID"))
+	if cacheSystem == nil {
+		logrus.Error("Unsupported cache type")
+		utils.RespondError(c.Writer, http.StatusBadRequest, "Unsupported cache type")
+		return
+	}
+	scanner, ok := cacheSystem.(cache.Scanner)
+	if !ok {
+		logrus.Warnf("Cache system %s cannot list its keys", c.Query("system"))
+		utils.RespondError(c.Writer, http.StatusNotImplemented, utils.NotSupported.Error())
+		return
+	}
+
+	ctx, cancel := operationContext(c)
+	defer cancel()
+	keys, cursor, err := scanner.Scan(ctx, c.Query("cursor"), c.Query("match"), count)
+	if err != nil {
+		logrus.Errorf("Error while listing keys: %v", err)
+		switch err {
+		case utils.InvalidCursor:
+			utils.RespondError(c.Writer, http.StatusBadRequest, err.Error())
+			return
+		case utils.NotSupported:
+			utils.RespondError(c.Writer, http.StatusNotImplemented, err.Error())
+			return
+		}
+		if respondContextError(c, err) {
+			return
+		}
+		utils.RespondError(c.Writer, http.StatusInternalServerError, "Failed to list keys")
+		return
+	}
+
+	logrus.Infof("Listed %d keys", len(keys))
+	utils.RespondJSON(c.Writer, http.StatusOK, map[string]interface{}{
+		"keys":   keys,
+		"cursor": cursor,
+	})
+}
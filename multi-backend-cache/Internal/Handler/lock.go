@@ -0,0 +1,194 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"multi-backend-cache/Internal/cache"
+	utils "multi-backend-cache/packageUtils/Utils"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+type LockPayload struct {
+	Owner string `json:"owner" example:"3f2b9c0e8d7a41f6a5b4c3d2e1f00112"` // returned on acquisition, required to refresh and release
+	TTL   int64  `json:"ttl" example:"30000"`                              // lease, in milliseconds
+}
+
+// Longest lock name accepted, which leaves room for the tenant and lock prefixes in a memcache key
+const maxLockNameLength = 128
+
+/* Checks that the lock name can name a key in every backend.
+ */
+func validateLockName(name string) error {
+	if name == "" {
+		return fmt.Errorf("Lock name must not be null")
+	}
+	if len(name) > maxLockNameLength {
+		return fmt.Errorf("Lock name is longer than %d bytes", maxLockNameLength)
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] == 0x7f {
+			return fmt.Errorf("Lock name must not contain spaces or control characters")
+		}
+	}
+	return nil
+}
+
+/* Validates the lock name and binds the payload of a lock request: the lease is required to acquire and refresh, the owner to refresh and release.
+ */
+func bindLockPayload(c *gin.Context, needsTTL bool, needsOwner bool) (LockPayload, bool) {
+	var payload LockPayload
+	if err := validateLockName(c.Param("name")); err != nil {
+		logrus.Error(err)
+		utils.RespondError(c.Writer, http.StatusBadRequest, err.Error())
+		return payload, false
+	}
+	if err := c.ShouldBindJSON(&payload); err != nil && err != io.EOF {
+		logrus.Error("Invalid request payload", err)
+		utils.RespondError(c.Writer, http.StatusBadRequest, "Invalid request payload")
+		return payload, false
+	}
+	if needsTTL && payload.TTL <= 0 {
+		logrus.Error("Lock lease must be positive")
+		utils.RespondError(c.Writer, http.StatusBadRequest, "ttl must be a positive number of milliseconds")
+		return payload, false
+	}
+	if needsOwner && payload.Owner == "" {
+		logrus.Error("Lock owner must not be null")
+		utils.RespondError(c.Writer, http.StatusBadRequest, "owner must not be null")
+		return payload, false
+	}
+	return payload, true
+}
+
+/* Returns the locker of the requested cache system, answering 400 when it is not supported.
+ */
+func (s *Server) locker(c *gin.Context) cache.Locker {
+	cacheSystem := s.determineCacheLibraryType(c.Query("system"), c.Query("tenantID"))
+	if cacheSystem == nil {
+		logrus.Error("Unsupported cache type")
+		utils.RespondError(c.Writer, http.StatusBadRequest, "Unsupported cache type")
+		return nil
+	}
+	return cache.LockerFor(cacheSystem)
+}
+
+/* Answers a failed lock operation.
+ */
+func respondLockError(c *gin.Context, name string, err error) {
+	switch err {
+	case utils.Locked, utils.NotOwner:
+		logrus.Warnf("Lock %s: %v", name, err)
+		utils.RespondError(c.Writer, http.StatusConflict, err.Error())
+		return
+	}
+	logrus.Errorf("Error on lock %s: %v", name, err)
+	if respondContextError(c, err) {
+		return
+	}
+	utils.RespondError(c.Writer, http.StatusInternalServerError, "Failed to update lock")
+}
+
+// @Summary Acquire a lock
+// @Description Take the named lock for a lease of ttl milliseconds. The response holds the owner token, needed to refresh and release the lock, and a fencing token that grows with every acquisition. In-memory and Memcache leases are rounded up to the second
+// @ID acquire-lock
+// @Accept  json
+// @Produce  json
+// @Param   name        path    string  true  "Lock Name"
+// @Param   system      query   string  true  "Cache Type"
+// @Param   payload body handler.LockPayload true "Lease in milliseconds"
+// @Success 200  {object} cache.Lease
+// @Failure 400  "Bad Request"
+// @Failure 409  "Lock is held by another owner"
+// @Failure 500  "Internal Server Error"
+// @Router /locks/{name} [post]
+func (s *Server) AcquireLockHandler(c *gin.Context) {
+	payload, ok := bindLockPayload(c, true, false)
+	if !ok {
+		return
+	}
+	locker := s.locker(c)
+	if locker == nil {
+		return
+	}
+	name := c.Param("name")
+	ctx, cancel := operationContext(c)
+	defer cancel()
+	lease, err := locker.Acquire(ctx, name, time.Duration(payload.TTL)*time.Millisecond)
+	if err != nil {
+		respondLockError(c, name, err)
+		return
+	}
+	logrus.Infof("Lock %s acquired with fencing token %d", name, lease.Fence)
+	utils.RespondJSON(c.Writer, http.StatusOK, lease)
+}
+
+// @Summary Refresh a lock
+// @Description Extend the lease of the owner to ttl milliseconds from now
+// @ID refresh-lock
+// @Accept  json
+// @Produce  json
+// @Param   name        path    string  true  "Lock Name"
+// @Param   system      query   string  true  "Cache Type"
+// @Param   payload body handler.LockPayload true "Owner and lease in milliseconds"
+// @Success 200  {object} cache.Lease
+// @Failure 400  "Bad Request"
+// @Failure 409  "Lock is not held by this owner"
+// @Failure 500  "Internal Server Error"
+// @Router /locks/{name}/refresh [post]
+func (s *Server) RefreshLockHandler(c *gin.Context) {
+	payload, ok := bindLockPayload(c, true, true)
+	if !ok {
+		return
+	}
+	locker := s.locker(c)
+	if locker == nil {
+		return
+	}
+	name := c.Param("name")
+	ctx, cancel := operationContext(c)
+	defer cancel()
+	lease, err := locker.Refresh(ctx, name, payload.Owner, time.Duration(payload.TTL)*time.Millisecond)
+	if err != nil {
+		respondLockError(c, name, err)
+		return
+	}
+	logrus.Infof("Lock %s refreshed", name)
+	utils.RespondJSON(c.Writer, http.StatusOK, lease)
+}
+
+// @Summary Release a lock
+// @Description Free the lock held by the owner
+// @ID release-lock
+// @Accept  json
+// @Produce  json
+// @Param   name        path    string  true  "Lock Name"
+// @Param   system      query   string  true  "Cache Type"
+// @Param   payload body handler.LockPayload true "Owner"
+// @Success 200  "status: ok"
+// @Failure 400  "Bad Request"
+// @Failure 409  "Lock is not held by this owner"
+// @Failure 500  "Internal Server Error"
+// @Router /locks/{name}/release [post]
+func (s *Server) ReleaseLockHandler(c *gin.Context) {
+	payload, ok := bindLockPayload(c, false, true)
+	if !ok {
+		return
+	}
+	locker := s.locker(c)
+	if locker == nil {
+		return
+	}
+	name := c.Param("name")
+	ctx, cancel := operationContext(c)
+	defer cancel()
+	if err := locker.Release(ctx, name, payload.Owner); err != nil {
+		respondLockError(c, name, err)
+		return
+	}
+	logrus.Infof("Lock %s released", name)
+	utils.RespondJSON(c.Writer, http.StatusOK, map[string]string{"status": "ok"})
+}
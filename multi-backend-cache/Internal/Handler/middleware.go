@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"multi-backend-cache/Internal/cache"
 	"multi-backend-cache/Internal/config"
 	"net/http"
 
@@ -8,11 +9,13 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func ValidateTenant() gin.HandlerFunc {
+// ValidateTenant rejects requests for tenants that do not exist. Tenants are looked up in the
+// tenant caches, so tenants added or removed at runtime are seen immediately.
+func ValidateTenant(tenantCaches *cache.FixedTenantsCaches) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		tenantID := c.Query("tenantID")
 		logrus.Debugf("Received tenantID from parameter: %s", tenantID)
-		if tenantID == "" || !isTenantValid(tenantID) {
+		if tenantID == "" || !isTenantValid(tenantCaches, tenantID) {
 			logrus.Warnf("Invalid or missing tenantID: %s", tenantID)
 			c.JSON(http.StatusNotFound, gin.H{"error": "Tenant Not Found"})
 			c.Abort()
@@ -23,14 +26,12 @@ func ValidateTenant() gin.HandlerFunc {
 	}
 }
 
-func isTenantValid(tenantID string) bool {
-	for _, tenant := range config.AppConfig.TenantIDs {
-		if tenant == tenantID {
-			logrus.Debugf("Valid tenantID: %s", tenantID)
-			return true
-		}
+func isTenantValid(tenantCaches *cache.FixedTenantsCaches, tenantID string) bool {
+	if tenantCaches != nil && tenantCaches.HasTenant(tenantID) {
+		logrus.Debugf("Valid tenantID: %s", tenantID)
+		return true
 	}
-	logrus.Warnf("TenantID not found in configuration: %s", tenantID)
+	logrus.Warnf("TenantID not found: %s", tenantID)
 	return false
 }
 
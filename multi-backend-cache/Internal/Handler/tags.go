@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"multi-backend-cache/Internal/cache"
+	utils "multi-backend-cache/packageUtils/Utils"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Longest tag accepted, which leaves room for the tenant and tag prefixes in a memcache key
+const maxTagLength = 200
+
+// validateTags checks that the tags can name a key in every backend
+func validateTags(tags []string) error {
+	for _, tag := range tags {
+		if tag == "" {
+			return fmt.Errorf("Tag must not be null")
+		}
+		if len(tag) > maxTagLength {
+			return fmt.Errorf("Tag %q is longer than %d bytes", tag, maxTagLength)
+		}
+		for i := 0; i < len(tag); i++ {
+			if tag[i] <= ' ' || tag[i] == 0x7f {
+				return fmt.Errorf("Tag %q must not contain spaces or control characters", tag)
+			}
+		}
+	}
+	return nil
+}
+
+// setEntry writes the payload with its tags, failing with utils.NotSupported when it has tags
+// the backend cannot keep
+func setEntry(ctx context.Context, cacheSystem cache.CacheSystem, payload cache.CacheData, condition cache.Condition) (uint64, error) {
+	if len(payload.Tags) == 0 {
+		return cacheSystem.SetIf(ctx, payload.Key, payload.Value, payload.SoftTTL, payload.TTL, condition)
+	}
+	tagger, ok := cacheSystem.(cache.Tagger)
+	if !ok {
+		return 0, utils.NotSupported
+	}
+	return tagger.SetTagged(ctx, payload.Key, payload.Value, payload.SoftTTL, payload.TTL, condition, payload.Tags)
+}
+
+// @Summary Invalidate a tag
+// @Description Delete every entry written with the tag by POST /cache. Memcache cannot count the entries, which read as missing from then on and are left to expire
+// @ID invalidate-tag
+// @Produce  json
+// @Param   tag         path    string  true  "Tag"
+// @Param   system      query   string  true  "Cache Type"
+// @Success 200  "status: ok, and the number of deleted entries when known"
+// @Failure 400  "Bad Request"
+// @Failure 500  "Internal Server Error"
+// @Failure 501  "Not Implemented"
+// @Router /cache/tags/{tag} [delete]
+func (s *Server) InvalidateTagHandler(c *gin.Context) {
+	tag := c.Param("tag")
+	if err := validateTags([]string{tag}); err != nil {
+		logrus.Error(err)
+		utils.RespondError(c.Writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	cacheSystem := s.determineCacheLibraryType(c.Query("system"), c.Query("tenantID"))
+	if cacheSystem == nil {
+		logrus.Error("Unsupported cache type")
+		utils.RespondError(c.Writer, http.StatusBadRequest, "Unsupported cache type")
+		return
+	}
+	tagger, ok := cacheSystem.(cache.Tagger)
+	if !ok {
+		logrus.Warnf("Cache system %s cannot invalidate tags", c.Query("system"))
+		utils.RespondError(c.Writer, http.StatusNotImplemented, utils.NotSupported.Error())
+		return
+	}
+
+	ctx, cancel := operationContext(c)
+	defer cancel()
+	deleted, err := tagger.InvalidateTag(ctx, tag)
+	if err != nil {
+		logrus.Errorf("Error while invalidating tag %s: %v", tag, err)
+		if err == utils.NotSupported {
+			utils.RespondError(c.Writer, http.StatusNotImplemented, err.Error())
+			return
+		}
+		if respondContextError(c, err) {
+			return
+		}
+		utils.RespondError(c.Writer, http.StatusInternalServerError, "Failed to invalidate tag")
+		return
+	}
+
+	response := map[string]interface{}{"status": "ok"}
+	if deleted >= 0 {
+		response["deleted"] = deleted
+	}
+	utils.RespondJSON(c.Writer, http.StatusOK, response)
+}
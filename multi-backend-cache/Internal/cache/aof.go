@@ -0,0 +1,313 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Fsync policies of the append-only log.
+const (
+	FsyncAlways   = "always"   // fsync after every write
+	FsyncEverySec = "everysec" // fsync once per second, at most a second of writes is lost
+	FsyncNever    = "never"    // leave flushing to the operating system
+)
+
+// Operations recorded in the append-only log. Records without an operation are sets, so that
+// a snapshot is a valid log.
+const (
+	aofOpSet    = "set"
+	aofOpDelete = "del"
+	aofOpClear  = "clear"
+)
+
+const defaultAOFRewriteMinSize = 64 << 20
+
+// aofRecord is one line of the append-only log
+type aofRecord struct {
+	Op string `json:"op,omitempty"`
+	snapshotRecord
+}
+
+// appendLog is the append-only log of a cache. Mutations are appended while the lock of
+// their shard is held, so the log has the same order as the cache. The log is compacted in
+// the background by rewriting it as a snapshot followed by the writes made meanwhile.
+type appendLog struct {
+	path           string
+	fsync          string
+	minRewriteSize int64
+	cache          *LRUCache
+
+	lock          sync.Mutex
+	file          *os.File
+	size          int64 // bytes in the log
+	baseSize      int64 // bytes in the log after the last rewrite
+	dirty         bool  // written since the last fsync
+	closed        bool
+	rewriting     bool
+	rewriteBuffer [][]byte // writes made during a rewrite
+	rewrites      sync.WaitGroup
+}
+
+// EnableAppendLog replays the append-only log at path into the cache, then appends every
+// following Set, Delete and Clear to it. It returns the number of replayed records.
+func (c *LRUCache) EnableAppendLog(path string, fsync string, minRewriteSize int64) (int, error) {
+	switch fsync {
+	case "":
+		fsync = FsyncEverySec
+	case FsyncAlways, FsyncEverySec, FsyncNever:
+	default:
+		return 0, fmt.Errorf("unknown fsync policy %q", fsync)
+	}
+	if minRewriteSize <= 0 {
+		minRewriteSize = defaultAOFRewriteMinSize
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, err
+	}
+	replayed, size, err := c.replayLog(path)
+	if err != nil {
+		return replayed, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return replayed, err
+	}
+	c.aof = &appendLog{
+		path:           path,
+		fsync:          fsync,
+		minRewriteSize: minRewriteSize,
+		cache:          c,
+		file:           file,
+		size:           size,
+		baseSize:       size,
+	}
+	if fsync == FsyncEverySec {
+		c.janitors.Add(1)
+		go syncAppendLog(c)
+	}
+	return replayed, nil
+}
+
+// replayLog applies the records of the log at path and returns their number along with the
+// size of the valid part of the log. A torn or corrupt tail is truncated.
+func (c *LRUCache) replayLog(path string) (int, int64, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	replayed := 0
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return replayed, offset, nil
+		}
+		var record aofRecord
+		if err == nil {
+			err = json.Unmarshal(line, &record)
+		}
+		if err != nil {
+			logrus.Warnf("Truncating the append-only log %s at byte %d: %v", path, offset, err)
+			return replayed, offset, file.Truncate(offset)
+		}
+		c.applyRecord(record)
+		offset += int64(len(line))
+		replayed++
+	}
+}
+
+// applyRecord replays one record of the log
+func (c *LRUCache) applyRecord(record aofRecord) {
+	switch record.Op {
+	case "", aofOpSet:
+		if IsExpired(record.ExpiryTime) {
+			return
+		}
+		shard := c.shard(record.Key)
+		shard.lock.Lock()
+		if err := shard.setWithExpiry(record.Key, record.Value, record.TTL, record.ExpiryTime, record.softExpiry(), 0, record.Tags); err != nil {
+			logrus.Warnf("Skipping logged entry %s: %v", record.Key, err)
+		}
+		shard.lock.Unlock()
+	case aofOpDelete:
+		shard := c.shard(record.Key)
+		shard.lock.Lock()
+		shard.delete(record.Key)
+		shard.lock.Unlock()
+	case aofOpClear:
+		for _, shard := range c.shards {
+			shard.lock.Lock()
+			shard.clear()
+			shard.lock.Unlock()
+		}
+	}
+}
+
+// logRecord appends a record to the log of the cache, if it has one. Caller must hold the lock
+// of the shard the record belongs to, or every shard lock for a clear.
+func (c *LRUCache) logRecord(record aofRecord) error {
+	if c.aof == nil {
+		return nil
+	}
+	return c.aof.append(record)
+}
+
+func (l *appendLog) append(record aofRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return fmt.Errorf("append-only log %s is closed", l.path)
+	}
+	if _, err := l.file.Write(line); err != nil {
+		logrus.Errorf("Error writing to the append-only log %s: %v", l.path, err)
+		return err
+	}
+	l.size += int64(len(line))
+	if l.rewriting {
+		l.rewriteBuffer = append(l.rewriteBuffer, line)
+	}
+	switch l.fsync {
+	case FsyncAlways:
+		if err := l.file.Sync(); err != nil {
+			logrus.Errorf("Error syncing the append-only log %s: %v", l.path, err)
+			return err
+		}
+	case FsyncEverySec:
+		l.dirty = true
+	}
+	if !l.rewriting && l.size >= l.minRewriteSize && l.size >= 2*l.baseSize {
+		l.rewriting = true
+		l.rewrites.Add(1)
+		go l.rewrite()
+	}
+	return nil
+}
+
+// rewrite compacts the log in the background
+func (l *appendLog) rewrite() {
+	defer l.rewrites.Done()
+	start := time.Now()
+	if err := l.compact(); err != nil {
+		logrus.Errorf("Error rewriting the append-only log %s: %v", l.path, err)
+		l.lock.Lock()
+		l.rewriting = false
+		l.rewriteBuffer = nil
+		l.baseSize = l.size // wait for the log to double again before retrying
+		l.lock.Unlock()
+		return
+	}
+	logrus.Infof("Rewrote the append-only log %s in %v", l.path, time.Since(start))
+}
+
+// compact writes a snapshot of the cache to a temporary file, appends the writes made while
+// it was taken and swaps it in place of the log
+func (l *appendLog) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".rewrite*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := l.cache.Snapshot(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, err := tmp.Write(bytes.Join(l.rewriteBuffer, nil)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), l.path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	l.file.Close()
+	l.file = file
+	l.size = info.Size()
+	l.baseSize = l.size
+	l.dirty = false
+	l.rewriting = false
+	l.rewriteBuffer = nil
+	return nil
+}
+
+// sync flushes the log to disk if it was written since the last fsync
+func (l *appendLog) sync() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.dirty || l.closed {
+		return
+	}
+	if err := l.file.Sync(); err != nil {
+		logrus.Errorf("Error syncing the append-only log %s: %v", l.path, err)
+		return
+	}
+	l.dirty = false
+}
+
+// close waits for a running rewrite, then flushes and closes the log
+func (l *appendLog) close() error {
+	l.lock.Lock()
+	l.closed = true
+	l.lock.Unlock()
+	l.rewrites.Wait()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// Go-routine that fsyncs the log of the cache every second, until the cache is closed
+func syncAppendLog(lru *LRUCache) {
+	defer lru.janitors.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lru.stop:
+			return
+		case <-ticker.C:
+			lru.aof.sync()
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"multi-backend-cache/Internal/config"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// Invalidations waiting to be published. When the bus falls further behind, the changes that do
+// not fit are not told to the other replicas, whose entries then live until their TTL.
+const invalidationQueueSize = 4096
+
+const (
+	defaultInvalidationChannel = "cache:invalidations"
+	// InvalidationPath is the endpoint of every replica the peer bus posts the invalidations to
+	InvalidationPath = "/internal/invalidations"
+	// InvalidationSecretHeader carries the secret shared by the peers, see InvalidationConfig.Secret
+	InvalidationSecretHeader = "X-Invalidation-Secret"
+)
+
+// Invalidation tells the other replicas which entries of a tenant cache changed: a list of
+// keys, a tag or the whole cache. Replicas drop those entries, they do not copy the new values.
+type Invalidation struct {
+	Origin   string   `json:"origin"` // instance ID of the replica that made the change
+	TenantID string   `json:"tenantID"`
+	Keys     []string `json:"keys,omitempty"`
+	Tag      string   `json:"tag,omitempty"`
+	Clear    bool     `json:"clear,omitempty"`
+	Tiered   bool     `json:"tiered,omitempty"` // the change is to the tiered L1 of the tenant rather than its in-memory cache
+}
+
+// InvalidationBus carries the invalidations of a replica to the others
+type InvalidationBus interface {
+	Publish(ctx context.Context, invalidation Invalidation) error
+}
+
+// invalidationListener is implemented by the buses the replicas subscribe to. The peer bus has
+// none, its invalidations arrive at InvalidationPath.
+type invalidationListener interface {
+	// Listen applies the invalidations of the bus until the context is done
+	Listen(ctx context.Context, apply func(Invalidation))
+}
+
+// invalidationOutbox queues the invalidations of one tenant cache for the sender of the tenant caches
+type invalidationOutbox struct {
+	tenantID string
+	tiered   bool // the cache is the tiered L1 of the tenant
+	queue    chan<- Invalidation
+}
+
+// NewInvalidationBus publishes on Redis when Redis is configured, otherwise to the peers
+func NewInvalidationBus(invalidationConfig config.InvalidationConfig, redisCache *RedisCache) InvalidationBus {
+	if config.AppConfig.Redis.Address != "" && redisCache != nil {
+		channel := invalidationConfig.Channel
+		if channel == "" {
+			channel = defaultInvalidationChannel
+		}
+		logrus.Infof("Publishing the invalidations on the Redis channel %s", channel)
+		return &RedisInvalidationBus{client: redisCache.client, channel: channel}
+	}
+	logrus.Infof("Publishing the invalidations to the peers %v", invalidationConfig.Peers)
+	return NewPeerInvalidationBus(invalidationConfig.Peers, invalidationConfig.Secret)
+}
+
+// NewInstanceID identifies a replica by its host name and a random suffix
+func NewInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "cache"
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return fmt.Sprintf("%s-%d", host, time.Now().UnixNano())
+	}
+	return host + "-" + hex.EncodeToString(suffix)
+}
+
+// RedisInvalidationBus publishes the invalidations on a Redis pub/sub channel every replica
+// subscribes to. Pub/sub does not keep messages, a replica misses those sent while it is
+// disconnected.
+type RedisInvalidationBus struct {
+	client  *redis.Client
+	channel string
+}
+
+func (b *RedisInvalidationBus) Publish(ctx context.Context, invalidation Invalidation) error {
+	payload, err := json.Marshal(invalidation)
+	if err != nil {
+		return err
+	}
+	if err := b.client.Publish(ctx, b.channel, payload).Err(); err != nil {
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+func (b *RedisInvalidationBus) Listen(ctx context.Context, apply func(Invalidation)) {
+	subscription := b.client.Subscribe(ctx, b.channel)
+	defer subscription.Close()
+	messages := subscription.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+			var invalidation Invalidation
+			if err := json.Unmarshal([]byte(message.Payload), &invalidation); err != nil {
+				logrus.Errorf("Ignoring the invalid invalidation %q: %v", message.Payload, err)
+				continue
+			}
+			apply(invalidation)
+		}
+	}
+}
+
+// PeerInvalidationBus posts every invalidation to InvalidationPath of each peer, for the
+// deployments without Redis, with the secret the peers share
+type PeerInvalidationBus struct {
+	peers  []string // base URLs
+	secret string
+	client *http.Client
+}
+
+func NewPeerInvalidationBus(peers []string, secret string) *PeerInvalidationBus {
+	bus := &PeerInvalidationBus{secret: secret, client: &http.Client{}}
+	for _, peer := range peers {
+		if peer = strings.TrimRight(peer, "/"); peer != "" {
+			bus.peers = append(bus.peers, peer)
+		}
+	}
+	return bus
+}
+
+// Publish posts to the peers concurrently and reports the peers that failed
+func (b *PeerInvalidationBus) Publish(ctx context.Context, invalidation Invalidation) error {
+	payload, err := json.Marshal(invalidation)
+	if err != nil {
+		return err
+	}
+	errs := make([]error, len(b.peers))
+	var wg sync.WaitGroup
+	for i, peer := range b.peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			if err := b.post(ctx, peer, payload); err != nil {
+				errs[i] = fmt.Errorf("peer %s: %w", peer, err)
+			}
+		}(i, peer)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (b *PeerInvalidationBus) post(ctx context.Context, peer string, payload []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+InvalidationPath, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(InvalidationSecretHeader, b.secret)
+	response, err := b.client.Do(request)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// broadcast queues an invalidation for the other replicas when the cache belongs to tenant
+// caches sharing them. It never blocks, so that it can be called under the shard locks. The
+// reserved keys are left out: the locks of the in-memory caches belong to each replica.
+func (c *LRUCache) broadcast(invalidation Invalidation) {
+	outbox := c.invalidations.Load()
+	if outbox == nil {
+		return
+	}
+	if len(invalidation.Keys) > 0 {
+		if invalidation.Keys = withoutReservedKeys(invalidation.Keys); len(invalidation.Keys) == 0 {
+			return
+		}
+	}
+	invalidation.TenantID = outbox.tenantID
+	invalidation.Tiered = outbox.tiered
+	select {
+	case outbox.queue <- invalidation:
+	default:
+		logrus.Warnf("Invalidation queue full, the other replicas keep tenant %s keys %v", outbox.tenantID, invalidation.Keys)
+	}
+}
+
+// withoutReservedKeys returns the keys that are not reserved, leaving the given slice untouched
+func withoutReservedKeys(keys []string) []string {
+	kept := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if !IsReservedKey(key) {
+			kept = append(kept, key)
+		}
+	}
+	return kept
+}
+
+// Invalidate applies an invalidation of another replica. The entries are removed like Delete,
+// Clear and InvalidateTag would, without broadcasting the changes again. Reserved keys are
+// ignored, the locks of this replica are its own.
+func (c *LRUCache) Invalidate(invalidation Invalidation) error {
+	switch {
+	case invalidation.Clear:
+		return c.clear()
+	case invalidation.Tag != "":
+		_, err := c.invalidateTag(invalidation.Tag)
+		return err
+	}
+	for _, key := range invalidation.Keys {
+		if IsReservedKey(key) {
+			continue
+		}
+		shard := c.shard(key)
+		shard.lock.Lock()
+		_, err := c.delete(shard, key)
+		shard.lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnableInvalidation makes every tenant cache, present or added later, broadcast its changes
+// over the bus, and applies those of the other replicas received from it
+func (ftc *FixedTenantsCaches) EnableInvalidation(invalidationConfig config.InvalidationConfig, bus InvalidationBus) {
+	instanceID := invalidationConfig.InstanceID
+	if instanceID == "" {
+		instanceID = NewInstanceID()
+	}
+	timeout := invalidationConfig.Timeout
+	if timeout <= 0 {
+		timeout = config.AppConfig.OperationTimeout
+	}
+	queue := make(chan Invalidation, invalidationQueueSize)
+
+	ftc.lock.Lock()
+	ftc.instanceID = instanceID
+	ftc.invalidations = queue
+	for tenantID, cache := range ftc.caches {
+		cache.invalidations.Store(&invalidationOutbox{tenantID: tenantID, queue: queue})
+	}
+	for tenantID, l1 := range ftc.tieredCaches {
+		l1.invalidations.Store(&invalidationOutbox{tenantID: tenantID, tiered: true, queue: queue})
+	}
+	ftc.lock.Unlock()
+
+	ftc.janitors.Add(1)
+	go sendInvalidations(ftc, bus, queue, instanceID, time.Duration(timeout)*time.Millisecond)
+	if listener, ok := bus.(invalidationListener); ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		ftc.janitors.Add(1)
+		go func() {
+			defer ftc.janitors.Done()
+			<-ftc.stop
+			cancel()
+		}()
+		ftc.janitors.Add(1)
+		go func() {
+			defer ftc.janitors.Done()
+			listener.Listen(ctx, ftc.ApplyInvalidation)
+		}()
+	}
+	logrus.Infof("Sharing the invalidations of the in-memory caches as instance %s", instanceID)
+}
+
+// sendInvalidations publishes the queued invalidations one by one until the tenant caches are closed
+func sendInvalidations(ftc *FixedTenantsCaches, bus InvalidationBus, queue <-chan Invalidation, instanceID string, timeout time.Duration) {
+	defer ftc.janitors.Done()
+	for {
+		select {
+		case <-ftc.stop:
+			return
+		case invalidation := <-queue:
+			invalidation.Origin = instanceID
+			publishInvalidation(bus, invalidation, timeout)
+		}
+	}
+}
+
+func publishInvalidation(bus InvalidationBus, invalidation Invalidation, timeout time.Duration) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := bus.Publish(ctx, invalidation); err != nil {
+		logrus.Errorf("Error publishing the invalidation of tenant %s: %v", invalidation.TenantID, err)
+	}
+}
+
+// ApplyInvalidation applies an invalidation received from the bus to the cache of its tenant,
+// or to its tiered L1, ignoring those of this replica, of unknown tenants and of a tiered L1 not
+// created here
+func (ftc *FixedTenantsCaches) ApplyInvalidation(invalidation Invalidation) {
+	ftc.lock.RLock()
+	instanceID := ftc.instanceID
+	cache := ftc.caches[invalidation.TenantID]
+	if invalidation.Tiered {
+		cache = ftc.tieredCaches[invalidation.TenantID]
+	}
+	ftc.lock.RUnlock()
+	if invalidation.Origin == instanceID || cache == nil {
+		return
+	}
+	if err := cache.Invalidate(invalidation); err != nil {
+		logrus.Errorf("Error applying the invalidation of tenant %s from %s: %v", invalidation.TenantID, invalidation.Origin, err)
+		return
+	}
+	logrus.Debugf("Applied the invalidation of tenant %s from %s", invalidation.TenantID, invalidation.Origin)
+}
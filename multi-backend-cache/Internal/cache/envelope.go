@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+// Values stored with a soft TTL or with tags in the remote backends are wrapped in an envelope
+// that carries them. Other values are stored bare, so that keys written before or by other
+// clients read as they are.
+var envelopeMarker = []byte(`{"__cache_envelope__":1,`)
+
+type envelope struct {
+	Marker     int               `json:"__cache_envelope__"` // first, so that the encoding starts with envelopeMarker
+	SoftExpiry time.Time         `json:"soft_expiry"`
+	Tags       map[string]string `json:"tags,omitempty"` // generation of each tag when the value was written, see MemCache
+	Value      json.RawMessage   `json:"value"`
+}
+
+// encodeValue marshals a value, in an envelope when it turns stale at softExpiry
+func encodeValue(value interface{}, softExpiry time.Time) ([]byte, error) {
+	return encodeTaggedValue(value, softExpiry, nil)
+}
+
+// encodeTaggedValue is encodeValue for a value carrying the generations of its tags
+func encodeTaggedValue(value interface{}, softExpiry time.Time, tags map[string]string) ([]byte, error) {
+	raw, err := json.Marshal(value)
+	if err != nil || (softExpiry.IsZero() && len(tags) == 0) {
+		return raw, err
+	}
+	return json.Marshal(envelope{Marker: 1, SoftExpiry: softExpiry, Tags: tags, Value: raw})
+}
+
+// decodeValue unmarshals a value written by encodeValue and returns its soft expiry, zero for
+// bare values
+func decodeValue(raw []byte) (interface{}, time.Time, error) {
+	value, softExpiry, _, err := decodeTaggedValue(raw)
+	return value, softExpiry, err
+}
+
+// decodeTaggedValue is decodeValue that also returns the generations of the tags of the value
+func decodeTaggedValue(raw []byte) (interface{}, time.Time, map[string]string, error) {
+	var softExpiry time.Time
+	var tags map[string]string
+	if bytes.HasPrefix(raw, envelopeMarker) {
+		var wrapped envelope
+		if err := json.Unmarshal(raw, &wrapped); err != nil {
+			return nil, time.Time{}, nil, err
+		}
+		raw, softExpiry, tags = wrapped.Value, wrapped.SoftExpiry, wrapped.Tags
+	}
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, time.Time{}, nil, err
+	}
+	return value, softExpiry, tags, nil
+}
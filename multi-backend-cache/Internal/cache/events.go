@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"context"
+	utils "multi-backend-cache/packageUtils/Utils"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// Types of change events
+const (
+	EventSet    = "set"
+	EventDelete = "delete"
+	EventExpire = "expire"
+	EventEvict  = "evict"
+	EventClear  = "clear"
+)
+
+// Events buffered for each watcher. A watcher that falls further behind misses the events that
+// do not fit, like a Redis pub/sub client.
+const eventBufferSize = 256
+
+// Event is a change of a key, or the clear of the whole cache
+type Event struct {
+	Type string    `json:"type" example:"set"`
+	Key  string    `json:"key,omitempty" example:"1"` // empty for a clear
+	Time time.Time `json:"time"`
+}
+
+// Watcher is implemented by the backends that can stream their changes
+type Watcher interface {
+	// Watch streams the changes of the keys matching the glob pattern, empty for all, and the
+	// clears of the cache. The channel is closed once the context is done.
+	Watch(ctx context.Context, match string) (<-chan Event, error)
+}
+
+// eventBroker fans the events of an in-memory cache out to its watchers. Events are published
+// under the shard locks, so publishing never blocks: an event is dropped for a watcher whose
+// buffer is full.
+type eventBroker struct {
+	lock     sync.RWMutex
+	watchers map[*eventWatcher]struct{}
+	count    atomic.Int32 // watchers, read without the lock so that caches nobody watches pay nothing
+	closed   bool
+}
+
+type eventWatcher struct {
+	match  string
+	events chan Event
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{watchers: make(map[*eventWatcher]struct{})}
+}
+
+// publish sends an event to the watchers of its key. The changes of reserved keys are not
+// streamed, like Scan does not list them.
+func (b *eventBroker) publish(eventType string, key string) {
+	if b.count.Load() == 0 || IsReservedKey(key) {
+		return
+	}
+	event := Event{Type: eventType, Key: key, Time: time.Now()}
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for watcher := range b.watchers {
+		if eventType != EventClear && !matchGlob(watcher.match, key) {
+			continue
+		}
+		select {
+		case watcher.events <- event:
+		default:
+			logrus.Debugf("Dropping %s event of key %s for a slow watcher", eventType, key)
+		}
+	}
+}
+
+// watch registers a watcher until the context is done or the broker is closed
+func (b *eventBroker) watch(ctx context.Context, match string) <-chan Event {
+	watcher := &eventWatcher{match: match, events: make(chan Event, eventBufferSize)}
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		close(watcher.events)
+		return watcher.events
+	}
+	b.watchers[watcher] = struct{}{}
+	b.count.Add(1)
+	b.lock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if _, found := b.watchers[watcher]; found {
+			delete(b.watchers, watcher)
+			b.count.Add(-1)
+			close(watcher.events)
+		}
+	}()
+	return watcher.events
+}
+
+// close ends every watch, and those started later
+func (b *eventBroker) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	for watcher := range b.watchers {
+		delete(b.watchers, watcher)
+		close(watcher.events)
+	}
+	b.count.Store(0)
+}
+
+// Watch streams the sets, deletes, expiries and evictions of the cache, and its clears
+func (c *LRUCache) Watch(ctx context.Context, match string) (<-chan Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.events.watch(ctx, match), nil
+}
+
+// redisEventTypes maps the keyspace notifications of Redis to event types. The other
+// notifications, such as expire for a TTL change, are not changes of the value.
+var redisEventTypes = map[string]string{
+	"set":         EventSet,
+	"incrby":      EventSet,
+	"incrbyfloat": EventSet,
+	"append":      EventSet,
+	"setrange":    EventSet,
+	"del":         EventDelete,
+	"expired":     EventExpire,
+	"evicted":     EventEvict,
+}
+
+// Watch subscribes to the keyspace notifications of the keys of the cache, leaving out the
+// reserved keys. Redis only sends them when notify-keyspace-events enables them (at least
+// "K$gxe"), and has no notification for FLUSHDB, so clears are not streamed.
+func (r *RedisCache) Watch(ctx context.Context, match string) (<-chan Event, error) {
+	if match == "" {
+		match = "*"
+	}
+	channelPrefix := "__keyspace@" + strconv.Itoa(r.client.Options().DB) + "__:"
+	pubsub := r.client.PSubscribe(ctx, escapeRedisPattern(channelPrefix+r.prefix)+match)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		logrus.Errorf("Error subscribing to the keyspace notifications of %s: %v", match, err)
+		return nil, contextError(ctx, err)
+	}
+
+	events := make(chan Event, eventBufferSize)
+	go func() {
+		defer close(events)
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			var message *redis.Message
+			var ok bool
+			select {
+			case <-ctx.Done():
+				return
+			case message, ok = <-messages:
+				if !ok {
+					return
+				}
+			}
+			eventType, ok := redisEventTypes[message.Payload]
+			if !ok {
+				continue
+			}
+			key := strings.TrimPrefix(message.Channel, channelPrefix+r.prefix)
+			if IsReservedKey(key) {
+				continue
+			}
+			select {
+			case events <- Event{Type: eventType, Key: key, Time: time.Now()}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Watch streams the changes of L2, which every instance writes
+func (t *TieredCache) Watch(ctx context.Context, match string) (<-chan Event, error) {
+	watcher, ok := t.l2.(Watcher)
+	if !ok {
+		return nil, utils.NotSupported
+	}
+	return watcher.Watch(ctx, match)
+}
@@ -0,0 +1,439 @@
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"hash/maphash"
+	"sort"
+)
+
+// Names of the eviction policies supported by the in-memory cache.
+const (
+	PolicyLRU      = "lru"
+	PolicyLFU      = "lfu"
+	PolicyFIFO     = "fifo"
+	PolicySIEVE    = "sieve"
+	PolicyWTinyLFU = "wtinylfu"
+)
+
+// evictionPolicy decides which entry of an in-memory cache is evicted next.
+// Policies are not safe for concurrent use, the cache only calls them while holding its lock.
+type evictionPolicy interface {
+	// Add registers a newly inserted entry.
+	Add(e *entry)
+	// Access records a read or an update of an entry the policy already tracks.
+	Access(e *entry)
+	// Remove forgets an entry that was deleted, expired or evicted.
+	Remove(e *entry)
+	// Victim returns the entry to evict next, or nil when no entry is tracked.
+	Victim() *entry
+	// Walk visits the entries from the most to the least worth keeping, until fn returns false.
+	Walk(fn func(e *entry) bool)
+	// Reset forgets every entry.
+	Reset()
+}
+
+// sizeTracker is implemented by policies that weigh entries by their size and must hear
+// about entries whose value was replaced.
+type sizeTracker interface {
+	Resize(e *entry, oldSize int)
+}
+
+// newEvictionPolicy builds the named policy. The capacity in bytes is only used to size
+// the frequency sketch of W-TinyLFU.
+func newEvictionPolicy(name string, capacity int) (evictionPolicy, error) {
+	switch name {
+	case "", PolicyLRU:
+		return &lruPolicy{queue: list.New()}, nil
+	case PolicyLFU:
+		return &lfuPolicy{}, nil
+	case PolicyFIFO:
+		return &fifoPolicy{lruPolicy{queue: list.New()}}, nil
+	case PolicySIEVE:
+		return &sievePolicy{queue: list.New()}, nil
+	case PolicyWTinyLFU:
+		return newTinyLFUPolicy(capacity), nil
+	default:
+		return nil, fmt.Errorf("unknown eviction policy %q", name)
+	}
+}
+
+// walkList visits the entries of a queue from front to back.
+func walkList(queue *list.List, fn func(e *entry) bool) bool {
+	for element := queue.Front(); element != nil; element = element.Next() {
+		if !fn(element.Value.(*entry)) {
+			return false
+		}
+	}
+	return true
+}
+
+// lruPolicy evicts the least recently used entry. The front of the queue is the most recent one.
+type lruPolicy struct {
+	queue *list.List
+}
+
+func (p *lruPolicy) Add(e *entry) { e.element = p.queue.PushFront(e) }
+
+func (p *lruPolicy) Access(e *entry) { p.queue.MoveToFront(e.element) }
+
+func (p *lruPolicy) Remove(e *entry) {
+	p.queue.Remove(e.element)
+	e.element = nil
+}
+
+func (p *lruPolicy) Victim() *entry {
+	if back := p.queue.Back(); back != nil {
+		return back.Value.(*entry)
+	}
+	return nil
+}
+
+func (p *lruPolicy) Walk(fn func(e *entry) bool) { walkList(p.queue, fn) }
+
+func (p *lruPolicy) Reset() { p.queue.Init() }
+
+// fifoPolicy evicts entries in insertion order, ignoring accesses.
+type fifoPolicy struct {
+	lruPolicy
+}
+
+func (p *fifoPolicy) Access(e *entry) {}
+
+// lfuPolicy evicts the least frequently used entry, breaking ties by least recent access.
+type lfuPolicy struct {
+	entries lfuHeap
+	clock   uint64
+}
+
+func (p *lfuPolicy) Add(e *entry) {
+	p.clock++
+	e.freq, e.tick = 1, p.clock
+	heap.Push(&p.entries, e)
+}
+
+func (p *lfuPolicy) Access(e *entry) {
+	p.clock++
+	e.freq++
+	e.tick = p.clock
+	heap.Fix(&p.entries, e.heapIndex)
+}
+
+func (p *lfuPolicy) Remove(e *entry) { heap.Remove(&p.entries, e.heapIndex) }
+
+func (p *lfuPolicy) Victim() *entry {
+	if len(p.entries) == 0 {
+		return nil
+	}
+	return p.entries[0]
+}
+
+func (p *lfuPolicy) Walk(fn func(e *entry) bool) {
+	ordered := make([]*entry, len(p.entries))
+	copy(ordered, p.entries)
+	sort.Slice(ordered, func(i, j int) bool { return lfuLess(ordered[j], ordered[i]) })
+	for _, e := range ordered {
+		if !fn(e) {
+			return
+		}
+	}
+}
+
+func (p *lfuPolicy) Reset() { p.entries = nil }
+
+// lfuLess reports whether a is a better eviction candidate than b.
+func lfuLess(a, b *entry) bool {
+	if a.freq != b.freq {
+		return a.freq < b.freq
+	}
+	return a.tick < b.tick
+}
+
+// lfuHeap is a min-heap of entries ordered by lfuLess.
+type lfuHeap []*entry
+
+func (h lfuHeap) Len() int           { return len(h) }
+func (h lfuHeap) Less(i, j int) bool { return lfuLess(h[i], h[j]) }
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	e := x.(*entry)
+	e.heapIndex = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	e.heapIndex = -1
+	return e
+}
+
+// sievePolicy implements SIEVE: a FIFO queue where a hand sweeps from the oldest entry towards
+// the newest, sparing (and resetting) entries that were accessed since it last passed them.
+// Hits only set a flag, and scans of one-hit keys get evicted before the hot set.
+type sievePolicy struct {
+	queue *list.List // front is the newest entry
+	hand  *list.Element
+}
+
+func (p *sievePolicy) Add(e *entry) {
+	e.visited = false
+	e.element = p.queue.PushFront(e)
+}
+
+func (p *sievePolicy) Access(e *entry) { e.visited = true }
+
+func (p *sievePolicy) Remove(e *entry) {
+	if p.hand == e.element {
+		p.hand = p.hand.Prev()
+	}
+	p.queue.Remove(e.element)
+	e.element = nil
+}
+
+func (p *sievePolicy) Victim() *entry {
+	element := p.hand
+	if element == nil {
+		element = p.queue.Back()
+	}
+	for element != nil {
+		e := element.Value.(*entry)
+		if !e.visited {
+			p.hand = element
+			return e
+		}
+		e.visited = false
+		if element = element.Prev(); element == nil {
+			element = p.queue.Back()
+		}
+	}
+	return nil
+}
+
+func (p *sievePolicy) Walk(fn func(e *entry) bool) { walkList(p.queue, fn) }
+
+func (p *sievePolicy) Reset() {
+	p.queue.Init()
+	p.hand = nil
+}
+
+// Segments of the W-TinyLFU policy.
+const (
+	segmentWindow uint8 = iota
+	segmentProbation
+	segmentProtected
+)
+
+// tinyLFUPolicy implements W-TinyLFU: new entries land in a small LRU window (1% of the
+// tracked bytes) and overflow into the probation segment of a segmented LRU. When something
+// must go, the newest arrival in probation is only admitted if the frequency sketch estimates
+// it is more popular than the probation victim, otherwise the arrival itself is evicted.
+// Entries hit while in probation move to the protected segment (80% of main).
+type tinyLFUPolicy struct {
+	window, probation, protected *list.List
+	windowBytes, protectedBytes  int
+	totalBytes                   int
+	sketch                       *countMinSketch
+}
+
+func newTinyLFUPolicy(capacity int) *tinyLFUPolicy {
+	return &tinyLFUPolicy{
+		window:    list.New(),
+		probation: list.New(),
+		protected: list.New(),
+		sketch:    newCountMinSketch(capacity / entryOverhead),
+	}
+}
+
+func (p *tinyLFUPolicy) queue(segment uint8) *list.List {
+	switch segment {
+	case segmentProbation:
+		return p.probation
+	case segmentProtected:
+		return p.protected
+	default:
+		return p.window
+	}
+}
+
+func (p *tinyLFUPolicy) Add(e *entry) {
+	p.sketch.Increment(e.key)
+	e.segment = segmentWindow
+	e.element = p.window.PushFront(e)
+	p.windowBytes += e.size
+	p.totalBytes += e.size
+	// Overflow of the window waits in probation for its admission decision
+	for p.windowBytes > p.totalBytes/100 && p.window.Len() > 1 {
+		arrival := p.window.Remove(p.window.Back()).(*entry)
+		p.windowBytes -= arrival.size
+		arrival.segment = segmentProbation
+		arrival.pending = true
+		arrival.element = p.probation.PushFront(arrival)
+	}
+}
+
+func (p *tinyLFUPolicy) Access(e *entry) {
+	p.sketch.Increment(e.key)
+	switch e.segment {
+	case segmentWindow:
+		p.window.MoveToFront(e.element)
+	case segmentProtected:
+		p.protected.MoveToFront(e.element)
+	case segmentProbation:
+		// Promote to protected, demoting the oldest protected entries when it outgrows its share
+		p.probation.Remove(e.element)
+		e.pending = false
+		e.segment = segmentProtected
+		e.element = p.protected.PushFront(e)
+		p.protectedBytes += e.size
+		for p.protectedBytes > (p.totalBytes-p.windowBytes)*8/10 && p.protected.Len() > 1 {
+			demoted := p.protected.Remove(p.protected.Back()).(*entry)
+			p.protectedBytes -= demoted.size
+			demoted.segment = segmentProbation
+			demoted.element = p.probation.PushFront(demoted)
+		}
+	}
+}
+
+func (p *tinyLFUPolicy) Remove(e *entry) {
+	p.queue(e.segment).Remove(e.element)
+	e.element = nil
+	switch e.segment {
+	case segmentWindow:
+		p.windowBytes -= e.size
+	case segmentProtected:
+		p.protectedBytes -= e.size
+	}
+	p.totalBytes -= e.size
+}
+
+// Resize accounts a change in the size of a tracked entry.
+func (p *tinyLFUPolicy) Resize(e *entry, oldSize int) {
+	delta := e.size - oldSize
+	switch e.segment {
+	case segmentWindow:
+		p.windowBytes += delta
+	case segmentProtected:
+		p.protectedBytes += delta
+	}
+	p.totalBytes += delta
+}
+
+func (p *tinyLFUPolicy) Victim() *entry {
+	victim := p.mainVictim()
+	if victim == nil {
+		if back := p.window.Back(); back != nil {
+			return back.Value.(*entry)
+		}
+		return nil
+	}
+	front := p.probation.Front()
+	if front == nil {
+		return victim
+	}
+	candidate := front.Value.(*entry)
+	if !candidate.pending || candidate == victim {
+		return victim
+	}
+	if p.sketch.Estimate(candidate.key) > p.sketch.Estimate(victim.key) {
+		candidate.pending = false // admitted
+		return victim
+	}
+	return candidate
+}
+
+func (p *tinyLFUPolicy) mainVictim() *entry {
+	if back := p.probation.Back(); back != nil {
+		return back.Value.(*entry)
+	}
+	if back := p.protected.Back(); back != nil {
+		return back.Value.(*entry)
+	}
+	return nil
+}
+
+func (p *tinyLFUPolicy) Walk(fn func(e *entry) bool) {
+	_ = walkList(p.protected, fn) && walkList(p.window, fn) && walkList(p.probation, fn)
+}
+
+func (p *tinyLFUPolicy) Reset() {
+	p.window.Init()
+	p.probation.Init()
+	p.protected.Init()
+	p.windowBytes, p.protectedBytes, p.totalBytes = 0, 0, 0
+	p.sketch.Reset()
+}
+
+// countMinSketch estimates access frequencies with four rows of saturating 4-bit counters
+// (kept in bytes for simplicity). Every counter is halved once the number of increments reaches
+// ten times the width, so that popularity decays over time.
+type countMinSketch struct {
+	rows      [4][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+	seed      maphash.Seed
+}
+
+func newCountMinSketch(expectedEntries int) *countMinSketch {
+	width := 256
+	for width < expectedEntries && width < 1<<20 {
+		width <<= 1
+	}
+	s := &countMinSketch{mask: uint64(width - 1), resetAt: 10 * width, seed: maphash.MakeSeed()}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *countMinSketch) indexes(key string) [4]uint64 {
+	h := maphash.String(s.seed, key)
+	h1, h2 := h&0xffffffff, h>>32
+	var idx [4]uint64
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) & s.mask
+	}
+	return idx
+}
+
+func (s *countMinSketch) Increment(key string) {
+	for i, idx := range s.indexes(key) {
+		if s.rows[i][idx] < 15 {
+			s.rows[i][idx]++
+		}
+	}
+	if s.additions++; s.additions >= s.resetAt {
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] >>= 1
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+func (s *countMinSketch) Estimate(key string) uint8 {
+	min := uint8(15)
+	for i, idx := range s.indexes(key) {
+		if s.rows[i][idx] < min {
+			min = s.rows[i][idx]
+		}
+	}
+	return min
+}
+
+func (s *countMinSketch) Reset() {
+	for i := range s.rows {
+		clear(s.rows[i])
+	}
+	s.additions = 0
+}
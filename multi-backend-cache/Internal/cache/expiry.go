@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"container/heap"
+	"time"
+
+	"multi-backend-cache/Internal/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	activeExpireBatch  = 20               // expired entries removed per acquisition of a shard lock
+	activeExpireBudget = time.Millisecond // time a janitor cycle may spend on one shard
+
+	defaultJanitorInterval     = time.Second
+	defaultMemoryCheckInterval = time.Second
+	defaultMetricsInterval     = 5 * time.Second
+)
+
+// expiryHeap orders the entries of a shard by expiry time, soonest first
+type expiryHeap []*entry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiryTime.Before(h[j].expiryTime) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].expiryIndex = i
+	h[j].expiryIndex = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	e := x.(*entry)
+	e.expiryIndex = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.expiryIndex = -1
+	*h = old[:n-1]
+	return e
+}
+
+// Go-routine that periodically removes the expired entries of every shard, until the cache is closed
+func DeleteExpiredCache(lru *LRUCache) {
+	defer lru.janitors.Done()
+	ticker := time.NewTicker(intervalOrDefault(config.AppConfig.JanitorInterval, defaultJanitorInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lru.stop:
+			return
+		case <-ticker.C:
+			for _, shard := range lru.shards {
+				if removed := shard.expireActive(); removed > 0 {
+					logrus.Debugf("Deleted %d expired cache keys", removed)
+				}
+			}
+		}
+	}
+}
+
+// expireActive removes the expired entries at the top of the expiry heap in small batches,
+// releasing the lock in between. Like the active expiry of Redis, it only carries on while
+// batches come back full and stops once its time budget is spent; whatever is left is removed
+// on the next cycle or when it is read.
+func (s *cacheShard) expireActive() int {
+	deadline := time.Now().Add(activeExpireBudget)
+	removed := 0
+	for {
+		s.lock.Lock()
+		batch := 0
+		for batch < activeExpireBatch && len(s.expiries) > 0 && IsExpired(s.expiries[0].expiryTime) {
+			removeAndResize(s, s.expiries[0], EventExpire)
+			batch++
+		}
+		s.lock.Unlock()
+		removed += batch
+		if batch < activeExpireBatch || time.Now().After(deadline) {
+			return removed
+		}
+	}
+}
+
+// trackExpiry adds a new entry to the expiry heap. Caller must hold the lock.
+func (s *cacheShard) trackExpiry(node *entry) {
+	heap.Push(&s.expiries, node)
+}
+
+// untrackExpiry removes an entry from the expiry heap. Caller must hold the lock.
+func (s *cacheShard) untrackExpiry(node *entry) {
+	if node.expiryIndex >= 0 {
+		heap.Remove(&s.expiries, node.expiryIndex)
+	}
+}
+
+// intervalOrDefault converts an interval configured in milliseconds, using the fallback when unset
+func intervalOrDefault(milliseconds int, fallback time.Duration) time.Duration {
+	if milliseconds <= 0 {
+		return fallback
+	}
+	return time.Duration(milliseconds) * time.Millisecond
+}
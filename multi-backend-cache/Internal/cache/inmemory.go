@@ -1,11 +1,17 @@
 package cache
 
 import (
+	"container/heap"
 	"container/list"
+	"context"
 	"encoding/json"
+	"hash/maphash"
+	"multi-backend-cache/Internal/metrices"
 	utils "multi-backend-cache/packageUtils/Utils"
 	"reflect"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"multi-backend-cache/Internal/config"
@@ -21,25 +27,106 @@ type CacheData struct { //node
 	Key        string        `json:"key" example:"1"`
 	Value      interface{}   `json:"value" `
 	TTL        time.Duration `json:"ttl" example:"100"`
+	SoftTTL    time.Duration `json:"soft_ttl" example:"30"` // seconds after which the value is served stale, 0 for never
+	Tags       []string      `json:"tags,omitempty" example:"product:42,user:7"` // invalidated together by DELETE /cache/tags/:tag, only with POST /cache
 	ExpiryTime time.Time     `json:"expirytime" example:"2021-05-25T00:53:16.535668Z" format:"date-time" swaggerignore:"true"`
 }
 
-// LRUCache represents the LRU cache, that consists of capacity, linkedlist as list, hashmap as index and lock
+// entry is the node held in the cache index. The value is kept JSON encoded, so that the
+// memory it occupies is known exactly.
+type entry struct {
+	key         string
+	value       []byte
+	ttl         time.Duration
+	expiryTime  time.Time
+	softExpiry  time.Time // stale after it, zero without a soft TTL
+	version     uint64    // changed by every write of the key
+	tags        []string  // attached by SetTagged, kept until the entry is removed
+	size        int       // accounted bytes, see CalculateSize
+	expiryIndex int // position in the expiry heap of the shard
+
+	// Bookkeeping owned by the eviction policy
+	element   *list.Element // position in the policy queue
+	freq      uint32        // LFU access count
+	tick      uint64        // LFU last access, breaks frequency ties
+	heapIndex int           // LFU heap position
+	visited   bool          // SIEVE visited bit
+	segment   uint8         // W-TinyLFU segment
+	pending   bool          // W-TinyLFU arrival awaiting admission
+}
+
+// Fixed cost of every entry on top of its key and value: the entry itself, its list element
+// and its slot in the index map (key header, entry pointer and bucket tophash, rounded up).
+var entryOverhead = int(reflect.TypeOf(entry{}).Size()+reflect.TypeOf(list.Element{}).Size()) + mapSlotOverhead
+
+const mapSlotOverhead = 32
+
+// LRUCache represents the in-memory cache. The key space is striped over a power of two number
+// of shards, each with its own lock, index, eviction policy and share of the capacity, so that
+// operations on different keys rarely contend.
 type LRUCache struct {
-	capacity   int // in bytes
-	used       int // in bytes
-	list       *list.List
-	index      map[string]*list.Element //key-> sring, value -> pointer to the list(*list.Element)
-	lock       sync.Mutex
+	shards     []*cacheShard
+	seed       maphash.Seed // hashes keys to shards
 	defaultTTL time.Duration
+	aof        *appendLog    // nil unless the cache is durable
+	stop       chan struct{} // closed by Close to stop the janitor
+	closeOnce  sync.Once
+	janitors   sync.WaitGroup
+	versions   atomic.Uint64 // last version handed out, seeded from the clock so that restarts do not reuse versions
+	events     *eventBroker  // watchers of the changes of the cache
+
+	invalidations atomic.Pointer[invalidationOutbox] // nil unless the changes are shared with other replicas, see bus.go
 }
 
+// cacheShard is one lock-striped segment of a cache. Lookups only take the read lock; the hits
+// they observe are queued in a lossy buffer and replayed into the eviction policy by writers.
+type cacheShard struct {
+	capacity int               // in bytes
+	used     int               // in bytes
+	index    map[string]*entry //key-> sring, value -> pointer to the entry
+	policy   evictionPolicy
+	lock     sync.RWMutex
+	reads    chan *entry // hits not yet applied to the policy
+	expiries expiryHeap  // entries by expiry time, drives the active expiry
+	versions *atomic.Uint64
+	tags     map[string]map[string]struct{} // keys of the entries carrying each tag
+	events   *eventBroker
+}
+
+const (
+	defaultShardCount = 16
+	minShardCapacity  = 64 * 1024 // smaller caches get fewer shards, down to a single one
+	readBufferSize    = 64
+)
+
+// FixedTenantsCaches holds the in-memory cache of every tenant. Tenants can be added, resized and
+// removed at runtime, see tenants.go.
 type FixedTenantsCaches struct {
-	caches map[string]*LRUCache
+	lock             sync.RWMutex // guards caches, tieredCaches, pending, fixedCapacities and totalCacheMemory
+	caches           map[string]*LRUCache
+	tieredCaches     map[string]*LRUCache // L1 of the tiered system per tenant, see TieredL1
+	pending          map[string]bool      // IDs of the tenants being added or removed, reserved until done
+	fixedCapacities  map[string]int // tenants given an explicit capacity, the others share the rest
+	totalCacheMemory int
+	isTenantBased    bool
+	defaultTTL       time.Duration
+
+	stop      chan struct{} // closed by Close to stop the memory checks
+	closeOnce sync.Once
+	janitors  sync.WaitGroup
+
+	snapshotDir  string // empty when snapshots are disabled
+	snapshotLock sync.Mutex
+	lastSnapshot time.Time
+
+	instanceID    string              // identifies this replica on the invalidation bus
+	invalidations chan<- Invalidation // nil unless the invalidations are shared, see bus.go
 }
 
 // GetCache retrieves the cache for the specified tenant.
 func (ftc *FixedTenantsCaches) GetCache(tenantID string) *LRUCache {
+	ftc.lock.RLock()
+	defer ftc.lock.RUnlock()
 	if cache, exists := ftc.caches[tenantID]; exists {
 		return cache
 	}
@@ -50,23 +137,65 @@ func (ftc *FixedTenantsCaches) GetCache(tenantID string) *LRUCache {
 const DefaultTenant string = "defaultTenant"
 
 func NewFixedTenantsCaches(isTenantBased bool, totalCacheMemory int, defaultTTL time.Duration) *FixedTenantsCaches {
-	tenantCaches := make(map[string]*LRUCache)
+	ftc := &FixedTenantsCaches{
+		caches:           make(map[string]*LRUCache),
+		tieredCaches:     make(map[string]*LRUCache),
+		pending:          make(map[string]bool),
+		fixedCapacities:  make(map[string]int),
+		totalCacheMemory: totalCacheMemory,
+		isTenantBased:    isTenantBased,
+		defaultTTL:       defaultTTL,
+		stop:             make(chan struct{}),
+		snapshotDir:      config.AppConfig.SnapshotDir,
+	}
 
+	tenantIDs := []string{DefaultTenant}
 	if isTenantBased {
-		tenantIDs := config.AppConfig.TenantIDs
+		tenantIDs = config.AppConfig.TenantIDs
 		logrus.Infof("Tenant IDs: %v", tenantIDs)
-
+	}
+	// Capacities follow the weights, quotas and minimums configured per tenant
+	capacities, err := ftc.plan(tenantIDs, ftc.fixedCapacities)
+	if err != nil {
+		logrus.Errorf("Ignoring the tenant quotas: %v", err)
+		capacities = make(map[string]int, len(tenantIDs))
 		for _, id := range tenantIDs {
-			tenantCaches[id] = NewLRUCache(int(totalCacheMemory)/len(tenantIDs), defaultTTL) // Define capacity per tenant here.
+			capacities[id] = totalCacheMemory / len(tenantIDs)
 		}
-	} else {
-		tenantCaches[DefaultTenant] = NewLRUCache(totalCacheMemory, defaultTTL)
+	}
+	for _, id := range tenantIDs {
+		ftc.caches[id] = newTenantCache(id, capacities[id], defaultTTL)
 	}
 
-	go checkMemoryForTenants(totalCacheMemory, tenantCaches)
+	if ftc.snapshotDir != "" {
+		ftc.restoreSnapshots()
+		ftc.janitors.Add(1)
+		go takeSnapshots(ftc)
+	}
+	ftc.janitors.Add(2)
+	go checkMemoryForTenants(ftc)
+	go reportMemoryUsage(ftc)
 
-	return &FixedTenantsCaches{
-		caches: tenantCaches,
+	return ftc
+}
+
+// Close stops the background goroutines of the tenant caches and of every cache they hold,
+// taking a last snapshot when snapshots are enabled
+func (ftc *FixedTenantsCaches) Close() {
+	ftc.closeOnce.Do(func() { close(ftc.stop) })
+	ftc.janitors.Wait()
+	if ftc.snapshotDir != "" {
+		if _, err := ftc.SaveSnapshots(); err != nil {
+			logrus.Errorf("Error taking the final snapshot: %v", err)
+		}
+	}
+	for _, cache := range ftc.tenantCaches() {
+		cache.Close()
+	}
+	ftc.lock.RLock()
+	defer ftc.lock.RUnlock()
+	for _, l1 := range ftc.tieredCaches {
+		l1.Close()
 	}
 }
 
@@ -75,234 +204,786 @@ func IsExpired(expiryTime time.Time) bool {
 	return time.Now().After(expiryTime)
 }
 
+// newTenantCache creates the cache of a tenant with the eviction policy configured for it,
+// falling back to LRU when the configured policy is unknown
+func newTenantCache(tenantID string, capacity int, defaultTTL time.Duration) *LRUCache {
+	policy := config.AppConfig.EvictionPolicyFor(tenantID)
+	cache, err := NewCacheWithPolicy(capacity, defaultTTL, policy)
+	if err != nil {
+		logrus.Errorf("Tenant %s: %v, falling back to %s", tenantID, err, PolicyLRU)
+		return NewLRUCache(capacity, defaultTTL)
+	}
+	logrus.Infof("Tenant %s uses the %s eviction policy", tenantID, policy)
+	if tenantConfig := config.AppConfig.TenantConfigFor(tenantID); tenantConfig.AOF {
+		path := aofPath(tenantID)
+		replayed, err := cache.EnableAppendLog(path, tenantConfig.AOFFsync, config.AppConfig.AOFRewriteMinSize)
+		if err != nil {
+			logrus.Errorf("Tenant %s: append-only log %s: %v", tenantID, path, err)
+		} else {
+			logrus.Infof("Tenant %s replayed %d records from %s", tenantID, replayed, path)
+		}
+	}
+	return cache
+}
+
 // NewLRUCache creates a new LRU cache with the given capacity and ttl
 func NewLRUCache(capacity int, defaultTTL time.Duration) *LRUCache {
+	lru, _ := NewCacheWithPolicy(capacity, defaultTTL, PolicyLRU)
+	return lru
+}
+
+// NewCacheWithPolicy creates a new in-memory cache with the given capacity, ttl and eviction policy
+func NewCacheWithPolicy(capacity int, defaultTTL time.Duration, policyName string) (*LRUCache, error) {
+	shardCount := shardCountFor(capacity)
 	lru := &LRUCache{ // The "&" operator returns a pointer to the newly created LRUCache instance.
-		capacity:   capacity,
-		list:       list.New(),
-		index:      make(map[string]*list.Element),
+		shards:     make([]*cacheShard, shardCount),
+		seed:       maphash.MakeSeed(),
 		defaultTTL: defaultTTL,
+		stop:       make(chan struct{}),
+		events:     newEventBroker(),
 	}
+	lru.versions.Store(uint64(time.Now().UnixNano()))
+	for i := range lru.shards {
+		shardCapacity := splitCapacity(capacity, shardCount, i)
+		policy, err := newEvictionPolicy(policyName, shardCapacity)
+		if err != nil {
+			return nil, err
+		}
+		lru.shards[i] = &cacheShard{
+			capacity: shardCapacity,
+			index:    make(map[string]*entry),
+			policy:   policy,
+			reads:    make(chan *entry, readBufferSize),
+			versions: &lru.versions,
+			events:   lru.events,
+		}
+	}
+	lru.janitors.Add(1)
 	go DeleteExpiredCache(lru)
 
-	return lru
+	return lru, nil
 }
 
-// Go-routine that runs concurrently and for each 5 seconds scans the memory and deletes the
-// expired ones
-func DeleteExpiredCache(lru *LRUCache) {
-	for range time.Tick(5 * time.Second) {
-		lru.lock.Lock()
-		// Iterate over the cache items and delete expired ones.
-		for key, element := range lru.index {
-			node := element.Value.(*CacheData)
-			if IsExpired(node.ExpiryTime) {
-				removeAndResize(lru, node, element)
-				logrus.Infof("Deleted cache key %s with expiry time %v", key, node.ExpiryTime)
+// Close stops the janitor of the cache, ends its watches and closes its append-only log. The
+// cache stays usable, but expired entries are then only removed when they are read, and writes
+// fail if it had a log.
+func (c *LRUCache) Close() {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+		c.janitors.Wait()
+		c.events.close()
+		if c.aof != nil {
+			if err := c.aof.close(); err != nil {
+				logrus.Errorf("Error closing the append-only log %s: %v", c.aof.path, err)
 			}
 		}
-		lru.lock.Unlock()
+	})
+}
+
+// shardCountFor returns the number of shards for a cache of the given capacity: the configured
+// count rounded down to a power of two, reduced until every shard gets at least minShardCapacity
+func shardCountFor(capacity int) int {
+	limit := config.AppConfig.ShardCount
+	if limit <= 0 {
+		limit = defaultShardCount
+	}
+	count := 1
+	for count*2 <= limit && capacity/(count*2) >= minShardCapacity {
+		count *= 2
+	}
+	return count
+}
+
+// splitCapacity returns the share of the capacity of shard i, the first shard takes the remainder
+func splitCapacity(capacity int, shardCount int, i int) int {
+	share := capacity / shardCount
+	if i == 0 {
+		share += capacity % shardCount
 	}
+	return share
+}
+
+// shard returns the shard owning a key
+func (c *LRUCache) shard(key string) *cacheShard {
+	return c.shards[maphash.String(c.seed, key)&uint64(len(c.shards)-1)]
 }
 
 // Go-routine that concurrently checks whether the memory size increases and allocates cache memory accordingly
-func checkMemoryForTenants(totalCacheMemory int, tenantCaches map[string]*LRUCache) {
-	for range time.Tick(1 * time.Second) {
-		numberOfTenants := len(tenantCaches)
-		if totalCacheMemory < int(memory.TotalMemory()) {
-			cacheMemory := float64(memory.TotalMemory()) * config.AppConfig.MemoryUsagePercentage
-			capacity := int(cacheMemory) / numberOfTenants
-			logrus.Infof("increased capacity for tenant :: %d", int(cacheMemory))
-			for _, cache := range tenantCaches {
-				cache.lock.Lock()
-				cache.capacity = capacity
-				cache.lock.Unlock()
-			}
+func checkMemoryForTenants(ftc *FixedTenantsCaches) {
+	defer ftc.janitors.Done()
+	ticker := time.NewTicker(intervalOrDefault(config.AppConfig.MemoryCheckInterval, defaultMemoryCheckInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ftc.stop:
+			return
+		case <-ticker.C:
+		}
+		cacheMemory := int(float64(memory.TotalMemory()) * config.AppConfig.MemoryUsagePercentage)
+		ftc.lock.Lock()
+		if cacheMemory > ftc.totalCacheMemory {
+			logrus.Infof("increased cache memory to %d bytes", cacheMemory)
+			ftc.totalCacheMemory = cacheMemory
+			ftc.rebalance()
 		}
+		ftc.lock.Unlock()
 	}
 }
 
-// GetAllCache retrieves all values from the cache
-func (c *LRUCache) GetAllCache() []*CacheData {
-	c.lock.Lock()
-	defer c.lock.Unlock()
+// Go-routine that publishes the memory accounted by each tenant cache to Prometheus
+func reportMemoryUsage(ftc *FixedTenantsCaches) {
+	defer ftc.janitors.Done()
+	ticker := time.NewTicker(intervalOrDefault(config.AppConfig.MetricsInterval, defaultMetricsInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ftc.stop:
+			return
+		case <-ticker.C:
+		}
+		for tenantID, cache := range ftc.tenantCaches() {
+			used, capacity, entries := cache.Stats()
+			metrices.InMemoryUsedBytes.WithLabelValues(tenantID).Set(float64(used))
+			metrices.InMemoryCapacityBytes.WithLabelValues(tenantID).Set(float64(capacity))
+			metrices.InMemoryEntries.WithLabelValues(tenantID).Set(float64(entries))
+		}
+	}
+}
+
+// Stats returns the bytes used by the entries, the capacity in bytes and the number of entries
+func (c *LRUCache) Stats() (used int, capacity int, entries int) {
+	for _, shard := range c.shards {
+		shard.lock.RLock()
+		used += shard.used
+		capacity += shard.capacity
+		entries += len(shard.index)
+		shard.lock.RUnlock()
+	}
+	return used, capacity, entries
+}
+
+// SetCapacity changes the byte budget of the cache, evicting entries if it shrank below the used size
+func (c *LRUCache) SetCapacity(capacity int) {
+	for i, shard := range c.shards {
+		shard.lock.Lock()
+		shard.drainReads()
+		shard.capacity = splitCapacity(capacity, len(c.shards), i)
+		shard.evict()
+		shard.lock.Unlock()
+	}
+}
 
+// GetAllCache retrieves all values from the cache, shard by shard in the order of their eviction policy
+func (c *LRUCache) GetAllCache() []*CacheData {
 	var allCacheData []*CacheData
-	for element := c.list.Front(); element != nil; element = element.Next() {
-		node := element.Value.(*CacheData)
-		nodeJSON, err := json.Marshal(node)
-		if err != nil {
-			logrus.Error("Error marshalling node to JSON:", err)
-		} else {
-			logrus.Debugf("All cached data without Expired Cache: %s", string(nodeJSON))
-		}
-		if IsExpired(node.ExpiryTime) {
-			removeAndResize(c, node, element) // Entry has expired, remove it
-		} else {
-			allCacheData = append(allCacheData, node)
+	for _, shard := range c.shards {
+		shard.lock.Lock()
+		shard.drainReads()
+		var expired []*entry
+		shard.policy.Walk(func(node *entry) bool {
+			if IsExpired(node.expiryTime) {
+				expired = append(expired, node)
+				return true
+			}
+			data, err := node.cacheData()
+			if err != nil {
+				logrus.Errorf("Error decoding value for key %s: %v", node.key, err)
+			} else {
+				allCacheData = append(allCacheData, data)
+			}
+			return true
+		})
+		for _, node := range expired {
+			removeAndResize(shard, node, EventExpire) // Entry has expired, remove it
 		}
+		shard.lock.Unlock()
 	}
+	logrus.Debugf("All cached data without Expired Cache: %d entries", len(allCacheData))
 	return allCacheData
 }
 
+// decodeJSON decodes a stored JSON value
+func decodeJSON(raw []byte) (interface{}, error) {
+	var value interface{}
+	err := json.Unmarshal(raw, &value)
+	return value, err
+}
+
+// cacheData converts the entry to its API representation
+func (node *entry) cacheData() (*CacheData, error) {
+	value, err := decodeJSON(node.value)
+	if err != nil {
+		return nil, err
+	}
+	return &CacheData{Key: node.key, Value: value, TTL: node.ttl, ExpiryTime: node.expiryTime}, nil
+}
+
 // GetCache returns the cache value for a specified key if exists
-func (c *LRUCache) Get(key string) (interface{}, error) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	var Err error
-	if element, found := c.index[key]; found {
-		logrus.Debugf("Existing cache found for key %s: %v", key, element.Value)
-		node := element.Value.(*CacheData)
-		nodeJSON, err := json.Marshal(node)
-		if err != nil {
-			logrus.Error("Error marshalling node to JSON:", err)
-		} else {
-			logrus.Infof("Cache data for key %s: %s", key, string(nodeJSON))
+func (c *LRUCache) Get(ctx context.Context, key string) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cached, found := c.shard(key).get(key)
+	if !found {
+		return nil, utils.NotFound
+	}
+	value, err := decodeJSON(cached.value)
+	if err != nil {
+		logrus.Errorf("Error decoding value for key %s: %v", key, err)
+		return nil, err
+	}
+	return value, nil
+}
+
+// GetMany returns the values of the keys that exist
+func (c *LRUCache) GetMany(ctx context.Context, keys []string) (map[string]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		if cached, found := c.shard(key).get(key); found {
+			value, err := decodeJSON(cached.value)
+			if err != nil {
+				logrus.Errorf("Error decoding value for key %s: %v", key, err)
+				return nil, err
+			}
+			values[key] = value
 		}
-		if IsExpired(node.ExpiryTime) { // Check if the entry has expired
-			removeAndResize(c, node, element)
-			return nil, utils.NotFound
+	}
+	return values, nil
+}
+
+// GetWithTTL returns the cache value for a specified key along with its remaining TTL and expiry time
+func (c *LRUCache) GetWithTTL(ctx context.Context, key string) (interface{}, time.Duration, time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	cached, found := c.shard(key).get(key)
+	if !found {
+		return nil, 0, time.Time{}, utils.NotFound
+	}
+	value, err := decodeJSON(cached.value)
+	if err != nil {
+		logrus.Errorf("Error decoding value for key %s: %v", key, err)
+		return nil, 0, time.Time{}, err
+	}
+	return value, time.Until(cached.expiryTime), cached.expiryTime, nil
+}
+
+// GetItem returns the cache value for a specified key along with its expiry and soft expiry
+func (c *LRUCache) GetItem(ctx context.Context, key string) (Item, error) {
+	if err := ctx.Err(); err != nil {
+		return Item{}, err
+	}
+	cached, found := c.shard(key).get(key)
+	if !found {
+		return Item{}, utils.NotFound
+	}
+	value, err := decodeJSON(cached.value)
+	if err != nil {
+		logrus.Errorf("Error decoding value for key %s: %v", key, err)
+		return Item{}, err
+	}
+	return Item{Value: value, ExpiryTime: cached.expiryTime, SoftExpiry: cached.softExpiry, Version: cached.version}, nil
+}
+
+// cachedValue is a copy of an entry taken under the shard lock
+type cachedValue struct {
+	value      []byte
+	expiryTime time.Time
+	softExpiry time.Time
+	version    uint64
+}
+
+// get looks up a live entry under the read lock and records the hit. It returns the encoded
+// value, which is never mutated in place and can be decoded after the lock is released.
+func (s *cacheShard) get(key string) (cachedValue, bool) {
+	s.lock.RLock()
+	node, found := s.index[key]
+	var cached cachedValue
+	if found {
+		cached = cachedValue{value: node.value, expiryTime: node.expiryTime, softExpiry: node.softExpiry, version: node.version}
+	}
+	s.lock.RUnlock()
+	if !found {
+		logrus.Debugf("Cache miss for key %s", key)
+		return cachedValue{}, false
+	}
+	if IsExpired(cached.expiryTime) { // Check if the entry has expired
+		s.lock.Lock()
+		if current, ok := s.index[key]; ok && IsExpired(current.expiryTime) {
+			removeAndResize(s, current, EventExpire)
 		}
-		c.list.MoveToFront(element)
-		return node.Value, Err
-	} else {
-		logrus.Infof("Cache miss for key %s", key)
-		return nil, utils.NotFound
+		s.lock.Unlock()
+		return cachedValue{}, false
 	}
+	s.recordAccess(node)
+	return cached, true
 }
 
-// Get cache along with data
-// func (c *LRUCache) GetWithTTL(key string) (interface{}, time.Duration, time.Time, error) {
-// 	c.lock.Lock()
-// 	defer c.lock.Unlock()
-// 	var Err error
-// 	if element, found := c.index[key]; found {
-// 		log.Println("Exsiting cache found", element.Value)
-// 		node := element.Value.(*CacheData)
-// 		nodeJSON, err := json.Marshal(node)
-// 		if err != nil {
-// 			log.Println("Error marshalling node to JSON:", err)
-// 		} else {
-// 			log.Printf("Cache data for key %s is: %s", key, string(nodeJSON))
-// 		}
-// 		size := CalculateSize(node)
-// 		if IsExpired(node.ExpiryTime) { // Check if the entry has expired
-// 			c.list.Remove(element)
-// 			delete(c.index, key)
-// 			c.used -= size
-// 			// return nil, err
-// 		}
-// 		log.Println("stp-1 node.TTL:", node.TTL.Seconds())
-// 		// expiryTime := CalculateExpiryTime(node.TTL) //extend expiry
-// 		log.Println("stp-2 node.TTL:", node.TTL)
-// 		//node.TTL = time.Duration((node.TTL * time.Nanosecond).Seconds())
-// 		log.Println("stp-3 after node.TTL:", node.TTL)
-// 		// node.ExpiryTime = expiryTime
-// 		c.list.MoveToFront(element)
-// 		ttl := time.Until(node.ExpiryTime)
-// 		return node.Value, ttl, node.ExpiryTime, Err
-// 	} else {
-// 		Err := errors.New("key not found")
-// 		return Err, 0, time.Time{}, nil
-// 	}
-// }
+// recordAccess queues a hit for the eviction policy, dropping it when the buffer is full. The
+// buffer is drained by whichever caller gets the write lock without waiting.
+func (s *cacheShard) recordAccess(node *entry) {
+	select {
+	case s.reads <- node:
+	default:
+	}
+	if len(s.reads) >= readBufferSize/2 && s.lock.TryLock() {
+		s.drainReads()
+		s.lock.Unlock()
+	}
+}
+
+// drainReads applies the queued hits of nodes that are still cached. Caller must hold the write lock.
+func (s *cacheShard) drainReads() {
+	for {
+		select {
+		case node := <-s.reads:
+			if s.index[node.key] == node {
+				s.policy.Access(node)
+			}
+		default:
+			return
+		}
+	}
+}
 
 // Replaces the existing cache value with new value, along with resizing the cache.
-func updateAndResize(c *LRUCache, node *CacheData, value interface{}, ttl time.Duration, expiryTime time.Time) {
-	updateCacheUsed(c, node, false) // reduce the size of the node that is replaced
-	node.Value = value
-	node.TTL = ttl
-	node.ExpiryTime = expiryTime
-	updateCacheUsed(c, node, true) // Add the size of the new node back to cache
+func updateAndResize(s *cacheShard, node *entry, value []byte, ttl time.Duration, expiryTime time.Time, softExpiry time.Time) {
+	updateCacheUsed(s, node, false) // reduce the size of the node that is replaced
+	oldSize := node.size
+	node.value = value
+	node.ttl = ttl
+	node.expiryTime = expiryTime
+	node.softExpiry = softExpiry
+	node.size = CalculateSize(node.key, value)
+	updateCacheUsed(s, node, true) // Add the size of the new node back to cache
+	if tracker, ok := s.policy.(sizeTracker); ok {
+		tracker.Resize(node, oldSize)
+	}
 }
 
 // setCache adds a value to the cache or updates the exisiting value
-func (c *LRUCache) Set(key string, value interface{}, ttl time.Duration) error {
+func (c *LRUCache) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	return c.SetWithSoftTTL(ctx, key, value, 0, ttl)
+}
+
+// SetWithSoftTTL adds or updates a value that is served stale after softTTL and expires after ttl,
+// both in seconds. A softTTL of 0 never turns the value stale.
+func (c *LRUCache) SetWithSoftTTL(ctx context.Context, key string, value interface{}, softTTL time.Duration, ttl time.Duration) error {
 	logrus.Debugf("Setting key %s", key)
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	if ttl <= 0 {
-		ttl = c.defaultTTL
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		logrus.Errorf("Error marshalling value for key %s: %v", key, err)
+		return err
+	}
+	shard := c.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	if err := c.set(shard, key, raw, softTTL, c.ttlOrDefault(ttl)); err != nil {
+		return err
 	}
-	logrus.Debugf("TTL for key %s: %s", key, ttl)
-	expiryTime := CalculateExpiryTime(ttl)
-	if element, found := c.index[key]; found {
-		logrus.Infof("Updating existing cache for key %s", key)
-		c.list.MoveToFront(element)
+	c.broadcast(Invalidation{Keys: []string{key}})
+	return nil
+}
 
-		node := element.Value.(*CacheData)
-		updateAndResize(c, node, value, ttl, expiryTime)
-	} else {
-		logrus.Infof("Creating new cache node for key %s", key)
-		newNode := &CacheData{Key: key, Value: value, TTL: ttl, ExpiryTime: expiryTime}
-		newNodeSize := CalculateSize(newNode)
-
-		for c.used+newNodeSize > c.capacity { // Recursively checked for freeing the last element to store the new one.
-			logrus.Warn("Capacity Exceeded. Removing least recently used items.")
-			backElement := c.list.Back()
-			if backElement != nil {
-				backNode := backElement.Value.(*CacheData)
-				removeAndResize(c, backNode, backElement)
+// SetIf is SetWithSoftTTL when the condition holds for the live entry of the key
+func (c *LRUCache) SetIf(ctx context.Context, key string, value interface{}, softTTL time.Duration, ttl time.Duration, condition Condition) (uint64, error) {
+	return c.SetTagged(ctx, key, value, softTTL, ttl, condition, nil)
+}
+
+// SetTagged is SetIf that also attaches the tags to the entry
+func (c *LRUCache) SetTagged(ctx context.Context, key string, value interface{}, softTTL time.Duration, ttl time.Duration, condition Condition, tags []string) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		logrus.Errorf("Error marshalling value for key %s: %v", key, err)
+		return 0, err
+	}
+	shard := c.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	if !condition.Holds(shard.version(key)) {
+		return 0, utils.PreconditionFailed
+	}
+	ttl = c.ttlOrDefault(ttl)
+	version := c.versions.Add(1)
+	if err := c.setUntil(shard, key, raw, ttl, CalculateExpiryTime(ttl), CalculateSoftExpiry(softTTL, ttl), version, tags); err != nil {
+		return 0, err
+	}
+	c.broadcast(Invalidation{Keys: []string{key}})
+	return version, nil
+}
+
+// setVersion stores a value with a version given by another cache, see TieredCache
+func (c *LRUCache) setVersion(key string, value interface{}, softTTL time.Duration, ttl time.Duration, version uint64, tags []string) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	shard := c.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	ttl = c.ttlOrDefault(ttl)
+	if err := c.setUntil(shard, key, raw, ttl, CalculateExpiryTime(ttl), CalculateSoftExpiry(softTTL, ttl), version, tags); err != nil {
+		return err
+	}
+	c.broadcast(Invalidation{Keys: []string{key}})
+	return nil
+}
+
+// version returns the version of the live entry of the key. Caller must hold the lock.
+func (s *cacheShard) version(key string) (uint64, bool) {
+	node, found := s.index[key]
+	if !found || IsExpired(node.expiryTime) {
+		return 0, false
+	}
+	return node.version, true
+}
+
+// Incr adds delta to the counter under the shard lock. Counters are stored as JSON integers,
+// so they can be read and written like any other value.
+func (c *LRUCache) Incr(ctx context.Context, key string, delta int64, initial int64, ttl time.Duration) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	shard := c.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	node, found := shard.index[key]
+	if !found || IsExpired(node.expiryTime) {
+		value, ok := addInt64(initial, delta)
+		if !ok {
+			return 0, utils.NotInteger
+		}
+		ttl = c.ttlOrDefault(ttl)
+		raw := strconv.AppendInt(nil, value, 10)
+		if err := c.setUntil(shard, key, raw, ttl, CalculateExpiryTime(ttl), time.Time{}, 0, nil); err != nil {
+			return 0, err
+		}
+		c.broadcast(Invalidation{Keys: []string{key}})
+		return value, nil
+	}
+	current, err := strconv.ParseInt(string(node.value), 10, 64)
+	if err != nil {
+		return 0, utils.NotInteger
+	}
+	value, ok := addInt64(current, delta)
+	if !ok {
+		return 0, utils.NotInteger
+	}
+	raw := strconv.AppendInt(nil, value, 10)
+	if err := c.setUntil(shard, key, raw, node.ttl, node.expiryTime, node.softExpiry, 0, nil); err != nil {
+		return 0, err
+	}
+	c.broadcast(Invalidation{Keys: []string{key}})
+	return value, nil
+}
+
+// addInt64 returns a + b, and false when it overflows
+func addInt64(a int64, b int64) (int64, bool) {
+	sum := a + b
+	if (b > 0 && sum < a) || (b < 0 && sum > a) {
+		return 0, false
+	}
+	return sum, true
+}
+
+// SetMany stores every item, taking the lock of each shard once for the items it owns. The
+// other replicas are told about every key, even when an item fails.
+func (c *LRUCache) SetMany(ctx context.Context, items []CacheData) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	values := make([][]byte, len(items))
+	keys := make([]string, len(items))
+	byShard := make(map[*cacheShard][]int)
+	for i, item := range items {
+		raw, err := json.Marshal(item.Value)
+		if err != nil {
+			logrus.Errorf("Error marshalling value for key %s: %v", item.Key, err)
+			return err
+		}
+		values[i] = raw
+		keys[i] = item.Key
+		shard := c.shard(item.Key)
+		byShard[shard] = append(byShard[shard], i)
+	}
+	defer c.broadcast(Invalidation{Keys: keys})
+	for shard, positions := range byShard {
+		shard.lock.Lock()
+		for _, i := range positions {
+			if err := c.set(shard, items[i].Key, values[i], items[i].SoftTTL, c.ttlOrDefault(items[i].TTL)); err != nil {
+				shard.lock.Unlock()
+				return err
 			}
 		}
-		element := c.list.PushFront(newNode)
-		c.index[key] = element
-		c.used += newNodeSize
+		shard.lock.Unlock()
 	}
 	return nil
 }
 
-// DeleteCache deletes a value from the cache
-func (c *LRUCache) Delete(key string) error {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-
-	if element, found := c.index[key]; found {
-		node := element.Value.(*CacheData)
-		removeAndResize(c, node, element)
-		logrus.Infof("Deleted cache for key %s", key)
-		return nil
+// ttlOrDefault returns the ttl, or the default ttl of the cache when none was given
+func (c *LRUCache) ttlOrDefault(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return c.defaultTTL
+	}
+	return ttl
+}
+
+// set adds or updates an encoded value in its shard, appending it to the append-only log first
+// when the cache has one. Caller must hold the shard lock.
+func (c *LRUCache) set(shard *cacheShard, key string, value []byte, softTTL time.Duration, ttl time.Duration) error {
+	return c.setUntil(shard, key, value, ttl, CalculateExpiryTime(ttl), CalculateSoftExpiry(softTTL, ttl), 0, nil)
+}
+
+// setUntil is set with explicit expiry times, version, 0 for the next version of the cache, and
+// tags to attach. Caller must hold the shard lock.
+func (c *LRUCache) setUntil(shard *cacheShard, key string, value []byte, ttl time.Duration, expiryTime time.Time, softExpiry time.Time, version uint64, tags []string) error {
+	if err := shard.fits(key, value); err != nil {
+		return err
+	}
+	record := aofRecord{Op: aofOpSet, snapshotRecord: newSnapshotRecord(key, value, ttl, expiryTime, softExpiry, tags)}
+	if err := c.logRecord(record); err != nil {
+		return err
+	}
+	return shard.setWithExpiry(key, value, ttl, expiryTime, softExpiry, version, tags)
+}
+
+// fits checks that an entry is not larger than the whole shard
+func (s *cacheShard) fits(key string, value []byte) error {
+	if size := CalculateSize(key, value); size > s.capacity {
+		logrus.Warnf("Entry for key %s needs %d bytes, more than the shard capacity of %d bytes", key, size, s.capacity)
+		return utils.TooLarge
+	}
+	return nil
+}
+
+// setWithExpiry adds or updates an encoded value with an explicit expiry time and version, 0 for
+// the next version of the cache, evicting entries as needed. The tags are added to those the
+// entry already carries. Caller must hold the lock.
+func (s *cacheShard) setWithExpiry(key string, value []byte, ttl time.Duration, expiryTime time.Time, softExpiry time.Time, version uint64, tags []string) error {
+	if err := s.fits(key, value); err != nil {
+		return err
+	}
+	if version == 0 {
+		version = s.versions.Add(1)
+	}
+	size := CalculateSize(key, value)
+	s.drainReads()
+	node, found := s.index[key]
+	if found {
+		logrus.Debugf("Updating existing cache for key %s", key)
+		updateAndResize(s, node, value, ttl, expiryTime, softExpiry)
+		node.version = version
+		heap.Fix(&s.expiries, node.expiryIndex)
+		s.policy.Access(node)
 	} else {
-		logrus.Infof("Cache miss for key %s during deletion", key)
+		logrus.Debugf("Creating new cache node for key %s", key)
+		node = &entry{key: key, value: value, ttl: ttl, expiryTime: expiryTime, softExpiry: softExpiry, version: version, size: size}
+		s.index[key] = node
+		s.policy.Add(node)
+		s.trackExpiry(node)
+		updateCacheUsed(s, node, true)
+	}
+	s.tag(node, tags)
+	s.events.publish(EventSet, key)
+	s.evict()
+	return nil
+}
+
+// evict removes the victims chosen by the eviction policy until the shard fits its capacity. Caller must hold the lock.
+func (s *cacheShard) evict() {
+	for s.used > s.capacity {
+		victim := s.policy.Victim()
+		if victim == nil {
+			return
+		}
+		logrus.Warnf("Capacity Exceeded. Evicting key %s.", victim.key)
+		removeAndResize(s, victim, EventEvict)
+	}
+}
+
+// DeleteCache deletes a value from the cache
+func (c *LRUCache) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	shard := c.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	deleted, err := c.delete(shard, key)
+	if err != nil {
+		return err
+	}
+	c.broadcast(Invalidation{Keys: []string{key}}) // the other replicas may hold it even when this one does not
+	if !deleted {
 		return utils.NotFound
 	}
+	return nil
+}
+
+// DeleteIf deletes the key when the condition holds for its live entry
+func (c *LRUCache) DeleteIf(ctx context.Context, key string, condition Condition) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	shard := c.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	version, exists := shard.version(key)
+	if !condition.Holds(version, exists) {
+		return utils.PreconditionFailed
+	}
+	c.broadcast(Invalidation{Keys: []string{key}})
+	if !exists {
+		return utils.NotFound
+	}
+	_, err := c.delete(shard, key)
+	return err
+}
+
+// DeleteMany removes the keys and reports how many existed
+func (c *LRUCache) DeleteMany(ctx context.Context, keys []string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	defer c.broadcast(Invalidation{Keys: keys})
+	deleted := 0
+	for _, key := range keys {
+		shard := c.shard(key)
+		shard.lock.Lock()
+		found, err := c.delete(shard, key)
+		shard.lock.Unlock()
+		if err != nil {
+			return deleted, err
+		}
+		if found {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// delete removes a key from its shard if present, appending the deletion to the append-only
+// log first when the cache has one. Caller must hold the shard lock.
+func (c *LRUCache) delete(shard *cacheShard, key string) (bool, error) {
+	if _, found := shard.index[key]; !found {
+		logrus.Debugf("Cache miss for key %s during deletion", key)
+		return false, nil
+	}
+	if err := c.logRecord(aofRecord{Op: aofOpDelete, snapshotRecord: snapshotRecord{Key: key}}); err != nil {
+		return false, err
+	}
+	return shard.delete(key), nil
+}
+
+// delete removes a key if present. Caller must hold the lock.
+func (s *cacheShard) delete(key string) bool {
+	if node, found := s.index[key]; found {
+		removeAndResize(s, node, EventDelete)
+		logrus.Debugf("Deleted cache for key %s", key)
+		return true
+	}
+	logrus.Debugf("Cache miss for key %s during deletion", key)
+	return false
 }
 
 // Returns expiry time of a cache based on it's TTL value
 func CalculateExpiryTime(ttl time.Duration) time.Time {
-	logrus.Debug("Calculating Expiry Time...")
 	return time.Now().Add(ttl * time.Second)
 }
 
-// Returns the size of the node that holds the data, key and ttl
-func CalculateSize(node *CacheData) int {
-	size := reflect.TypeOf(*node).Size()
-	return int(size)
+// Returns the time a value turns stale, zero when the soft TTL is unset or not shorter than the TTL
+func CalculateSoftExpiry(softTTL time.Duration, ttl time.Duration) time.Time {
+	if softTTL <= 0 || softTTL >= ttl {
+		return time.Time{}
+	}
+	return time.Now().Add(softTTL * time.Second)
+}
+
+// Returns the bytes accounted to an entry: its key, its encoded value and the fixed per-entry overhead
+func CalculateSize(key string, value []byte) int {
+	return len(key) + len(value) + entryOverhead
 }
 
-// Function to clear the cache
-func (c *LRUCache) Clear() error {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	c.list.Init()
-	c.index = make(map[string]*list.Element)
-	c.used = 0
+// Function to clear the cache, keeping the locks. Every shard is locked for the duration, so that
+// the clear is atomic and ordered with the other writes in the append-only log.
+func (c *LRUCache) Clear(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := c.clear(); err != nil {
+		return err
+	}
+	c.broadcast(Invalidation{Clear: true})
+	return nil
+}
+
+// clear is Clear without telling the other replicas
+func (c *LRUCache) clear() error {
+	for _, shard := range c.shards {
+		shard.lock.Lock()
+		defer shard.lock.Unlock()
+	}
+	if err := c.logRecord(aofRecord{Op: aofOpClear}); err != nil {
+		return err
+	}
+	for _, shard := range c.shards {
+		shard.clear()
+	}
+	c.events.publish(EventClear, "")
 	logrus.Infof("Cache cleared")
 	return nil
 }
 
+// clear removes every entry of the shard but the locks, see keptOnClear. Caller must hold the lock.
+func (s *cacheShard) clear() {
+	var kept []*entry
+	for key, node := range s.index {
+		if keptOnClear(key) {
+			kept = append(kept, node)
+		}
+	}
+	s.drainReads()
+	s.policy.Reset()
+	s.expiries = nil
+	s.tags = nil
+	s.index = make(map[string]*entry)
+	s.used = 0
+	for _, node := range kept {
+		node = &entry{key: node.key, value: node.value, ttl: node.ttl, expiryTime: node.expiryTime, softExpiry: node.softExpiry, version: node.version, size: node.size}
+		s.index[node.key] = node
+		s.policy.Add(node)
+		s.trackExpiry(node)
+		updateCacheUsed(s, node, true)
+	}
+}
+
 // Function to update the cache used size 
-func updateCacheUsed(c *LRUCache, node *CacheData, isAddition bool) {
+func updateCacheUsed(s *cacheShard, node *entry, isAddition bool) {
 	if isAddition { 				// Boolean to mention whether to add or remove size
-		c.used += CalculateSize(node)
+		s.used += node.size
 	} else {
-		c.used -= CalculateSize(node)
+		s.used -= node.size
 	}
 }
 
-// deletes the data physically from node and map
-func removeAndResize(c *LRUCache, node *CacheData, element *list.Element) {
-	updateCacheUsed(c, node, false) // Reduce the size of the node that is replaced
-	c.list.Remove(element)          // removes the node from list
-	delete(c.index, node.Key)       // Deletes record from Map
+// deletes the data physically from node and map, telling the watchers why
+func removeAndResize(s *cacheShard, node *entry, event string) {
+	updateCacheUsed(s, node, false) // Reduce the size of the node that is replaced
+	s.policy.Remove(node)           // removes the node from the eviction policy
+	s.untrackExpiry(node)           // and from the expiry heap
+	s.untag(node)                   // and from the tag index
+	delete(s.index, node.key)       // Deletes record from Map
+	s.events.publish(event, node.key)
 }
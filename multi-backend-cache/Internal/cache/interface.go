@@ -1,11 +1,141 @@
 package cache
 
-import "time"
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// NoExpiry is the TTL reported by GetWithTTL for entries that never expire.
+const NoExpiry time.Duration = -1
 
 type CacheSystem interface {
-	Get(key string) (interface{}, error)
-	//GetWithTTL(key string) (interface{}, time.Duration, time.Time, error)
-	Set(key string, value interface{}, ttl time.Duration) error
-	Delete(key string) error
-	Clear() error
-}
\ No newline at end of file
+	Get(ctx context.Context, key string) (interface{}, error)
+	// GetWithTTL returns the value along with its remaining TTL and absolute expiry time.
+	// Entries without an expiry report NoExpiry and a zero expiry time.
+	GetWithTTL(ctx context.Context, key string) (interface{}, time.Duration, time.Time, error)
+	Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+	Clear(ctx context.Context) error
+	// GetMany returns the values of the keys that exist; missing keys are left out of the map.
+	GetMany(ctx context.Context, keys []string) (map[string]interface{}, error)
+	// SetMany stores every item with its own TTL, falling back to the default TTL.
+	SetMany(ctx context.Context, items []CacheData) error
+	// DeleteMany removes the keys and reports how many of them existed.
+	DeleteMany(ctx context.Context, keys []string) (int, error)
+	// SetWithSoftTTL stores a value that is served stale after softTTL and expires after ttl,
+	// both in seconds. A softTTL of 0 behaves like Set.
+	SetWithSoftTTL(ctx context.Context, key string, value interface{}, softTTL time.Duration, ttl time.Duration) error
+	// GetItem returns the value along with its expiry, soft expiry and version.
+	GetItem(ctx context.Context, key string) (Item, error)
+	// SetIf is SetWithSoftTTL applied only when the condition holds for the current entry,
+	// failing with utils.PreconditionFailed otherwise. It returns the version of the new entry,
+	// 0 when the backend cannot tell it.
+	SetIf(ctx context.Context, key string, value interface{}, softTTL time.Duration, ttl time.Duration, condition Condition) (uint64, error)
+	// DeleteIf is Delete applied only when the condition holds for the current entry, failing
+	// with utils.PreconditionFailed otherwise.
+	DeleteIf(ctx context.Context, key string, condition Condition) error
+	// Incr atomically adds delta, which may be negative, to the integer stored at the key and
+	// returns the result. A missing key is created as initial + delta with the TTL, falling back
+	// to the default TTL; an existing counter keeps its expiry. It fails with utils.NotInteger
+	// when the value is not an integer.
+	Incr(ctx context.Context, key string, delta int64, initial int64, ttl time.Duration) (int64, error)
+}
+
+// Item is a cached value with its expiry times
+type Item struct {
+	Value      interface{}
+	ExpiryTime time.Time // zero when the entry never expires
+	SoftExpiry time.Time // zero when the entry never turns stale
+	Version    uint64    // changes on every write, 0 when the backend does not track it
+}
+
+// Stale reports whether the item is past its soft TTL, and should be refreshed
+func (i Item) Stale() bool {
+	return !i.SoftExpiry.IsZero() && time.Now().After(i.SoftExpiry)
+}
+
+// TTL returns the remaining TTL of the item, NoExpiry when it never expires
+func (i Item) TTL() time.Duration {
+	if i.ExpiryTime.IsZero() {
+		return NoExpiry
+	}
+	return time.Until(i.ExpiryTime)
+}
+
+// Condition is what a conditional write expects of the entry it replaces or deletes, as given
+// by the If-Match and If-None-Match headers. The zero Condition always holds.
+type Condition struct {
+	IfMatch     []uint64 // the entry exists with one of these versions
+	IfNoneMatch []uint64 // the entry does not exist with any of these versions
+	IfExists    bool     // the entry exists, If-Match: *
+	IfAbsent    bool     // the entry does not exist, If-None-Match: *
+}
+
+// IsZero reports whether the condition sets no requirement
+func (c Condition) IsZero() bool {
+	return len(c.IfMatch) == 0 && len(c.IfNoneMatch) == 0 && !c.IfExists && !c.IfAbsent
+}
+
+// Write modes of a set: upsert by default, add only creates the entry and replace only updates it
+const (
+	ModeUpsert  = "upsert"
+	ModeAdd     = "add"
+	ModeReplace = "replace"
+)
+
+// ConditionForMode returns the condition of a write mode, empty for an upsert
+func ConditionForMode(mode string) (Condition, error) {
+	switch mode {
+	case "", ModeUpsert:
+		return Condition{}, nil
+	case ModeAdd:
+		return Condition{IfAbsent: true}, nil
+	case ModeReplace:
+		return Condition{IfExists: true}, nil
+	}
+	return Condition{}, fmt.Errorf("unknown write mode %q, expected %s, %s or %s", mode, ModeUpsert, ModeAdd, ModeReplace)
+}
+
+// mode returns the write mode the condition amounts to, empty when it also checks versions.
+// Backends map the add and replace modes to their native commands.
+func (c Condition) mode() string {
+	if len(c.IfMatch) > 0 || len(c.IfNoneMatch) > 0 || c.IfExists == c.IfAbsent {
+		return ""
+	}
+	if c.IfAbsent {
+		return ModeAdd
+	}
+	return ModeReplace
+}
+
+// Holds reports whether the condition accepts the entry found, version is ignored when the
+// entry does not exist
+func (c Condition) Holds(version uint64, exists bool) bool {
+	if (c.IfExists || len(c.IfMatch) > 0) && !exists {
+		return false
+	}
+	if c.IfAbsent && exists {
+		return false
+	}
+	if len(c.IfMatch) > 0 && !slices.Contains(c.IfMatch, version) {
+		return false
+	}
+	return !exists || !slices.Contains(c.IfNoneMatch, version)
+}
+
+// TenantScoped is implemented by the backends that keep the data of every tenant on one server.
+// ForTenant returns a view of the backend restricted to the keys of the tenant.
+type TenantScoped interface {
+	ForTenant(tenantID string) CacheSystem
+}
+
+// contextError prefers the context error over a backend error caused by it,
+// so that callers can tell timeouts and cancellations apart from backend failures.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
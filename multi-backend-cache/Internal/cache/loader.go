@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"multi-backend-cache/Internal/config"
+	utils "multi-backend-cache/packageUtils/Utils"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Largest origin response that is read, bigger ones fail the load.
+const maxOriginResponse = 8 << 20
+
+// Loader fetches the values of a key namespace from an HTTP origin on a cache miss.
+// With a grace period, the loaded values are kept that long past their TTL: they turn stale at
+// the TTL at the latest, and once past it they are only served when their reload fails.
+type Loader struct {
+	prefix  string
+	url     string // template with {key} and {tenantID} placeholders
+	ttl     time.Duration
+	softTTL time.Duration
+	grace   time.Duration
+	timeout time.Duration
+}
+
+// Loaders picks the loader of a key by its longest matching prefix
+type Loaders struct {
+	loaders []*Loader
+	client  *http.Client
+}
+
+func NewLoaders(configs []config.LoaderConfig) *Loaders {
+	loaders := &Loaders{client: &http.Client{}}
+	for _, loaderConfig := range configs {
+		if loaderConfig.URL == "" {
+			logrus.Warnf("Ignoring the loader of prefix %q without URL", loaderConfig.Prefix)
+			continue
+		}
+		timeout := loaderConfig.Timeout
+		if timeout <= 0 {
+			timeout = config.AppConfig.OperationTimeout
+		}
+		loader := &Loader{
+			prefix:  loaderConfig.Prefix,
+			url:     loaderConfig.URL,
+			ttl:     time.Duration(loaderConfig.TTL),
+			softTTL: time.Duration(loaderConfig.SoftTTL),
+			timeout: time.Duration(timeout) * time.Millisecond,
+		}
+		if loaderConfig.Grace > 0 {
+			// The expiry is told by the soft expiry, so the TTL must be known and the value stale by then
+			loader.grace = time.Duration(loaderConfig.Grace)
+			if loader.ttl <= 0 {
+				loader.ttl = time.Duration(config.AppConfig.DefaultTTL)
+			}
+			if loader.softTTL <= 0 || loader.softTTL > loader.ttl {
+				loader.softTTL = loader.ttl
+			}
+		}
+		loaders.loaders = append(loaders.loaders, loader)
+	}
+	return loaders
+}
+
+// For returns the loader of the key, nil if no loader covers it
+func (l *Loaders) For(key string) *Loader {
+	if l == nil {
+		return nil
+	}
+	var found *Loader
+	for _, loader := range l.loaders {
+		if strings.HasPrefix(key, loader.prefix) && (found == nil || len(loader.prefix) > len(found.prefix)) {
+			found = loader
+		}
+	}
+	return found
+}
+
+// Load fetches the value of the key from the origin of its loader. An origin answering 404
+// reports utils.NotFound; any other status than 200 is an error.
+func (l *Loaders) Load(ctx context.Context, loader *Loader, key string, tenantID string) (interface{}, error) {
+	if loader.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, loader.timeout)
+		defer cancel()
+	}
+	originURL := loader.originURL(key, tenantID)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, originURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", "application/json")
+	response, err := l.client.Do(request)
+	if err != nil {
+		logrus.Errorf("Error loading key %s from %s: %v", key, originURL, err)
+		return nil, contextError(ctx, err)
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, utils.NotFound
+	default:
+		return nil, fmt.Errorf("origin %s answered %s", originURL, response.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxOriginResponse+1))
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	if len(body) > maxOriginResponse {
+		return nil, fmt.Errorf("origin %s answered more than %d bytes", originURL, maxOriginResponse)
+	}
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return nil, fmt.Errorf("origin %s answered invalid JSON: %w", originURL, err)
+	}
+	logrus.Infof("Loaded key %s from %s", key, originURL)
+	return value, nil
+}
+
+// originURL fills the placeholders of the URL template. They are path escaped before the "?" and
+// query escaped after it, so that a key cannot add query parameters of its own.
+func (loader *Loader) originURL(key string, tenantID string) string {
+	fill := func(template string, escape func(string) string) string {
+		return strings.NewReplacer(
+			"{key}", escape(strings.TrimPrefix(key, loader.prefix)),
+			"{tenantID}", escape(tenantID),
+		).Replace(template)
+	}
+	path, query, hasQuery := strings.Cut(loader.url, "?")
+	if !hasQuery {
+		return fill(path, url.PathEscape)
+	}
+	return fill(path, url.PathEscape) + "?" + fill(query, url.QueryEscape)
+}
+
+// TTL returns the TTL in seconds the loaded values are cached with, grace period included, 0 for
+// the default TTL
+func (loader *Loader) TTL() time.Duration {
+	return loader.ttl + loader.grace
+}
+
+// SoftTTL returns the TTL in seconds after which the loaded values are refreshed, 0 for never
+func (loader *Loader) SoftTTL() time.Duration {
+	return loader.softTTL
+}
+
+// Expired reports whether an item is past the TTL of the loader and only kept for its grace
+// period. Items written without a soft expiry, which the loader did not store, never are.
+func (loader *Loader) Expired(item Item) bool {
+	if loader.grace <= 0 || item.SoftExpiry.IsZero() {
+		return false
+	}
+	return time.Now().After(item.SoftExpiry.Add((loader.ttl - loader.softTTL) * time.Second))
+}
@@ -0,0 +1,242 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	utils "multi-backend-cache/packageUtils/Utils"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// Locks live next to the cache keys. Every lock has a lease key under the first prefix, holding
+// the owner, and a fencing counter under the second, so that no lock name can reach the counter
+// of another lock.
+const (
+	lockKeyPrefix  = "__lock__:"
+	fenceKeyPrefix = "__fence__:"
+)
+
+// Lifetime of a fencing counter, in seconds. A counter that expired or was evicted is recreated
+// from the clock in milliseconds, so fencing tokens keep growing as long as a lock is acquired
+// less than once per millisecond on average.
+const fenceTTL = 24 * 60 * 60
+
+// Lease is a lock held by its owner until it expires
+type Lease struct {
+	Name       string    `json:"name"`
+	Owner      string    `json:"owner"`           // token proving ownership
+	Fence      int64     `json:"fence,omitempty"` // grows with every acquisition, 0 on refresh
+	ExpiryTime time.Time `json:"expiry_time"`
+}
+
+// Locker hands out leases on named locks
+type Locker interface {
+	// Acquire takes the lock for ttl, failing with utils.Locked while another owner holds it.
+	Acquire(ctx context.Context, name string, ttl time.Duration) (Lease, error)
+	// Refresh extends the lease of the owner to ttl from now, failing with utils.NotOwner when
+	// the owner does not hold the lock anymore.
+	Refresh(ctx context.Context, name string, owner string, ttl time.Duration) (Lease, error)
+	// Release frees the lock, failing with utils.NotOwner when the owner does not hold it.
+	Release(ctx context.Context, name string, owner string) error
+}
+
+// LockerFor returns the locker of a backend: its own when it has one, otherwise a locker built
+// on its versioned writes
+func LockerFor(cacheSystem CacheSystem) Locker {
+	if locker, ok := cacheSystem.(Locker); ok {
+		return locker
+	}
+	return &versionedLocker{cache: cacheSystem}
+}
+
+func lockKey(name string) string {
+	return lockKeyPrefix + name
+}
+
+func fenceKey(name string) string {
+	return fenceKeyPrefix + name
+}
+
+// fenceSeed is the value a fencing counter is recreated from
+func fenceSeed() int64 {
+	return time.Now().UnixMilli()
+}
+
+// newLockOwner returns a random owner token
+func newLockOwner() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// versionedLocker keeps a lease as an entry holding its owner. The entry is added to take the
+// lock, and replaced or deleted only while it keeps the version read with the owner, so that a
+// lease that changed hands in between is left alone. With memcache these are Add and CAS.
+// The TTLs of the backends are whole seconds, so leases are rounded up to the second.
+type versionedLocker struct {
+	cache CacheSystem
+}
+
+// leaseSeconds rounds a lease up to the TTL in seconds of the backends
+func leaseSeconds(ttl time.Duration) time.Duration {
+	return (ttl + time.Second - 1) / time.Second
+}
+
+func (l *versionedLocker) Acquire(ctx context.Context, name string, ttl time.Duration) (Lease, error) {
+	owner, err := newLockOwner()
+	if err != nil {
+		return Lease{}, err
+	}
+	seconds := leaseSeconds(ttl)
+	if _, err := l.cache.SetIf(ctx, lockKey(name), owner, 0, seconds, Condition{IfAbsent: true}); err != nil {
+		if err == utils.PreconditionFailed {
+			return Lease{}, utils.Locked
+		}
+		return Lease{}, err
+	}
+	// Counted while holding the lock, so that fencing tokens follow the order of the leases
+	fence, err := l.cache.Incr(ctx, fenceKey(name), 1, fenceSeed(), fenceTTL)
+	if err != nil {
+		logrus.Errorf("Error counting the fencing token of lock %s: %v", name, err)
+		if err := l.Release(ctx, name, owner); err != nil {
+			logrus.Errorf("Error releasing lock %s: %v", name, err)
+		}
+		return Lease{}, err
+	}
+	return Lease{Name: name, Owner: owner, Fence: fence, ExpiryTime: CalculateExpiryTime(seconds)}, nil
+}
+
+func (l *versionedLocker) Refresh(ctx context.Context, name string, owner string, ttl time.Duration) (Lease, error) {
+	version, err := l.holder(ctx, name, owner)
+	if err != nil {
+		return Lease{}, err
+	}
+	seconds := leaseSeconds(ttl)
+	if _, err := l.cache.SetIf(ctx, lockKey(name), owner, 0, seconds, Condition{IfMatch: []uint64{version}}); err != nil {
+		if err == utils.PreconditionFailed {
+			return Lease{}, utils.NotOwner
+		}
+		return Lease{}, err
+	}
+	return Lease{Name: name, Owner: owner, ExpiryTime: CalculateExpiryTime(seconds)}, nil
+}
+
+func (l *versionedLocker) Release(ctx context.Context, name string, owner string) error {
+	version, err := l.holder(ctx, name, owner)
+	if err != nil {
+		return err
+	}
+	err = l.cache.DeleteIf(ctx, lockKey(name), Condition{IfMatch: []uint64{version}})
+	if err == utils.PreconditionFailed || err == utils.NotFound {
+		return utils.NotOwner
+	}
+	return err
+}
+
+// holder returns the version of the lease when the owner holds the lock
+func (l *versionedLocker) holder(ctx context.Context, name string, owner string) (uint64, error) {
+	item, err := l.cache.GetItem(ctx, lockKey(name))
+	if err == utils.NotFound {
+		return 0, utils.NotOwner
+	}
+	if err != nil {
+		return 0, err
+	}
+	if item.Value != owner || item.Version == 0 {
+		return 0, utils.NotOwner
+	}
+	return item.Version, nil
+}
+
+// acquireScript takes the lock with SET NX PX and counts its fencing token, creating the counter
+// from the clock when it is missing. It returns nil while the lock is held.
+var acquireScript = redis.NewScript(`
+if not redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return false
+end
+if redis.call("EXISTS", KEYS[2]) == 0 then
+	redis.call("SET", KEYS[2], ARGV[3], "EX", ARGV[4])
+end
+return redis.call("INCR", KEYS[2])
+`)
+
+// refreshScript extends the lease when it still holds the owner
+var refreshScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releaseScript deletes the lease when it still holds the owner
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Acquire takes the lock with millisecond precision. The owner is stored JSON encoded, like any
+// other value.
+func (r *RedisCache) Acquire(ctx context.Context, name string, ttl time.Duration) (Lease, error) {
+	owner, err := newLockOwner()
+	if err != nil {
+		return Lease{}, err
+	}
+	encoded, _ := json.Marshal(owner)
+	keys := []string{r.key(lockKey(name)), r.key(fenceKey(name))}
+	fence, err := acquireScript.Run(ctx, r.client, keys, encoded, ttl.Milliseconds(), fenceSeed(), fenceTTL).Int64()
+	if err == redis.Nil {
+		return Lease{}, utils.Locked
+	}
+	if err != nil {
+		logrus.Errorf("Error acquiring lock %s: %v", name, err)
+		return Lease{}, contextError(ctx, err)
+	}
+	return Lease{Name: name, Owner: owner, Fence: fence, ExpiryTime: time.Now().Add(ttl)}, nil
+}
+
+func (r *RedisCache) Refresh(ctx context.Context, name string, owner string, ttl time.Duration) (Lease, error) {
+	encoded, _ := json.Marshal(owner)
+	refreshed, err := refreshScript.Run(ctx, r.client, []string{r.key(lockKey(name))}, encoded, ttl.Milliseconds()).Int64()
+	if err != nil {
+		logrus.Errorf("Error refreshing lock %s: %v", name, err)
+		return Lease{}, contextError(ctx, err)
+	}
+	if refreshed == 0 {
+		return Lease{}, utils.NotOwner
+	}
+	return Lease{Name: name, Owner: owner, ExpiryTime: time.Now().Add(ttl)}, nil
+}
+
+func (r *RedisCache) Release(ctx context.Context, name string, owner string) error {
+	encoded, _ := json.Marshal(owner)
+	released, err := releaseScript.Run(ctx, r.client, []string{r.key(lockKey(name))}, encoded).Int64()
+	if err != nil {
+		logrus.Errorf("Error releasing lock %s: %v", name, err)
+		return contextError(ctx, err)
+	}
+	if released == 0 {
+		return utils.NotOwner
+	}
+	return nil
+}
+
+// The tiered system keeps its locks in L2 only, where every instance sees them
+func (t *TieredCache) Acquire(ctx context.Context, name string, ttl time.Duration) (Lease, error) {
+	return LockerFor(t.l2).Acquire(ctx, name, ttl)
+}
+
+func (t *TieredCache) Refresh(ctx context.Context, name string, owner string, ttl time.Duration) (Lease, error) {
+	return LockerFor(t.l2).Refresh(ctx, name, owner, ttl)
+}
+
+func (t *TieredCache) Release(ctx context.Context, name string, owner string) error {
+	return LockerFor(t.l2).Release(ctx, name, owner)
+}
@@ -1,80 +1,773 @@
 package cache
 
 import (
-	"encoding/json"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	utils "multi-backend-cache/packageUtils/Utils"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/sirupsen/logrus"
 )
 
+// Times a conditional write is retried when another client changes the key in between
+const memcacheCASRetries = 3
+
+// Idle connections kept for the meta-protocol commands, as many as gomemcache keeps by default
+const memcacheMetaIdleConns = memcache.DefaultMaxIdleConns
+
 type MemCache struct {
-	client *memcache.Client
-	ttl    int32
+	client    *memcache.Client
+	metaConns *metaConns // used for meta-protocol commands that gomemcache does not support
+	ttl       int32
+	tenantID  string // tenant the cache is scoped to, empty for the whole server
 }
 
 func NewMemCache(server string, ttl int32) *MemCache {
 	client := memcache.New(server)
 	logrus.Infof("Memcache initialized with server: %s", server)
-	return &MemCache{client: client, ttl: ttl}
+	return &MemCache{client: client, metaConns: newMetaConns(server), ttl: ttl}
+}
+
+// ForTenant returns a view of the cache holding only the keys of the tenant. Memcache cannot
+// list keys, so the keys of a tenant are prefixed with "<tenantID>:<generation>:" and Clear
+// moves the tenant to a new generation, leaving the old keys to expire or be evicted.
+func (m *MemCache) ForTenant(tenantID string) CacheSystem {
+	return &MemCache{client: m.client, metaConns: m.metaConns, ttl: m.ttl, tenantID: tenantID}
+}
+
+// generationKey holds the current generation of the tenant
+func (m *MemCache) generationKey() string {
+	return m.tenantID + ":generation"
+}
+
+// namespace returns the prefix of the keys of the tenant, starting a generation if the tenant
+// has none yet (or it was evicted, which drops the keys of the old one)
+func (m *MemCache) namespace(ctx context.Context) (string, error) {
+	if m.tenantID == "" {
+		return "", nil
+	}
+	var generation string
+	err := m.do(ctx, func() (err error) {
+		generation, err = m.generation(m.generationKey(), newGeneration())
+		return err
+	})
+	if err != nil {
+		logrus.Errorf("Error getting the generation of tenant %s: %v", m.tenantID, err)
+		return "", err
+	}
+	return m.tenantID + ":" + generation + ":", nil
+}
+
+// keyNamespace returns the prefix of the key. The locks of a tenant live outside its
+// generations, so that Clear keeps them, see keptOnClear.
+func (m *MemCache) keyNamespace(ctx context.Context, key string) (string, error) {
+	if !keptOnClear(key) {
+		return m.namespace(ctx)
+	}
+	if m.tenantID == "" {
+		return "", nil
+	}
+	return m.tenantID + ":", nil
+}
+
+func newGeneration() []byte {
+	return []byte(strconv.FormatInt(time.Now().UnixNano(), 36))
+}
+
+// generation returns the generation stored at the key, adding initial when there is none
+func (m *MemCache) generation(key string, initial []byte) (string, error) {
+	for {
+		item, err := m.client.Get(key)
+		if err == nil {
+			return string(item.Value), nil
+		}
+		if err != memcache.ErrCacheMiss {
+			return "", err
+		}
+		err = m.client.Add(&memcache.Item{Key: key, Value: initial})
+		if err == nil {
+			return string(initial), nil
+		}
+		if err != memcache.ErrNotStored { // ErrNotStored: another client started one first
+			return "", err
+		}
+	}
+}
+
+// do runs a memcache call, returning early when the context is cancelled or its deadline passes.
+// gomemcache has no context support, so an abandoned call is still bounded by the client's own
+// network timeout.
+func (m *MemCache) do(ctx context.Context, op func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- op()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Get retrieves a value from the cache by key
-func (m *MemCache) Get(key string) (interface{}, error) {
-	item, err := m.client.Get(key)
-	// fmt.Println(item.Expiration)
+func (m *MemCache) Get(ctx context.Context, key string) (interface{}, error) {
+	item, err := m.GetItem(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return item.Value, nil
+}
+
+// GetWithTTL retrieves the value and its remaining TTL for the specified key.
+func (m *MemCache) GetWithTTL(ctx context.Context, key string) (interface{}, time.Duration, time.Time, error) {
+	item, ttl, err := m.getItem(ctx, key, "t v")
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	return item.Value, ttl, item.ExpiryTime, nil
+}
+
+// GetItem retrieves the value and its CAS ID as version with a plain get on the pooled
+// connections of the client. A get does not return the expiry, so it is left zero; GetWithTTL
+// asks memcached for it.
+func (m *MemCache) GetItem(ctx context.Context, key string) (Item, error) {
+	namespace, err := m.keyNamespace(ctx, key)
+	if err != nil {
+		return Item{}, err
+	}
+	var item *memcache.Item
+	err = m.do(ctx, func() (err error) {
+		item, err = m.client.Get(namespace + key)
+		return err
+	})
 	if err != nil {
 		if err == memcache.ErrCacheMiss {
-			return nil, utils.NotFound
+			return Item{}, utils.NotFound
 		}
 		logrus.Errorf("Get: error getting key %s: %v", key, err)
-		return nil, err
+		return Item{}, err
 	}
-	var data interface{}
-	err = json.Unmarshal(item.Value, &data)
+	data, softExpiry, tags, err := decodeTaggedValue(item.Value)
 	if err != nil {
 		logrus.Errorf("Get: error unmarshaling value for key %s: %v", key, err)
+		return Item{}, err
+	}
+	if err := m.checkTags(ctx, namespace, tags); err != nil {
+		return Item{}, err
+	}
+	return Item{Value: data, SoftExpiry: softExpiry, Version: item.CasID}, nil
+}
+
+// getItem returns the item along with the remaining TTL reported by memcached.
+// gomemcache does not expose item expiration, so this issues a meta-protocol
+// "mg <key> <flags>" command directly (memcached 1.6+).
+func (m *MemCache) getItem(ctx context.Context, key string, flags string) (Item, time.Duration, error) {
+	namespace, err := m.keyNamespace(ctx, key)
+	if err != nil {
+		return Item{}, 0, err
+	}
+	if !legalMemcacheKey(namespace + key) {
+		return Item{}, 0, memcache.ErrMalformedKey
+	}
+	var raw []byte
+	var ttl time.Duration
+	var cas uint64
+	err = m.meta(ctx, fmt.Sprintf("mg %s%s %s", namespace, key, flags), func(r *bufio.Reader) (err error) {
+		raw, ttl, cas, err = readMetaGetResponse(r)
+		return err
+	})
+	if err != nil {
+		if err == memcache.ErrCacheMiss {
+			return Item{}, 0, utils.NotFound
+		}
+		logrus.Errorf("GetWithTTL: error getting key %s: %v", key, err)
+		return Item{}, 0, err
+	}
+
+	data, softExpiry, tags, err := decodeTaggedValue(raw)
+	if err != nil {
+		logrus.Errorf("GetWithTTL: error unmarshaling value for key %s: %v", key, err)
+		return Item{}, 0, err
+	}
+	if err := m.checkTags(ctx, namespace, tags); err != nil {
+		return Item{}, 0, err
+	}
+	item := Item{Value: data, SoftExpiry: softExpiry, Version: cas}
+	if ttl < 0 {
+		return item, NoExpiry, nil
+	}
+	item.ExpiryTime = time.Now().Add(ttl)
+	return item, ttl, nil
+}
+
+// metaConns keeps the idle connections of the meta-protocol commands to a server, shared by the
+// tenant views of the cache
+type metaConns struct {
+	server string
+	idle   chan *metaConn
+}
+
+// metaConn is a connection with the buffers reading and writing it
+type metaConn struct {
+	net.Conn
+	rw *bufio.ReadWriter
+}
+
+func newMetaConns(server string) *metaConns {
+	return &metaConns{server: server, idle: make(chan *metaConn, memcacheMetaIdleConns)}
+}
+
+// get returns an idle connection, or a new one when there is none, telling which it was
+func (p *metaConns) get(ctx context.Context) (*metaConn, bool, error) {
+	select {
+	case conn := <-p.idle:
+		return conn, true, nil
+	default:
+	}
+	conn, err := p.dial(ctx)
+	return conn, false, err
+}
+
+func (p *metaConns) dial(ctx context.Context) (*metaConn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", p.server)
+	if err != nil {
 		return nil, err
 	}
-	return data, nil
+	return &metaConn{Conn: conn, rw: bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))}, nil
+}
+
+// put keeps the connection for the next command, or closes it when enough are kept
+func (p *metaConns) put(conn *metaConn) {
+	select {
+	case p.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// meta sends one meta-protocol command and reads the reply with read, on an idle connection when
+// there is one. A reused connection that the server has closed meanwhile is replaced once.
+func (m *MemCache) meta(ctx context.Context, command string, read func(r *bufio.Reader) error) error {
+	conn, reused, err := m.metaConns.get(ctx)
+	if err != nil {
+		logrus.Errorf("Error connecting to %s: %v", m.metaConns.server, err)
+		return contextError(ctx, err)
+	}
+	err = m.exchange(ctx, conn, command, read)
+	if reused && closedByServer(err) {
+		conn.Close()
+		if conn, err = m.metaConns.dial(ctx); err != nil {
+			logrus.Errorf("Error connecting to %s: %v", m.metaConns.server, err)
+			return contextError(ctx, err)
+		}
+		err = m.exchange(ctx, conn, command, read)
+	}
+	if err != nil && err != memcache.ErrCacheMiss {
+		conn.Close() // the reply may be partly read
+		return contextError(ctx, err)
+	}
+	m.metaConns.put(conn)
+	return err
+}
+
+// exchange writes the command on the connection and reads its reply. It is bounded by the
+// deadline of the context, or by the network timeout of the client when the context has none.
+func (m *MemCache) exchange(ctx context.Context, conn *metaConn, command string, read func(r *bufio.Reader) error) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(m.netTimeout())
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	if _, err := conn.rw.WriteString(command + "\r\n"); err != nil {
+		return err
+	}
+	if err := conn.rw.Flush(); err != nil {
+		return err
+	}
+	return read(conn.rw.Reader)
+}
+
+// netTimeout is the read and write timeout of the client, the gomemcache default unless set
+func (m *MemCache) netTimeout() time.Duration {
+	if m.client.Timeout > 0 {
+		return m.client.Timeout
+	}
+	return memcache.DefaultTimeout
+}
+
+// closedByServer reports whether the error comes from a connection the server closed
+func closedByServer(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// readMetaGetResponse parses a "VA <size> t<ttl> c<cas>" / "EN" reply to a meta get.
+// A TTL of -1 from the server means the item never expires; the CAS ID is 0 unless requested.
+func readMetaGetResponse(r *bufio.Reader) ([]byte, time.Duration, uint64, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, 0, 0, fmt.Errorf("memcache: empty meta get response")
+	}
+	switch fields[0] {
+	case "EN":
+		return nil, 0, 0, memcache.ErrCacheMiss
+	case "VA":
+	default:
+		return nil, 0, 0, fmt.Errorf("memcache: unexpected meta get response %q", strings.TrimSpace(line))
+	}
+	if len(fields) < 2 {
+		return nil, 0, 0, fmt.Errorf("memcache: malformed meta get response %q", strings.TrimSpace(line))
+	}
+	size, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("memcache: malformed value size in %q", strings.TrimSpace(line))
+	}
+	ttl := NoExpiry
+	var cas uint64
+	for _, flag := range fields[2:] {
+		switch {
+		case strings.HasPrefix(flag, "t"):
+			seconds, err := strconv.Atoi(flag[1:])
+			if err != nil {
+				return nil, 0, 0, fmt.Errorf("memcache: malformed ttl flag %q", flag)
+			}
+			if seconds >= 0 {
+				ttl = time.Duration(seconds) * time.Second
+			}
+		case strings.HasPrefix(flag, "c"):
+			if cas, err = strconv.ParseUint(flag[1:], 10, 64); err != nil {
+				return nil, 0, 0, fmt.Errorf("memcache: malformed cas flag %q", flag)
+			}
+		}
+	}
+	value := make([]byte, size+2) // value is followed by \r\n
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, 0, 0, err
+	}
+	return value[:size], ttl, cas, nil
 }
 
-// GetWithTTL retrieves the value and its TTL for the specified key
-// func (m *MemCache) GetWithTTL(key string) (interface{}, time.Duration, time.Time, error) {
-// 	item, err := m.client.Get(key)
-// 	fmt.Println("item Expiration:: ", item.Expiration)
-// 	fmt.Println("item :: ", item)
+// legalMemcacheKey mirrors gomemcache's key validation: at most 250 bytes, no spaces or control characters.
+func legalMemcacheKey(key string) bool {
+	if len(key) == 0 || len(key) > 250 {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
 
-// 	if err != nil {
-// 		fmt.Println("item error :: ", err)
-// 		return nil, 0, time.Time{}, err
-// 	}
-// 	return item.Value, time.Duration(item.Expiration) * time.Second, time.Time{}, nil
-// }
+func (m *MemCache) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	return m.SetWithSoftTTL(ctx, key, value, 0, ttl)
+}
 
-func (m *MemCache) Set(key string, value interface{}, ttl time.Duration) error {
-	ttlDuration := time.Duration(ttl) * time.Second
-	val, err := json.Marshal(value)
+// SetWithSoftTTL stores the value in an envelope carrying its soft expiry
+func (m *MemCache) SetWithSoftTTL(ctx context.Context, key string, value interface{}, softTTL time.Duration, ttl time.Duration) error {
+	actualTTL := m.expiration(ttl)
+	val, err := encodeValue(value, m.softExpiry(softTTL, actualTTL))
 	if err != nil {
 		logrus.Errorf("Set: error marshaling value for key %s: %v", key, err)
 		return err
 	}
-	actualTTL := int32(ttlDuration.Seconds())
-	if ttl <= 0 {
-		actualTTL = m.ttl
+	namespace, err := m.keyNamespace(ctx, key)
+	if err != nil {
+		return err
 	}
 	logrus.Infof("Setting KEY: %s with VALUE: %v and TTL: %d seconds", key, value, actualTTL)
-	err = m.client.Set(&memcache.Item{Key: key, Value: val, Expiration: actualTTL})
+	err = m.do(ctx, func() error {
+		return m.client.Set(&memcache.Item{Key: namespace + key, Value: val, Expiration: actualTTL})
+	})
 	if err != nil {
 		logrus.Errorf("Set: error setting key %s: %v", key, err)
 	}
 	return err
 }
 
+// SetIf stores the value when the condition holds for the current item, and returns the CAS ID
+// of the new item as its version. The add and replace modes are meta sets in the add and replace
+// modes; other conditions replace the item with a meta set checking its CAS ID, or add it when
+// there is none. A concurrent write makes the set fail and the condition is checked again, a few
+// times before giving up.
+func (m *MemCache) SetIf(ctx context.Context, key string, value interface{}, softTTL time.Duration, ttl time.Duration, condition Condition) (uint64, error) {
+	return m.SetTagged(ctx, key, value, softTTL, ttl, condition, nil)
+}
+
+// SetTagged is SetIf for a value carrying the current generation of each of its tags, see
+// InvalidateTag
+func (m *MemCache) SetTagged(ctx context.Context, key string, value interface{}, softTTL time.Duration, ttl time.Duration, condition Condition, tags []string) (uint64, error) {
+	namespace, err := m.keyNamespace(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	generations, err := m.tagGenerations(ctx, namespace, tags)
+	if err != nil {
+		return 0, err
+	}
+	actualTTL := m.expiration(ttl)
+	val, err := encodeTaggedValue(value, m.softExpiry(softTTL, actualTTL), generations)
+	if err != nil {
+		logrus.Errorf("SetIf: error marshaling value for key %s: %v", key, err)
+		return 0, err
+	}
+	if condition.IsZero() {
+		version, err := m.metaSet(ctx, namespace+key, val, actualTTL, metaSetModeSet, 0)
+		if err != nil {
+			logrus.Errorf("SetIf: error setting key %s: %v", key, err)
+		}
+		return version, err
+	}
+	if mode := condition.mode(); mode != "" {
+		metaMode := metaSetModeAdd
+		if mode == ModeReplace {
+			metaMode = metaSetModeReplace
+		}
+		version, err := m.metaSet(ctx, namespace+key, val, actualTTL, metaMode, 0)
+		if err == memcache.ErrNotStored {
+			return 0, utils.PreconditionFailed
+		}
+		if err != nil {
+			logrus.Errorf("SetIf: error setting key %s in %s mode: %v", key, mode, err)
+		}
+		return version, err
+	}
+	for attempt := 0; attempt < memcacheCASRetries; attempt++ {
+		var item *memcache.Item
+		err = m.do(ctx, func() (err error) {
+			item, err = m.client.Get(namespace + key)
+			return err
+		})
+		var version uint64
+		switch {
+		case err == memcache.ErrCacheMiss:
+			if !condition.Holds(0, false) {
+				return 0, utils.PreconditionFailed
+			}
+			version, err = m.metaSet(ctx, namespace+key, val, actualTTL, metaSetModeAdd, 0)
+		case err != nil:
+			logrus.Errorf("SetIf: error getting key %s: %v", key, err)
+			return 0, err
+		default:
+			if !condition.Holds(item.CasID, true) {
+				return 0, utils.PreconditionFailed
+			}
+			version, err = m.metaSet(ctx, namespace+key, val, actualTTL, metaSetModeSet, item.CasID)
+		}
+		// Another client wrote or deleted the key in between
+		if err != memcache.ErrNotStored && err != memcache.ErrCASConflict && err != memcache.ErrCacheMiss {
+			if err != nil {
+				logrus.Errorf("SetIf: error setting key %s: %v", key, err)
+			}
+			return version, err
+		}
+	}
+	return 0, utils.PreconditionFailed
+}
+
+// Modes of a meta set
+const (
+	metaSetModeSet     = "S"
+	metaSetModeAdd     = "E"
+	metaSetModeReplace = "R"
+)
+
+// metaSet stores the value with a meta-protocol "ms <key> <size> T<ttl> c M<mode> [C<cas>]"
+// command, which unlike the commands of gomemcache returns the CAS ID of the new item. A cas of 0
+// does not check the CAS ID of the current item. The item is not stored with ErrNotStored, or
+// with ErrCASConflict and ErrCacheMiss when the CAS ID did not match.
+func (m *MemCache) metaSet(ctx context.Context, key string, value []byte, expiration int32, mode string, cas uint64) (uint64, error) {
+	if !legalMemcacheKey(key) {
+		return 0, memcache.ErrMalformedKey
+	}
+	command := fmt.Sprintf("ms %s %d T%d c M%s", key, len(value), expiration, mode)
+	if cas != 0 {
+		command += fmt.Sprintf(" C%d", cas)
+	}
+	var fields []string
+	err := m.meta(ctx, command+"\r\n"+string(value), func(r *bufio.Reader) error {
+		line, err := r.ReadString('\n')
+		fields = strings.Fields(line)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("memcache: empty meta set response")
+	}
+	switch fields[0] {
+	case "HD":
+	case "NS":
+		return 0, memcache.ErrNotStored
+	case "EX":
+		return 0, memcache.ErrCASConflict
+	case "NF":
+		return 0, memcache.ErrCacheMiss
+	default:
+		return 0, fmt.Errorf("memcache: unexpected meta set response %q", strings.Join(fields, " "))
+	}
+	for _, flag := range fields[1:] {
+		if strings.HasPrefix(flag, "c") {
+			version, err := strconv.ParseUint(flag[1:], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("memcache: malformed cas flag %q", flag)
+			}
+			return version, nil
+		}
+	}
+	return 0, nil
+}
+
+// DeleteIf deletes the key when the condition holds for the current item. gomemcache has no
+// conditional delete, so this issues a meta-protocol "md <key> C<cas>" command directly.
+func (m *MemCache) DeleteIf(ctx context.Context, key string, condition Condition) error {
+	if condition.IsZero() {
+		return m.Delete(ctx, key)
+	}
+	namespace, err := m.keyNamespace(ctx, key)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; attempt < memcacheCASRetries; attempt++ {
+		item, err := m.GetItem(ctx, key)
+		if err == utils.NotFound {
+			if !condition.Holds(0, false) {
+				return utils.PreconditionFailed
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if !condition.Holds(item.Version, true) {
+			return utils.PreconditionFailed
+		}
+		var status string
+		err = m.meta(ctx, fmt.Sprintf("md %s%s C%d", namespace, key, item.Version), func(r *bufio.Reader) error {
+			line, err := r.ReadString('\n')
+			status = strings.TrimSpace(line)
+			return err
+		})
+		if err != nil {
+			logrus.Errorf("DeleteIf: error deleting key %s: %v", key, err)
+			return err
+		}
+		switch status {
+		case "HD":
+			return nil
+		case "EX", "NF": // another client wrote or deleted the key in between
+		default:
+			return fmt.Errorf("memcache: unexpected meta delete response %q", status)
+		}
+	}
+	return utils.PreconditionFailed
+}
+
+// Incr adds delta with Increment or Decrement, adding the counter when it is missing. Memcache
+// counters are unsigned, so they never go below 0. Races with other clients are retried until the
+// context ends, rather than failing the increment.
+func (m *MemCache) Incr(ctx context.Context, key string, delta int64, initial int64, ttl time.Duration) (int64, error) {
+	namespace, err := m.keyNamespace(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	start, ok := addInt64(initial, delta)
+	if !ok {
+		return 0, utils.NotInteger
+	}
+	start = max(start, 0)
+	var value uint64
+	err = m.do(ctx, func() (err error) {
+		// Tried again until it is done or the context ends: each failed attempt means another
+		// client added or removed the counter in between
+		for ctx.Err() == nil {
+			if delta >= 0 {
+				value, err = m.client.Increment(namespace+key, uint64(delta))
+			} else {
+				value, err = m.client.Decrement(namespace+key, uint64(-delta))
+			}
+			if err != memcache.ErrCacheMiss {
+				return err
+			}
+			err = m.client.Add(&memcache.Item{Key: namespace + key, Value: strconv.AppendInt(nil, start, 10), Expiration: m.expiration(ttl)})
+			if err != memcache.ErrNotStored { // ErrNotStored: another client added it first
+				value = uint64(start)
+				return err
+			}
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "non-numeric") {
+			return 0, utils.NotInteger
+		}
+		logrus.Errorf("Incr: error incrementing key %s: %v", key, err)
+		return 0, err
+	}
+	if value > math.MaxInt64 {
+		return 0, utils.NotInteger
+	}
+	return int64(value), nil
+}
+
+// GetMany fetches all keys with GetMulti, one round trip per memcache server
+func (m *MemCache) GetMany(ctx context.Context, keys []string) (map[string]interface{}, error) {
+	namespace, err := m.namespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+	namespaced := make([]string, len(keys))
+	for i, key := range keys {
+		namespaced[i] = namespace + key
+	}
+	var items map[string]*memcache.Item
+	err = m.do(ctx, func() (err error) {
+		items, err = m.client.GetMulti(namespaced)
+		return err
+	})
+	if err != nil {
+		logrus.Errorf("GetMany: error getting %d keys: %v", len(keys), err)
+		return nil, err
+	}
+	values := make(map[string]interface{}, len(items))
+	tagged := make(map[string]map[string]string)
+	for key, item := range items {
+		data, _, tags, err := decodeTaggedValue(item.Value)
+		if err != nil {
+			logrus.Errorf("GetMany: error unmarshaling value for key %s: %v", key, err)
+			return nil, err
+		}
+		key = strings.TrimPrefix(key, namespace)
+		values[key] = data
+		if len(tags) > 0 {
+			tagged[key] = tags
+		}
+	}
+	if len(tagged) == 0 {
+		return values, nil
+	}
+	// The generations of the tags of every entry are read at once
+	var tags []string
+	for _, generations := range tagged {
+		for tag := range generations {
+			tags = append(tags, tag)
+		}
+	}
+	current, err := m.currentGenerations(ctx, namespace, tags)
+	if err != nil {
+		return nil, err
+	}
+	for key, generations := range tagged {
+		if !sameGenerations(generations, current) {
+			delete(values, key)
+		}
+	}
+	return values, nil
+}
+
+// SetMany stores the items one by one, as the memcache text protocol has no multi-set
+func (m *MemCache) SetMany(ctx context.Context, items []CacheData) error {
+	namespace, err := m.namespace(ctx)
+	if err != nil {
+		return err
+	}
+	memItems := make([]*memcache.Item, 0, len(items))
+	for _, item := range items {
+		expiration := m.expiration(item.TTL)
+		val, err := encodeValue(item.Value, m.softExpiry(item.SoftTTL, expiration))
+		if err != nil {
+			logrus.Errorf("SetMany: error marshaling value for key %s: %v", item.Key, err)
+			return err
+		}
+		memItems = append(memItems, &memcache.Item{Key: namespace + item.Key, Value: val, Expiration: expiration})
+	}
+	err = m.do(ctx, func() error {
+		for _, item := range memItems {
+			if err := m.client.Set(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("SetMany: error setting %d keys: %v", len(items), err)
+	}
+	return err
+}
+
+// expiration converts a TTL in seconds to a memcache expiration, applying the default TTL
+func (m *MemCache) expiration(ttl time.Duration) int32 {
+	if ttl <= 0 {
+		return m.ttl
+	}
+	return int32(ttl)
+}
+
+// softExpiry returns when a value stored with the expiration turns stale
+func (m *MemCache) softExpiry(softTTL time.Duration, expiration int32) time.Time {
+	if expiration == 0 { // never expires
+		return CalculateSoftExpiry(softTTL, math.MaxInt32)
+	}
+	return CalculateSoftExpiry(softTTL, time.Duration(expiration))
+}
+
+// DeleteMany removes the keys one by one and reports how many existed
+func (m *MemCache) DeleteMany(ctx context.Context, keys []string) (int, error) {
+	namespace, err := m.namespace(ctx)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	err = m.do(ctx, func() error {
+		for _, key := range keys {
+			err := m.client.Delete(namespace + key)
+			if err == memcache.ErrCacheMiss {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("DeleteMany: error deleting %d keys: %v", len(keys), err)
+		return 0, err
+	}
+	return deleted, nil
+}
+
 // Delete removes a value from the cache by key
-func (m *MemCache) Delete(key string) error {
-	err := m.client.Delete(key)
+func (m *MemCache) Delete(ctx context.Context, key string) error {
+	namespace, err := m.keyNamespace(ctx, key)
+	if err != nil {
+		return err
+	}
+	err = m.do(ctx, func() error {
+		return m.client.Delete(namespace + key)
+	})
 	if err != nil {
 		if err == memcache.ErrCacheMiss {
 			logrus.Debugf("Delete: key %s does not exist", key)
@@ -86,9 +779,21 @@ func (m *MemCache) Delete(key string) error {
 	return err
 }
 
-func (m *MemCache) Clear() error {
+// Clear moves the tenant to a new generation, keeping its locks. The cache of the whole server
+// cannot skip the locks: it flushes the server, which releases them.
+func (m *MemCache) Clear(ctx context.Context) error {
+	if m.tenantID != "" {
+		logrus.Infof("Clearing cache entries of tenant %s", m.tenantID)
+		err := m.do(ctx, func() error {
+			return m.client.Set(&memcache.Item{Key: m.generationKey(), Value: newGeneration()})
+		})
+		if err != nil {
+			logrus.Errorf("Error while clearing cache of tenant %s: %v", m.tenantID, err)
+		}
+		return err
+	}
 	logrus.Infof("Clearing all cache entries")
-	err := m.client.FlushAll()
+	err := m.do(ctx, m.client.FlushAll)
 	if err != nil {
 		logrus.Errorf("Error while clearing cache: %v", err)
 		return err
@@ -3,17 +3,42 @@ package cache
 
 import (
 	"context"
-	"encoding/json"
+	"hash/fnv"
+	"math"
+	"multi-backend-cache/Internal/config"
 	utils "multi-backend-cache/packageUtils/Utils"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/sirupsen/logrus"
 )
 
+// Tenant namespaces of the Redis backend
+const (
+	RedisNamespacePrefix   = "prefix"   // keys of a tenant are prefixed with "<tenantID>:"
+	RedisNamespaceDatabase = "database" // a tenant with a RedisDB gets its own database
+)
+
+// Keys scanned and unlinked per round trip by a tenant scoped Clear
+const redisClearBatch = 500
+
+// Times a conditional write is retried when the key changes while it checks the condition
+const redisTransactionRetries = 3
+
 type RedisCache struct {
-	client *redis.Client
-	ttl    time.Duration
+	client    *redis.Client
+	ttl       time.Duration
+	prefix    string          // namespace of the tenant the cache is scoped to, empty for the whole database
+	databases *redisDatabases // clients of the tenant databases, shared by every view
+}
+
+// redisDatabases lazily opens one client per tenant database
+type redisDatabases struct {
+	options redis.Options
+	lock    sync.Mutex
+	clients map[int]*redis.Client
 }
 
 // var NotFound = errors.New("key does not exist")
@@ -32,11 +57,60 @@ func NewRedisCache(addr string, password string, db int, ttl time.Duration) *Red
 	// logrus.Infof("Default DialTimeout: %s", client.Options().DialTimeout)
 	// logrus.Infof("Default ReadTimeout: %s", client.Options().ReadTimeout)
 	// logrus.Infof("Default WriteTimeout: %s", client.Options().WriteTimeout)
-	return &RedisCache{client: client, ttl: ttl}
+	return &RedisCache{
+		client: client,
+		ttl:    ttl,
+		databases: &redisDatabases{
+			options: *client.Options(),
+			clients: map[int]*redis.Client{db: client},
+		},
+	}
 }
 
-func (r *RedisCache) Get(key string) (interface{}, error) {
-	val, err := r.client.Get(context.Background(), key).Result()
+// ForTenant returns a view of the cache holding only the keys of the tenant. With the database
+// namespace a tenant that has a RedisDB in its config gets that database to itself; every other
+// tenant shares the configured database under a "<tenantID>:" key prefix.
+func (r *RedisCache) ForTenant(tenantID string) CacheSystem {
+	if config.AppConfig.Redis.TenantNamespace == RedisNamespaceDatabase {
+		if db := config.AppConfig.TenantConfigFor(tenantID).RedisDB; db > 0 {
+			return &RedisCache{client: r.databases.client(db), ttl: r.ttl, databases: r.databases}
+		}
+	}
+	return &RedisCache{client: r.client, ttl: r.ttl, prefix: tenantID + ":", databases: r.databases}
+}
+
+// client returns the client of a database, opening it on first use
+func (d *redisDatabases) client(db int) *redis.Client {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if client, ok := d.clients[db]; ok {
+		return client
+	}
+	options := d.options
+	options.DB = db
+	client := redis.NewClient(&options)
+	d.clients[db] = client
+	return client
+}
+
+// key returns the name of a key in the namespace of the cache
+func (r *RedisCache) key(key string) string {
+	return r.prefix + key
+}
+
+func (r *RedisCache) keys(keys []string) []string {
+	if r.prefix == "" {
+		return keys
+	}
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = r.prefix + key
+	}
+	return prefixed
+}
+
+func (r *RedisCache) Get(ctx context.Context, key string) (interface{}, error) {
+	val, err := r.client.Get(ctx, r.key(key)).Result()
 	if err != nil {
 		if err == redis.Nil {
 			logrus.Warnf("Key %s does not exist", key)
@@ -44,10 +118,9 @@ func (r *RedisCache) Get(key string) (interface{}, error) {
 			return nil, utils.NotFound
 		}
 		logrus.Errorf("Error retrieving key %s: %v", key, err)
-		return nil, err
+		return nil, contextError(ctx, err)
 	}
-	var data interface{}
-	err = json.Unmarshal([]byte(val), &data)
+	data, _, err := decodeValue([]byte(val))
 	if err != nil {
 		logrus.Errorf("Error unmarshalling value for key %s: %v", key, err)
 		return nil, err
@@ -56,61 +129,286 @@ func (r *RedisCache) Get(key string) (interface{}, error) {
 	return data, nil
 }
 
-// func (r *RedisCache) GetWithTTL(key string) (interface{}, time.Duration, time.Time, error) {
-// 	ctx := context.Background()
+// GetWithTTL fetches the value and its remaining TTL (via PTTL) in a single round trip
+func (r *RedisCache) GetWithTTL(ctx context.Context, key string) (interface{}, time.Duration, time.Time, error) {
+	item, ttl, err := r.getItem(ctx, key)
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	return item.Value, ttl, item.ExpiryTime, nil
+}
 
-// 	value, err := r.client.Get(ctx, key).Result()
-// 	if err != nil {
-// 		return nil, 0, time.Time{}, err
-// 	}
+// GetItem fetches the value and its expiry (via PTTL) in a single round trip
+func (r *RedisCache) GetItem(ctx context.Context, key string) (Item, error) {
+	item, _, err := r.getItem(ctx, key)
+	return item, err
+}
 
-// 	ttl, err := r.client.TTL(ctx, key).Result()
-// 	if err != nil {
-// 		return nil, 0, time.Time{}, err
-// 	}
-// 	fmt.Printf("%T\n", ttl)
-// 	fmt.Println("------------------------",ttl)
-// 	expiryTime := CalculateExpiryTime(ttl)
+// getItem returns the item along with the remaining TTL reported by Redis
+func (r *RedisCache) getItem(ctx context.Context, key string) (Item, time.Duration, error) {
+	var getCmd *redis.StringCmd
+	var ttlCmd *redis.DurationCmd
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		getCmd = pipe.Get(ctx, r.key(key))
+		ttlCmd = pipe.PTTL(ctx, r.key(key))
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		logrus.Errorf("Error retrieving key %s with TTL: %v", key, err)
+		return Item{}, 0, contextError(ctx, err)
+	}
+	val, err := getCmd.Result()
+	if err == redis.Nil {
+		logrus.Warnf("Key %s does not exist", key)
+		return Item{}, 0, utils.NotFound
+	}
+	if err != nil {
+		return Item{}, 0, contextError(ctx, err)
+	}
+	data, softExpiry, err := decodeValue([]byte(val))
+	if err != nil {
+		logrus.Errorf("Error unmarshalling value for key %s: %v", key, err)
+		return Item{}, 0, err
+	}
+
+	item := Item{Value: data, SoftExpiry: softExpiry, Version: redisVersion([]byte(val))}
+	switch ttl := ttlCmd.Val(); {
+	case ttl == -2: // expired between GET and PTTL
+		return Item{}, 0, utils.NotFound
+	case ttl >= 0:
+		item.ExpiryTime = time.Now().Add(ttl)
+		return item, ttl, nil
+	}
+	return item, NoExpiry, nil
+}
+
+// GetMany fetches all keys with a single MGET
+func (r *RedisCache) GetMany(ctx context.Context, keys []string) (map[string]interface{}, error) {
+	vals, err := r.client.MGet(ctx, r.keys(keys)...).Result()
+	if err != nil {
+		logrus.Errorf("Error retrieving %d keys: %v", len(keys), err)
+		return nil, contextError(ctx, err)
+	}
+	values := make(map[string]interface{}, len(keys))
+	for i, val := range vals {
+		raw, ok := val.(string)
+		if !ok { // nil for missing keys
+			continue
+		}
+		data, _, err := decodeValue([]byte(raw))
+		if err != nil {
+			logrus.Errorf("Error unmarshalling value for key %s: %v", keys[i], err)
+			return nil, err
+		}
+		values[keys[i]] = data
+	}
+	return values, nil
+}
 
-// 	var data interface{}
-// 	err = json.Unmarshal([]byte(value), &data)
-// 	if err != nil {
-// 		return nil, 0, time.Time{}, fmt.Errorf("failed to unmarshal value: %v", err)
-// 	}
+// SetMany writes all items in one pipeline so that each keeps its own TTL
+func (r *RedisCache) SetMany(ctx context.Context, items []CacheData) error {
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, item := range items {
+			expiration := r.expiration(item.TTL)
+			val, err := encodeValue(item.Value, r.softExpiry(item.SoftTTL, expiration))
+			if err != nil {
+				logrus.Errorf("Error marshalling value for key %s: %v", item.Key, err)
+				return err
+			}
+			pipe.Set(ctx, r.key(item.Key), val, expiration)
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("Error setting %d keys: %v", len(items), err)
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+// expiration converts a TTL in seconds to the duration passed to Redis, applying the default TTL
+func (r *RedisCache) expiration(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return r.ttl
+	}
+	return ttl * time.Second
+}
 
-// 	return data, ttl, expiryTime, nil
-// }
+// softExpiry returns when a value stored for the expiration turns stale
+func (r *RedisCache) softExpiry(softTTL time.Duration, expiration time.Duration) time.Time {
+	if expiration <= 0 { // never expires
+		expiration = time.Duration(math.MaxInt64)
+	}
+	return CalculateSoftExpiry(softTTL, expiration/time.Second)
+}
 
-func (r *RedisCache) Set(key string, value interface{}, ttl time.Duration) error {
+func (r *RedisCache) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	return r.SetWithSoftTTL(ctx, key, value, 0, ttl)
+}
 
-	ttlDuration := time.Duration(ttl) * time.Second
-	val, err := json.Marshal(value)
+// SetWithSoftTTL stores the value in an envelope carrying its soft expiry
+func (r *RedisCache) SetWithSoftTTL(ctx context.Context, key string, value interface{}, softTTL time.Duration, ttl time.Duration) error {
+	//Use the default TTL if the provided ttl is not provided
+	actualTTL := r.expiration(ttl)
+	val, err := encodeValue(value, r.softExpiry(softTTL, actualTTL))
 	if err != nil {
 		logrus.Errorf("Error marshalling value for key %s: %v", key, err)
 		return err
 	}
-	//Use the default TTL if the provided ttl is not provided
-	actualTTL := ttlDuration
-	if ttl <= 0 {
-		actualTTL = r.ttl
-	}
 	// fmt.Printf("%T\n", actualTTL)
 	// fmt.Println("----------------", actualTTL)
 
 	logrus.Infof("Setting KEY: %s with VALUE: %s and TTL: %v seconds", key, string(val), actualTTL)
-	err = r.client.Set(context.Background(), key, val, actualTTL).Err()
+	err = r.client.Set(ctx, r.key(key), val, actualTTL).Err()
 	if err != nil {
 		logrus.Errorf("Error setting key %s: %v", key, err)
+		return contextError(ctx, err)
 	}
-	return err
+	return nil
 }
 
-func (r *RedisCache) Delete(key string) error {
-	result, err := r.client.Del(context.Background(), key).Result()
+// SetIf stores the value when the condition holds for the current value of the key. The add and
+// replace modes are SET NX and SET XX, other conditions watch the key so that a concurrent write
+// cannot slip in between.
+func (r *RedisCache) SetIf(ctx context.Context, key string, value interface{}, softTTL time.Duration, ttl time.Duration, condition Condition) (uint64, error) {
+	actualTTL := r.expiration(ttl)
+	val, err := encodeValue(value, r.softExpiry(softTTL, actualTTL))
+	if err != nil {
+		logrus.Errorf("Error marshalling value for key %s: %v", key, err)
+		return 0, err
+	}
+	if condition.IsZero() {
+		if err := r.client.Set(ctx, r.key(key), val, actualTTL).Err(); err != nil {
+			logrus.Errorf("Error setting key %s: %v", key, err)
+			return 0, contextError(ctx, err)
+		}
+		return redisVersion(val), nil
+	}
+	if mode := condition.mode(); mode != "" {
+		set := r.client.SetNX
+		if mode == ModeReplace {
+			set = r.client.SetXX
+		}
+		stored, err := set(ctx, r.key(key), val, actualTTL).Result()
+		if err != nil {
+			logrus.Errorf("Error setting key %s in %s mode: %v", key, mode, err)
+			return 0, contextError(ctx, err)
+		}
+		if !stored {
+			return 0, utils.PreconditionFailed
+		}
+		return redisVersion(val), nil
+	}
+	_, err = r.transact(ctx, key, condition, func(pipe redis.Pipeliner) {
+		pipe.Set(ctx, r.key(key), val, actualTTL)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return redisVersion(val), nil
+}
+
+// DeleteIf deletes the key when the condition holds for its current value
+func (r *RedisCache) DeleteIf(ctx context.Context, key string, condition Condition) error {
+	if condition.IsZero() {
+		return r.Delete(ctx, key)
+	}
+	exists, err := r.transact(ctx, key, condition, func(pipe redis.Pipeliner) {
+		pipe.Del(ctx, r.key(key))
+	})
 	if err != nil {
-		logrus.Errorf("Delete: error deleting key %s: %v", key, err)
 		return err
 	}
+	if !exists {
+		return utils.NotFound
+	}
+	return nil
+}
+
+// transact runs write in a MULTI/EXEC transaction when the condition holds for the current
+// value of the key, which is WATCHed meanwhile. It reports whether the key existed. A write of
+// the key by another client aborts the transaction, which is retried a few times before
+// failing the condition.
+func (r *RedisCache) transact(ctx context.Context, key string, condition Condition, write func(pipe redis.Pipeliner)) (bool, error) {
+	name := r.key(key)
+	for attempt := 0; attempt < redisTransactionRetries; attempt++ {
+		exists := false
+		err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+			raw, err := tx.Get(ctx, name).Bytes()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			exists = err == nil
+			var version uint64
+			if exists {
+				version = redisVersion(raw)
+			}
+			if !condition.Holds(version, exists) {
+				return utils.PreconditionFailed
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				write(pipe)
+				return nil
+			})
+			return err
+		}, name)
+		switch err {
+		case nil, utils.PreconditionFailed:
+			return exists, err
+		case redis.TxFailedErr:
+			logrus.Debugf("Key %s changed during a conditional write, retrying", key)
+		default:
+			logrus.Errorf("Error in conditional write of key %s: %v", key, err)
+			return false, contextError(ctx, err)
+		}
+	}
+	return false, utils.PreconditionFailed
+}
+
+// incrScript creates a missing counter with its initial value and expiration (in milliseconds,
+// 0 for none) before applying INCRBY, so that both happen atomically
+var incrScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	if ARGV[3] == "0" then
+		redis.call("SET", KEYS[1], ARGV[2])
+	else
+		redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+	end
+end
+return redis.call("INCRBY", KEYS[1], ARGV[1])
+`)
+
+// Incr adds delta to the counter with INCRBY, creating it first when it is missing
+func (r *RedisCache) Incr(ctx context.Context, key string, delta int64, initial int64, ttl time.Duration) (int64, error) {
+	expiration := r.expiration(ttl)
+	value, err := incrScript.Run(ctx, r.client, []string{r.key(key)}, delta, initial, expiration.Milliseconds()).Int64()
+	if err != nil {
+		if strings.Contains(err.Error(), "not an integer") || strings.Contains(err.Error(), "overflow") {
+			return 0, utils.NotInteger
+		}
+		logrus.Errorf("Error incrementing key %s: %v", key, err)
+		return 0, contextError(ctx, err)
+	}
+	return value, nil
+}
+
+// redisVersion derives the version of a stored value from its bytes. Rewriting the very same
+// bytes keeps the version, which is harmless as the entry is then indistinguishable.
+func redisVersion(raw []byte) uint64 {
+	hash := fnv.New64a()
+	hash.Write(raw)
+	if version := hash.Sum64(); version != 0 {
+		return version
+	}
+	return 1
+}
+
+func (r *RedisCache) Delete(ctx context.Context, key string) error {
+	result, err := r.client.Del(ctx, r.key(key)).Result()
+	if err != nil {
+		logrus.Errorf("Delete: error deleting key %s: %v", key, err)
+		return contextError(ctx, err)
+	}
 	if result == 0 {
 		logrus.Warnf("Key %s not found for deletion", key)
 		return utils.NotFound
@@ -118,14 +416,68 @@ func (r *RedisCache) Delete(key string) error {
 	return nil
 }
 
-func (r *RedisCache) Clear() error {
+// DeleteMany removes all keys with a single DEL
+func (r *RedisCache) DeleteMany(ctx context.Context, keys []string) (int, error) {
+	deleted, err := r.client.Del(ctx, r.keys(keys)...).Result()
+	if err != nil {
+		logrus.Errorf("DeleteMany: error deleting %d keys: %v", len(keys), err)
+		return 0, contextError(ctx, err)
+	}
+	return int(deleted), nil
+}
 
-	logrus.Info("Clearing all cache entries")
-	err := r.client.FlushDB(context.Background()).Err()
+// Clear unlinks the keys in batches, only those of the tenant when it shares the database with
+// other tenants. It scans instead of using KEYS or FLUSHDB so that Redis is never blocked and
+// the locks are kept, see keptOnClear.
+func (r *RedisCache) Clear(ctx context.Context) error {
+	logrus.Infof("Clearing cache entries with prefix %q", r.prefix)
+	iter := r.client.Scan(ctx, 0, escapeRedisPattern(r.prefix)+"*", redisClearBatch).Iterator()
+	batch := make([]string, 0, redisClearBatch)
+	removed := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := r.client.Unlink(ctx, batch...).Err(); err != nil {
+			return err
+		}
+		removed += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	for iter.Next(ctx) {
+		if keptOnClear(strings.TrimPrefix(iter.Val(), r.prefix)) {
+			continue
+		}
+		batch = append(batch, iter.Val())
+		if len(batch) == redisClearBatch {
+			if err := flush(); err != nil {
+				logrus.Errorf("Error clearing cache entries with prefix %q: %v", r.prefix, err)
+				return contextError(ctx, err)
+			}
+		}
+	}
+	err := iter.Err()
+	if err == nil {
+		err = flush()
+	}
 	if err != nil {
-		logrus.Errorf("Error clearing cache: %v", err)
-		return err
+		logrus.Errorf("Error clearing cache entries with prefix %q: %v", r.prefix, err)
+		return contextError(ctx, err)
 	}
-	logrus.Info("Cache cleared successfully")
+	logrus.Infof("Cleared %d cache entries with prefix %q", removed, r.prefix)
 	return nil
 }
+
+// escapeRedisPattern escapes the glob characters of a SCAN pattern
+func escapeRedisPattern(pattern string) string {
+	var escaped strings.Builder
+	for _, char := range pattern {
+		switch char {
+		case '*', '?', '[', ']', '\\':
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(char)
+	}
+	return escaped.String()
+}
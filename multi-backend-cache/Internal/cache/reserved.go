@@ -0,0 +1,23 @@
+package cache
+
+import "strings"
+
+// The cache keeps its own keys next to those of the users, under these prefixes. They are not
+// listed by Scan, and users cannot read or write them.
+var reservedKeyPrefixes = []string{lockKeyPrefix, fenceKeyPrefix, tagKeyPrefix}
+
+// IsReservedKey reports whether the key belongs to the cache itself
+func IsReservedKey(key string) bool {
+	for _, prefix := range reservedKeyPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// keptOnClear reports whether a key survives Clear: leases and fencing counters do, so that a
+// clear does not release the locks or let their fencing tokens go back.
+func keptOnClear(key string) bool {
+	return strings.HasPrefix(key, lockKeyPrefix) || strings.HasPrefix(key, fenceKeyPrefix)
+}
@@ -0,0 +1,281 @@
+package cache
+
+import (
+	"container/heap"
+	"context"
+	"encoding/base64"
+	utils "multi-backend-cache/packageUtils/Utils"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Scanner is implemented by the backends that can list their keys. Memcache cannot.
+type Scanner interface {
+	// Scan returns up to about count keys matching the glob pattern, empty for all, from the
+	// position of the cursor, empty to start. The next cursor is empty once the scan is
+	// complete. Keys that exist for the whole scan are returned at least once; keys written or
+	// deleted meanwhile may or may not be. A cursor that was not returned by a previous scan
+	// fails with utils.InvalidCursor.
+	Scan(ctx context.Context, cursor string, match string, count int) ([]string, string, error)
+}
+
+// Scan walks the shards one after the other, each in key order, so that the cursor is the
+// shard and the last key returned from it. Every page walks the shard it starts in, keeping only
+// the keys it returns in a bounded heap rather than sorting the shard. Reserved keys are left out.
+func (c *LRUCache) Scan(ctx context.Context, cursor string, match string, count int) ([]string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	shardIndex, after, err := decodeScanCursor(cursor, len(c.shards))
+	if err != nil {
+		return nil, "", err
+	}
+	keys := make([]string, 0, count)
+	for ; shardIndex < len(c.shards); shardIndex, after = shardIndex+1, "" {
+		// One key more than the page needs tells whether the shard has more
+		found := c.shards[shardIndex].scan(after, match, count-len(keys)+1)
+		if remaining := count - len(keys); len(found) > remaining {
+			if remaining == 0 {
+				return keys, encodeScanCursor(shardIndex, ""), nil
+			}
+			keys = append(keys, found[:remaining]...)
+			return keys, encodeScanCursor(shardIndex, keys[len(keys)-1]), nil
+		}
+		keys = append(keys, found...)
+	}
+	return keys, "", nil
+}
+
+// scan returns, in key order, the first limit live keys of the shard that follow after and match
+// the pattern
+func (s *cacheShard) scan(after string, match string, limit int) []string {
+	s.lock.RLock()
+	keys := make(keyHeap, 0, min(limit, len(s.index)))
+	for key, node := range s.index {
+		if key <= after || (len(keys) == limit && key >= keys[0]) {
+			continue
+		}
+		if IsExpired(node.expiryTime) || IsReservedKey(key) || !matchGlob(match, key) {
+			continue
+		}
+		if len(keys) < limit {
+			heap.Push(&keys, key)
+		} else { // replaces the greatest key kept
+			keys[0] = key
+			heap.Fix(&keys, 0)
+		}
+	}
+	s.lock.RUnlock()
+	slices.Sort(keys)
+	return keys
+}
+
+// keyHeap is a heap of keys with the greatest at its root
+type keyHeap []string
+
+func (h keyHeap) Len() int              { return len(h) }
+func (h keyHeap) Less(i, j int) bool    { return h[i] > h[j] }
+func (h keyHeap) Swap(i, j int)         { h[i], h[j] = h[j], h[i] }
+func (h *keyHeap) Push(key interface{}) { *h = append(*h, key.(string)) }
+
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	key := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return key
+}
+
+// A cursor of the in-memory caches is "<shard>:<last key>", base64 encoded
+func encodeScanCursor(shardIndex int, after string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(shardIndex) + ":" + after))
+}
+
+func decodeScanCursor(cursor string, shardCount int) (int, string, error) {
+	if cursor == "" {
+		return 0, "", nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", utils.InvalidCursor
+	}
+	index, after, found := strings.Cut(string(raw), ":")
+	shardIndex, err := strconv.Atoi(index)
+	if !found || err != nil || shardIndex < 0 || shardIndex >= shardCount {
+		return 0, "", utils.InvalidCursor
+	}
+	return shardIndex, after, nil
+}
+
+// matchGlob reports whether the key matches a glob pattern with the syntax of Redis: * and ?
+// for any characters, [abc], [a-z] and [^a] for classes, and \ to escape. An empty pattern
+// matches every key.
+func matchGlob(pattern string, key string) bool {
+	if pattern == "" {
+		return true
+	}
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if matchGlob(pattern, key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if key == "" {
+				return false
+			}
+		case '[':
+			if key == "" {
+				return false
+			}
+			matched, rest, ok := matchClass(pattern[1:], key[0])
+			if !ok { // unterminated class, matched literally
+				if key[0] != '[' {
+					return false
+				}
+				rest = pattern[1:]
+			} else if !matched {
+				return false
+			}
+			pattern, key = rest, key[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if key == "" || pattern[0] != key[0] {
+				return false
+			}
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+	return key == ""
+}
+
+// matchClass matches a character against the class that starts the pattern, after its [. It
+// returns the pattern after the class, and false when the class is not terminated.
+func matchClass(pattern string, char byte) (bool, string, bool) {
+	negated := strings.HasPrefix(pattern, "^")
+	if negated {
+		pattern = pattern[1:]
+	}
+	matched := false
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case pattern[i] == ']' && i > 0:
+			return matched != negated, pattern[i+1:], true
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			i++
+			matched = matched || pattern[i] == char
+		case i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']':
+			low, high := min(pattern[i], pattern[i+2]), max(pattern[i], pattern[i+2])
+			matched = matched || (low <= char && char <= high)
+			i += 2
+		default:
+			matched = matched || pattern[i] == char
+		}
+	}
+	return false, "", false
+}
+
+// Scan pages through the keys with SCAN. Redis may return a key more than once and treats count
+// as a hint. The keys of a tenant sharing the database are matched and returned without their
+// prefix, and the reserved keys are left out.
+func (r *RedisCache) Scan(ctx context.Context, cursor string, match string, count int) ([]string, string, error) {
+	position := uint64(0)
+	if cursor != "" {
+		var err error
+		if position, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			return nil, "", utils.InvalidCursor
+		}
+	}
+	if match == "" {
+		match = "*"
+	}
+	keys, next, err := r.client.Scan(ctx, position, escapeRedisPattern(r.prefix)+match, int64(count)).Result()
+	if err != nil {
+		logrus.Errorf("Error scanning keys matching %s: %v", match, err)
+		return nil, "", contextError(ctx, err)
+	}
+	listed := keys[:0]
+	for _, key := range keys {
+		if key = strings.TrimPrefix(key, r.prefix); !IsReservedKey(key) {
+			listed = append(listed, key)
+		}
+	}
+	keys = listed
+	if next == 0 {
+		return keys, "", nil
+	}
+	return keys, strconv.FormatUint(next, 10), nil
+}
+
+// Scan lists the keys of L2, which holds every key of the tiered system
+func (t *TieredCache) Scan(ctx context.Context, cursor string, match string, count int) ([]string, string, error) {
+	scanner, ok := t.l2.(Scanner)
+	if !ok {
+		return nil, "", utils.NotSupported
+	}
+	return scanner.Scan(ctx, cursor, match, count)
+}
+
+// MatchDeleter deletes the keys matching a glob pattern one page at a time
+type MatchDeleter interface {
+	// DeleteMatching deletes up to about count keys matching the pattern from the position of
+	// the cursor, like Scan, and returns how many existed along with the next cursor.
+	DeleteMatching(ctx context.Context, cursor string, match string, count int) (int, string, error)
+}
+
+// MatchDeleterFor returns the match deleter of a backend: its own when it has one, otherwise
+// one deleting the pages of its scan. It returns nil when the backend cannot list its keys.
+func MatchDeleterFor(cacheSystem CacheSystem) MatchDeleter {
+	if deleter, ok := cacheSystem.(MatchDeleter); ok {
+		return deleter
+	}
+	if scanner, ok := cacheSystem.(Scanner); ok {
+		return &scanDeleter{cache: cacheSystem, scanner: scanner}
+	}
+	return nil
+}
+
+type scanDeleter struct {
+	cache   CacheSystem
+	scanner Scanner
+}
+
+func (d *scanDeleter) DeleteMatching(ctx context.Context, cursor string, match string, count int) (int, string, error) {
+	keys, next, err := d.scanner.Scan(ctx, cursor, match, count)
+	if err != nil || len(keys) == 0 {
+		return 0, next, err
+	}
+	deleted, err := d.cache.DeleteMany(ctx, keys)
+	return deleted, next, err
+}
+
+// DeleteMatching unlinks each page of SCAN, so that Redis frees the values in the background
+// and is never blocked for long
+func (r *RedisCache) DeleteMatching(ctx context.Context, cursor string, match string, count int) (int, string, error) {
+	keys, next, err := r.Scan(ctx, cursor, match, count)
+	if err != nil || len(keys) == 0 {
+		return 0, next, err
+	}
+	deleted, err := r.client.Unlink(ctx, r.keys(keys)...).Result()
+	if err != nil {
+		logrus.Errorf("Error unlinking %d keys matching %s: %v", len(keys), match, err)
+		return 0, "", contextError(ctx, err)
+	}
+	return int(deleted), next, nil
+}
@@ -0,0 +1,220 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"multi-backend-cache/Internal/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultSnapshotInterval = time.Minute
+
+// snapshotRecord is one entry of a snapshot file. Snapshots are JSON lines, with the entries
+// ordered from the least to the most worth keeping, so that restoring them in file order
+// rebuilds the recency of the cache.
+type snapshotRecord struct {
+	Key        string          `json:"key"`
+	Value      json.RawMessage `json:"value"`
+	TTL        time.Duration   `json:"ttl"`
+	ExpiryTime time.Time       `json:"expirytime"`
+	SoftExpiry *time.Time      `json:"softexpiry,omitempty"` // nil when the entry never turns stale
+	Tags       []string        `json:"tags,omitempty"`
+}
+
+// newSnapshotRecord records an entry, leaving the soft expiry out when there is none
+func newSnapshotRecord(key string, value []byte, ttl time.Duration, expiryTime time.Time, softExpiry time.Time, tags []string) snapshotRecord {
+	record := snapshotRecord{Key: key, Value: value, TTL: ttl, ExpiryTime: expiryTime, Tags: tags}
+	if !softExpiry.IsZero() {
+		record.SoftExpiry = &softExpiry
+	}
+	return record
+}
+
+// softExpiry returns the soft expiry of the entry, zero when it never turns stale
+func (r snapshotRecord) softExpiry() time.Time {
+	if r.SoftExpiry == nil {
+		return time.Time{}
+	}
+	return *r.SoftExpiry
+}
+
+// Snapshot writes the live entries of the cache to w. Shards are read one at a time, and their
+// entries are interleaved by their relative position in the eviction order of their shard.
+func (c *LRUCache) Snapshot(w io.Writer) (int, error) {
+	type rankedRecord struct {
+		rank   float64
+		record snapshotRecord
+	}
+	var records []rankedRecord
+	for _, shard := range c.shards {
+		shard.lock.Lock()
+		shard.drainReads()
+		var nodes []*entry
+		shard.policy.Walk(func(node *entry) bool {
+			if !IsExpired(node.expiryTime) {
+				nodes = append(nodes, node)
+			}
+			return true
+		})
+		shard.lock.Unlock()
+		// Walk goes from the most to the least worth keeping, the snapshot the other way round
+		for i := len(nodes) - 1; i >= 0; i-- {
+			node := nodes[i]
+			records = append(records, rankedRecord{
+				rank:   float64(len(nodes)-i) / float64(len(nodes)),
+				record: newSnapshotRecord(node.key, node.value, node.ttl, node.expiryTime, node.softExpiry, node.tags),
+			})
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].rank < records[j].rank })
+
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	for _, ranked := range records {
+		if err := encoder.Encode(ranked.record); err != nil {
+			return 0, err
+		}
+	}
+	return len(records), buffered.Flush()
+}
+
+// Restore loads a snapshot written by Snapshot, skipping the entries that expired since.
+// It returns the number of restored entries.
+func (c *LRUCache) Restore(r io.Reader) (int, error) {
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	restored := 0
+	for {
+		var record snapshotRecord
+		if err := decoder.Decode(&record); err == io.EOF {
+			return restored, nil
+		} else if err != nil {
+			return restored, err
+		}
+		if IsExpired(record.ExpiryTime) {
+			continue
+		}
+		shard := c.shard(record.Key)
+		shard.lock.Lock()
+		err := shard.setWithExpiry(record.Key, record.Value, record.TTL, record.ExpiryTime, record.softExpiry(), 0, record.Tags)
+		shard.lock.Unlock()
+		if err != nil {
+			logrus.Warnf("Skipping snapshot entry %s: %v", record.Key, err)
+			continue
+		}
+		restored++
+	}
+}
+
+// SaveSnapshots writes a snapshot of every tenant cache to the snapshot directory and returns
+// the time it was taken
+func (ftc *FixedTenantsCaches) SaveSnapshots() (time.Time, error) {
+	if ftc.snapshotDir == "" {
+		return time.Time{}, fmt.Errorf("Snapshots are not configured")
+	}
+	ftc.snapshotLock.Lock()
+	defer ftc.snapshotLock.Unlock()
+	if err := os.MkdirAll(ftc.snapshotDir, 0o755); err != nil {
+		return time.Time{}, err
+	}
+	takenAt := time.Now()
+	tenantCaches := ftc.tenantCaches()
+	for tenantID, cache := range tenantCaches {
+		if err := writeSnapshot(snapshotPath(ftc.snapshotDir, tenantID), cache); err != nil {
+			return time.Time{}, fmt.Errorf("snapshot of tenant %s: %w", tenantID, err)
+		}
+	}
+	ftc.lastSnapshot = takenAt
+	logrus.Infof("Snapshot of %d tenant caches written to %s", len(tenantCaches), ftc.snapshotDir)
+	return takenAt, nil
+}
+
+// SnapshotsEnabled reports whether a snapshot directory is configured
+func (ftc *FixedTenantsCaches) SnapshotsEnabled() bool {
+	return ftc.snapshotDir != ""
+}
+
+// LastSnapshot returns the time of the last successful snapshot, zero if none was taken yet
+func (ftc *FixedTenantsCaches) LastSnapshot() time.Time {
+	ftc.snapshotLock.Lock()
+	defer ftc.snapshotLock.Unlock()
+	return ftc.lastSnapshot
+}
+
+// restoreSnapshots loads the snapshot of every tenant that has one
+func (ftc *FixedTenantsCaches) restoreSnapshots() {
+	for tenantID, cache := range ftc.tenantCaches() {
+		ftc.restoreSnapshot(tenantID, cache)
+	}
+}
+
+// restoreSnapshot loads the snapshot of a tenant if it has one. Tenants with an append-only
+// log were already restored from it, a snapshot could only bring back stale entries.
+func (ftc *FixedTenantsCaches) restoreSnapshot(tenantID string, cache *LRUCache) {
+	if cache.aof != nil {
+		return
+	}
+	file, err := os.Open(snapshotPath(ftc.snapshotDir, tenantID))
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		logrus.Errorf("Error opening the snapshot of tenant %s: %v", tenantID, err)
+		return
+	}
+	restored, err := cache.Restore(file)
+	file.Close()
+	if err != nil {
+		logrus.Errorf("Error restoring the snapshot of tenant %s: %v", tenantID, err)
+	}
+	logrus.Infof("Restored %d entries for tenant %s", restored, tenantID)
+}
+
+// Go-routine that takes a snapshot of the tenant caches at every snapshot interval
+func takeSnapshots(ftc *FixedTenantsCaches) {
+	defer ftc.janitors.Done()
+	ticker := time.NewTicker(intervalOrDefault(config.AppConfig.SnapshotInterval, defaultSnapshotInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ftc.stop:
+			return
+		case <-ticker.C:
+		}
+		if _, err := ftc.SaveSnapshots(); err != nil {
+			logrus.Errorf("Error taking snapshot: %v", err)
+		}
+	}
+}
+
+// writeSnapshot replaces the snapshot at path, through a temporary file so that a crash never
+// leaves a partial snapshot behind
+func writeSnapshot(path string, cache *LRUCache) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := cache.Snapshot(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func snapshotPath(dir string, tenantID string) string {
+	return filepath.Join(dir, tenantID+".snapshot")
+}
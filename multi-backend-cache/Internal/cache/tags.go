@@ -0,0 +1,335 @@
+package cache
+
+import (
+	"context"
+	utils "multi-backend-cache/packageUtils/Utils"
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// Tagger is implemented by the backends that can invalidate entries by tag
+type Tagger interface {
+	// SetTagged is SetIf that also attaches the tags to the entry.
+	SetTagged(ctx context.Context, key string, value interface{}, softTTL time.Duration, ttl time.Duration, condition Condition, tags []string) (uint64, error)
+	// InvalidateTag deletes every entry carrying the tag and reports how many there were, -1
+	// when the backend cannot tell.
+	InvalidateTag(ctx context.Context, tag string) (int, error)
+}
+
+// The index of a tag lives next to the cache keys under this prefix: a Redis set of the keys
+// carrying the tag, or the memcache generation of the tag.
+const tagKeyPrefix = "__tag__:"
+
+func tagKey(tag string) string {
+	return tagKeyPrefix + tag
+}
+
+// tag attaches the tags to the entry, in addition to those it carries. Caller must hold the lock.
+func (s *cacheShard) tag(node *entry, tags []string) {
+	for _, tag := range tags {
+		if _, found := s.tags[tag][node.key]; found {
+			continue
+		}
+		if s.tags == nil {
+			s.tags = make(map[string]map[string]struct{})
+		}
+		if s.tags[tag] == nil {
+			s.tags[tag] = make(map[string]struct{})
+		}
+		s.tags[tag][node.key] = struct{}{}
+		node.tags = append(node.tags, tag)
+	}
+}
+
+// untag drops a removed entry from the tag index. Caller must hold the lock.
+func (s *cacheShard) untag(node *entry) {
+	for _, tag := range node.tags {
+		delete(s.tags[tag], node.key)
+		if len(s.tags[tag]) == 0 {
+			delete(s.tags, tag)
+		}
+	}
+}
+
+// InvalidateTag deletes the entries of the tag shard by shard, counting those that had not
+// expired yet. Every deletion goes to the append-only log, like Delete.
+func (c *LRUCache) InvalidateTag(ctx context.Context, tag string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	deleted, err := c.invalidateTag(tag)
+	if err != nil {
+		return deleted, err
+	}
+	c.broadcast(Invalidation{Tag: tag})
+	return deleted, nil
+}
+
+// invalidateTag is InvalidateTag without telling the other replicas
+func (c *LRUCache) invalidateTag(tag string) (int, error) {
+	deleted := 0
+	for _, shard := range c.shards {
+		shard.lock.Lock()
+		keys := make([]string, 0, len(shard.tags[tag]))
+		for key := range shard.tags[tag] {
+			keys = append(keys, key)
+		}
+		for _, key := range keys {
+			live := !IsExpired(shard.index[key].expiryTime)
+			if _, err := c.delete(shard, key); err != nil {
+				shard.lock.Unlock()
+				return deleted, err
+			}
+			if live {
+				deleted++
+			}
+		}
+		shard.lock.Unlock()
+	}
+	logrus.Infof("Invalidated %d entries tagged %s", deleted, tag)
+	return deleted, nil
+}
+
+// tagScript adds the key to the set of every tag, extending the life of a set to at least the
+// TTL of the key. A TTL of 0 makes the sets persistent.
+var tagScript = redis.NewScript(`
+for i = 1, #KEYS do
+	local ttl = redis.call("PTTL", KEYS[i])
+	redis.call("SADD", KEYS[i], ARGV[1])
+	if tonumber(ARGV[2]) == 0 then
+		redis.call("PERSIST", KEYS[i])
+	elseif ttl == -2 or (ttl >= 0 and ttl < tonumber(ARGV[2])) then
+		redis.call("PEXPIRE", KEYS[i], ARGV[2])
+	end
+end
+return 0
+`)
+
+// setTaggedScript writes KEYS[1] with SET, in the mode of ARGV[3] (NX, XX or empty), and only
+// once it is written adds it to the sets of the tags in the other keys, like tagScript. It
+// returns 0 when the mode prevented the write.
+var setTaggedScript = redis.NewScript(`
+local set = {"SET", KEYS[1], ARGV[1]}
+local ttl = tonumber(ARGV[2])
+if ttl > 0 then
+	table.insert(set, "PX")
+	table.insert(set, ARGV[2])
+end
+if ARGV[3] ~= "" then
+	table.insert(set, ARGV[3])
+end
+if not redis.call(unpack(set)) then
+	return 0
+end
+for i = 2, #KEYS do
+	local setTTL = redis.call("PTTL", KEYS[i])
+	redis.call("SADD", KEYS[i], KEYS[1])
+	if ttl == 0 then
+		redis.call("PERSIST", KEYS[i])
+	elseif setTTL == -2 or (setTTL >= 0 and setTTL < ttl) then
+		redis.call("PEXPIRE", KEYS[i], ARGV[2])
+	end
+end
+return 1
+`)
+
+// invalidateTagScript unlinks the keys of the set in batches, then the set itself
+var invalidateTagScript = redis.NewScript(`
+local keys = redis.call("SMEMBERS", KEYS[1])
+local batch = tonumber(ARGV[1])
+local deleted = 0
+for i = 1, #keys, batch do
+	deleted = deleted + redis.call("UNLINK", unpack(keys, i, math.min(i + batch - 1, #keys)))
+end
+redis.call("DEL", KEYS[1])
+return deleted
+`)
+
+// SetTagged writes the key and adds it to the set of each tag atomically, in a script for the
+// unconditional writes and the add and replace modes, and in the transaction of the other
+// conditions. A write the condition rejects tags nothing. Sets are not told when their keys are
+// deleted, a key written again without the tag is still invalidated until the set expires.
+func (r *RedisCache) SetTagged(ctx context.Context, key string, value interface{}, softTTL time.Duration, ttl time.Duration, condition Condition, tags []string) (uint64, error) {
+	if len(tags) == 0 {
+		return r.SetIf(ctx, key, value, softTTL, ttl, condition)
+	}
+	actualTTL := r.expiration(ttl)
+	val, err := encodeValue(value, r.softExpiry(softTTL, actualTTL))
+	if err != nil {
+		logrus.Errorf("Error marshalling value for key %s: %v", key, err)
+		return 0, err
+	}
+	tagKeys := make([]string, len(tags))
+	for i, tag := range tags {
+		tagKeys[i] = r.key(tagKey(tag))
+	}
+
+	if mode := condition.mode(); condition.IsZero() || mode != "" {
+		option := ""
+		switch mode {
+		case ModeAdd:
+			option = "NX"
+		case ModeReplace:
+			option = "XX"
+		}
+		stored, err := setTaggedScript.Run(ctx, r.client, append([]string{r.key(key)}, tagKeys...), val, actualTTL.Milliseconds(), option).Int()
+		if err != nil {
+			logrus.Errorf("Error setting tagged key %s: %v", key, err)
+			return 0, contextError(ctx, err)
+		}
+		if stored == 0 {
+			return 0, utils.PreconditionFailed
+		}
+		return redisVersion(val), nil
+	}
+	_, err = r.transact(ctx, key, condition, func(pipe redis.Pipeliner) {
+		pipe.Set(ctx, r.key(key), val, actualTTL)
+		tagScript.Eval(ctx, pipe, tagKeys, r.key(key), actualTTL.Milliseconds())
+	})
+	if err != nil {
+		return 0, err
+	}
+	return redisVersion(val), nil
+}
+
+func (r *RedisCache) InvalidateTag(ctx context.Context, tag string) (int, error) {
+	deleted, err := invalidateTagScript.Run(ctx, r.client, []string{r.key(tagKey(tag))}, redisClearBatch).Int()
+	if err != nil {
+		logrus.Errorf("Error invalidating tag %s: %v", tag, err)
+		return 0, contextError(ctx, err)
+	}
+	logrus.Infof("Invalidated %d entries tagged %s", deleted, tag)
+	return deleted, nil
+}
+
+// Memcache cannot list the entries of a tag. Every tag has a generation counter instead, seeded
+// from the clock in nanoseconds, and an entry stores the generation of each of its tags when it
+// is written. InvalidateTag increments the counter, so that the entries written before read as
+// missing and are left to expire or be evicted. A counter that was evicted is recreated from
+// the clock, which also invalidates its entries.
+
+// tagGenerations returns the generation of every tag, starting a counter for the tags without one
+func (m *MemCache) tagGenerations(ctx context.Context, namespace string, tags []string) (map[string]string, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	generations := make(map[string]string, len(tags))
+	err := m.do(ctx, func() error {
+		for _, tag := range tags {
+			generation, err := m.generation(namespace+tagKey(tag), strconv.AppendInt(nil, time.Now().UnixNano(), 10))
+			if err != nil {
+				return err
+			}
+			generations[tag] = generation
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("Error getting the generations of tags %v: %v", tags, err)
+		return nil, err
+	}
+	return generations, nil
+}
+
+// currentGenerations returns the generation of the tags that have a counter
+func (m *MemCache) currentGenerations(ctx context.Context, namespace string, tags []string) (map[string]string, error) {
+	keys := make([]string, len(tags))
+	for i, tag := range tags {
+		keys[i] = namespace + tagKey(tag)
+	}
+	var items map[string]*memcache.Item
+	err := m.do(ctx, func() (err error) {
+		items, err = m.client.GetMulti(keys)
+		return err
+	})
+	if err != nil {
+		logrus.Errorf("Error getting the generations of tags %v: %v", tags, err)
+		return nil, err
+	}
+	generations := make(map[string]string, len(items))
+	for _, tag := range tags {
+		if item, found := items[namespace+tagKey(tag)]; found {
+			generations[tag] = string(item.Value)
+		}
+	}
+	return generations, nil
+}
+
+// sameGenerations reports whether none of the tags of an entry was invalidated since it was written
+func sameGenerations(written map[string]string, current map[string]string) bool {
+	for tag, generation := range written {
+		if current[tag] != generation {
+			return false
+		}
+	}
+	return true
+}
+
+// checkTags fails with utils.NotFound when a tag of the entry was invalidated since it was written
+func (m *MemCache) checkTags(ctx context.Context, namespace string, written map[string]string) error {
+	if len(written) == 0 {
+		return nil
+	}
+	tags := make([]string, 0, len(written))
+	for tag := range written {
+		tags = append(tags, tag)
+	}
+	current, err := m.currentGenerations(ctx, namespace, tags)
+	if err != nil {
+		return err
+	}
+	if !sameGenerations(written, current) {
+		return utils.NotFound
+	}
+	return nil
+}
+
+// InvalidateTag moves the tag to its next generation. The entries are not deleted, so they
+// cannot be counted.
+func (m *MemCache) InvalidateTag(ctx context.Context, tag string) (int, error) {
+	namespace, err := m.namespace(ctx)
+	if err != nil {
+		return 0, err
+	}
+	err = m.do(ctx, func() error {
+		_, err := m.client.Increment(namespace+tagKey(tag), 1)
+		return err
+	})
+	if err != nil && err != memcache.ErrCacheMiss { // without a counter no entry is current
+		logrus.Errorf("Error invalidating tag %s: %v", tag, err)
+		return 0, err
+	}
+	logrus.Infof("Invalidated the entries tagged %s", tag)
+	return -1, nil
+}
+
+// SetTagged writes L2 with the tags, then L1, which keeps them too. L1 entries promoted from L2
+// do not know their tags; l1TTL bounds how long they are served after an invalidation.
+func (t *TieredCache) SetTagged(ctx context.Context, key string, value interface{}, softTTL time.Duration, ttl time.Duration, condition Condition, tags []string) (uint64, error) {
+	tagger, ok := t.l2.(Tagger)
+	if !ok {
+		return 0, utils.NotSupported
+	}
+	version, err := tagger.SetTagged(ctx, key, value, softTTL, ttl, condition, tags)
+	return t.writeL1(key, value, softTTL, ttl, tags, version, err)
+}
+
+// InvalidateTag invalidates the tag in L2, then in L1, and reports the count of L2
+func (t *TieredCache) InvalidateTag(ctx context.Context, tag string) (int, error) {
+	tagger, ok := t.l2.(Tagger)
+	if !ok {
+		return 0, utils.NotSupported
+	}
+	deleted, err := tagger.InvalidateTag(ctx, tag)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := t.l1.InvalidateTag(ctx, tag); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
@@ -0,0 +1,319 @@
+package cache
+
+import (
+	"fmt"
+	"multi-backend-cache/Internal/metrices"
+	utils "multi-backend-cache/packageUtils/Utils"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"multi-backend-cache/Internal/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Smallest capacity a tenant can be given, explicitly or by rebalancing.
+const minTenantCapacity = 4096
+
+// Tenant IDs end up in file names, so they are kept to a safe alphabet.
+var validTenantID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// TenantInfo describes a tenant cache
+type TenantInfo struct {
+	TenantID    string  `json:"tenantID"`
+	Capacity    int     `json:"capacity"`
+	Used        int     `json:"used"`
+	Entries     int     `json:"entries"`
+	Fixed       bool    `json:"fixed"` // the capacity was set at runtime or by a quota rather than shared
+	Weight      float64 `json:"weight"`
+	MinCapacity int     `json:"minCapacity"`
+}
+
+// HasTenant reports whether the tenant exists
+func (ftc *FixedTenantsCaches) HasTenant(tenantID string) bool {
+	return ftc.GetCache(tenantID) != nil
+}
+
+// Tenants lists the tenants sorted by ID
+func (ftc *FixedTenantsCaches) Tenants() []TenantInfo {
+	ftc.lock.RLock()
+	defer ftc.lock.RUnlock()
+	tenants := make([]TenantInfo, 0, len(ftc.caches))
+	for tenantID, cache := range ftc.caches {
+		used, capacity, entries := cache.Stats()
+		_, fixed := ftc.fixedCapacities[tenantID]
+		tenants = append(tenants, TenantInfo{
+			TenantID:    tenantID,
+			Capacity:    capacity,
+			Used:        used,
+			Entries:     entries,
+			Fixed:       fixed || config.AppConfig.TenantConfigFor(tenantID).Quota > 0,
+			Weight:      tenantWeight(tenantID),
+			MinCapacity: tenantMinCapacity(tenantID),
+		})
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].TenantID < tenants[j].TenantID })
+	return tenants
+}
+
+// AddTenant creates the cache of a new tenant. A capacity of 0 makes the tenant follow its
+// configured quota or weight; either way the other tenants are rebalanced. The cache replays its
+// append-only log or snapshot before the lock is taken to install it, with its ID reserved
+// meanwhile.
+func (ftc *FixedTenantsCaches) AddTenant(tenantID string, capacity int) error {
+	if !ftc.isTenantBased {
+		return fmt.Errorf("Tenants are disabled, set IsTenantBased to use them")
+	}
+	if !validTenantID.MatchString(tenantID) {
+		return fmt.Errorf("Tenant ID must be 1 to 64 letters, digits, '-' or '_'")
+	}
+
+	ftc.lock.Lock()
+	if _, exists := ftc.caches[tenantID]; exists || ftc.pending[tenantID] {
+		ftc.lock.Unlock()
+		return utils.TenantExists
+	}
+	fixed := copyCapacities(ftc.fixedCapacities)
+	if capacity > 0 {
+		fixed[tenantID] = capacity
+	}
+	capacities, err := ftc.plan(append(ftc.tenantIDs(), tenantID), fixed)
+	if err != nil {
+		ftc.lock.Unlock()
+		return err
+	}
+	ftc.pending[tenantID] = true
+	ftc.lock.Unlock()
+
+	cache := newTenantCache(tenantID, capacities[tenantID], ftc.defaultTTL)
+	if ftc.snapshotDir != "" {
+		ftc.restoreSnapshot(tenantID, cache)
+	}
+
+	ftc.lock.Lock()
+	defer ftc.lock.Unlock()
+	delete(ftc.pending, tenantID)
+	// The other tenants may have changed meanwhile
+	fixed = copyCapacities(ftc.fixedCapacities)
+	if capacity > 0 {
+		fixed[tenantID] = capacity
+	}
+	if capacities, err = ftc.plan(append(ftc.tenantIDs(), tenantID), fixed); err != nil {
+		cache.Close()
+		return err
+	}
+	if ftc.invalidations != nil {
+		cache.invalidations.Store(&invalidationOutbox{tenantID: tenantID, queue: ftc.invalidations})
+	}
+	ftc.caches[tenantID] = cache
+	ftc.fixedCapacities = fixed
+	ftc.apply(capacities)
+	logrus.Infof("Added tenant %s with a capacity of %d bytes", tenantID, capacities[tenantID])
+	return nil
+}
+
+// ResizeTenant gives a tenant an explicit capacity, or makes it follow its configured quota or
+// weight again when capacity is 0, and rebalances the other tenants
+func (ftc *FixedTenantsCaches) ResizeTenant(tenantID string, capacity int) error {
+	ftc.lock.Lock()
+	defer ftc.lock.Unlock()
+	if _, exists := ftc.caches[tenantID]; !exists {
+		return utils.TenantNotFound
+	}
+	fixed := copyCapacities(ftc.fixedCapacities)
+	delete(fixed, tenantID)
+	if capacity > 0 {
+		fixed[tenantID] = capacity
+	}
+	capacities, err := ftc.plan(ftc.tenantIDs(), fixed)
+	if err != nil {
+		return err
+	}
+	ftc.fixedCapacities = fixed
+	ftc.apply(capacities)
+	logrus.Infof("Resized tenant %s to %d bytes", tenantID, capacities[tenantID])
+	return nil
+}
+
+// RemoveTenant deletes a tenant along with its cached data, snapshot and append-only log, and
+// gives its memory back to the other tenants. Its ID stays reserved until the files are gone, so
+// that a tenant added again cannot replay them.
+func (ftc *FixedTenantsCaches) RemoveTenant(tenantID string) error {
+	ftc.lock.Lock()
+	cache, exists := ftc.caches[tenantID]
+	if !exists {
+		ftc.lock.Unlock()
+		return utils.TenantNotFound
+	}
+	tieredL1 := ftc.tieredCaches[tenantID]
+	delete(ftc.caches, tenantID)
+	delete(ftc.tieredCaches, tenantID)
+	delete(ftc.fixedCapacities, tenantID)
+	if capacities, err := ftc.plan(ftc.tenantIDs(), ftc.fixedCapacities); err == nil {
+		ftc.apply(capacities)
+	}
+	ftc.pending[tenantID] = true
+	ftc.lock.Unlock()
+	defer func() {
+		ftc.lock.Lock()
+		delete(ftc.pending, tenantID)
+		ftc.lock.Unlock()
+	}()
+
+	cache.Close()
+	if tieredL1 != nil {
+		tieredL1.Close()
+	}
+	metrices.InMemoryUsedBytes.DeleteLabelValues(tenantID)
+	metrices.InMemoryCapacityBytes.DeleteLabelValues(tenantID)
+	metrices.InMemoryEntries.DeleteLabelValues(tenantID)
+	if cache.aof != nil {
+		removeFile(cache.aof.path)
+	}
+	if ftc.snapshotDir != "" {
+		// Wait for a snapshot in progress, so that it cannot write the file back
+		ftc.snapshotLock.Lock()
+		removeFile(snapshotPath(ftc.snapshotDir, tenantID))
+		ftc.snapshotLock.Unlock()
+	}
+	logrus.Infof("Removed tenant %s", tenantID)
+	return nil
+}
+
+// plan computes the capacity of every tenant. Tenants with a capacity set at runtime or a quota
+// in the configuration get it; the rest of the memory is split among the others by weight, where
+// a tenant whose share would be below its guaranteed minimum gets the minimum and the others
+// split what is left. Caller must hold the lock.
+func (ftc *FixedTenantsCaches) plan(tenantIDs []string, fixed map[string]int) (map[string]int, error) {
+	capacities := make(map[string]int, len(tenantIDs))
+	remaining := ftc.totalCacheMemory
+	var sharing []string
+	for _, tenantID := range tenantIDs {
+		capacity, ok := fixed[tenantID]
+		if !ok {
+			capacity = config.AppConfig.TenantConfigFor(tenantID).Quota
+		}
+		if capacity <= 0 {
+			sharing = append(sharing, tenantID)
+			continue
+		}
+		if minimum := tenantMinCapacity(tenantID); capacity < minimum {
+			return nil, fmt.Errorf("Capacity of tenant %s must be at least %d bytes", tenantID, minimum)
+		}
+		capacities[tenantID] = capacity
+		remaining -= capacity
+	}
+
+	for len(sharing) > 0 {
+		if remaining < 0 {
+			break
+		}
+		totalWeight := 0.0
+		for _, tenantID := range sharing {
+			totalWeight += tenantWeight(tenantID)
+		}
+		var unpinned []string
+		for _, tenantID := range sharing {
+			share := int(float64(remaining) * tenantWeight(tenantID) / totalWeight)
+			if minimum := tenantMinCapacity(tenantID); share < minimum {
+				capacities[tenantID] = minimum
+				remaining -= minimum
+			} else {
+				unpinned = append(unpinned, tenantID)
+			}
+		}
+		if len(unpinned) == len(sharing) {
+			for _, tenantID := range sharing {
+				capacities[tenantID] = int(float64(remaining) * tenantWeight(tenantID) / totalWeight)
+			}
+			break
+		}
+		sharing = unpinned
+	}
+	if remaining < 0 {
+		return nil, fmt.Errorf("Not enough cache memory for the tenant quotas and minimums: %d bytes in total", ftc.totalCacheMemory)
+	}
+	return capacities, nil
+}
+
+// tenantWeight returns the configured weight of a tenant, 1 by default
+func tenantWeight(tenantID string) float64 {
+	if weight := config.AppConfig.TenantConfigFor(tenantID).Weight; weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// tenantMinCapacity returns the guaranteed capacity of a tenant, never below minTenantCapacity
+func tenantMinCapacity(tenantID string) int {
+	if minimum := config.AppConfig.TenantConfigFor(tenantID).MinCapacity; minimum > minTenantCapacity {
+		return minimum
+	}
+	return minTenantCapacity
+}
+
+// apply sets the planned capacities, which the tiered L1 of the tenants follow. Caller must hold the lock.
+func (ftc *FixedTenantsCaches) apply(capacities map[string]int) {
+	for tenantID, capacity := range capacities {
+		ftc.caches[tenantID].SetCapacity(capacity)
+		if l1 := ftc.tieredCaches[tenantID]; l1 != nil {
+			l1.SetCapacity(capacity)
+		}
+	}
+}
+
+// rebalance recomputes the capacities after the total memory changed. The capacities set at
+// runtime are dropped if they no longer fit. Caller must hold the lock.
+func (ftc *FixedTenantsCaches) rebalance() {
+	capacities, err := ftc.plan(ftc.tenantIDs(), ftc.fixedCapacities)
+	if err != nil {
+		logrus.Warnf("Dropping the explicit tenant capacities: %v", err)
+		ftc.fixedCapacities = make(map[string]int)
+		if capacities, err = ftc.plan(ftc.tenantIDs(), ftc.fixedCapacities); err != nil {
+			logrus.Errorf("Cannot rebalance the tenant caches: %v", err)
+			return
+		}
+	}
+	ftc.apply(capacities)
+}
+
+// tenantIDs returns the IDs of the tenants. Caller must hold the lock.
+func (ftc *FixedTenantsCaches) tenantIDs() []string {
+	tenantIDs := make([]string, 0, len(ftc.caches))
+	for tenantID := range ftc.caches {
+		tenantIDs = append(tenantIDs, tenantID)
+	}
+	return tenantIDs
+}
+
+// tenantCaches returns a copy of the tenant caches, to iterate over them without the lock
+func (ftc *FixedTenantsCaches) tenantCaches() map[string]*LRUCache {
+	ftc.lock.RLock()
+	defer ftc.lock.RUnlock()
+	caches := make(map[string]*LRUCache, len(ftc.caches))
+	for tenantID, cache := range ftc.caches {
+		caches[tenantID] = cache
+	}
+	return caches
+}
+
+func copyCapacities(capacities map[string]int) map[string]int {
+	copied := make(map[string]int, len(capacities))
+	for tenantID, capacity := range capacities {
+		copied[tenantID] = capacity
+	}
+	return copied
+}
+
+func removeFile(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		logrus.Errorf("Error removing %s: %v", path, err)
+	}
+}
+
+// aofPath returns the append-only log of a tenant
+func aofPath(tenantID string) string {
+	return filepath.Join(config.AppConfig.AOFDir, tenantID+".aof")
+}
@@ -0,0 +1,313 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"multi-backend-cache/Internal/config"
+	"multi-backend-cache/Internal/metrices"
+	utils "multi-backend-cache/packageUtils/Utils"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Tiers reported by the tiered cache lookups metric.
+const (
+	TierL1   = "l1"
+	TierL2   = "l2"
+	TierMiss = "miss"
+)
+
+// TieredCache reads through an in-memory L1 to a shared L2, usually Redis. Reads that miss L1
+// are promoted to it, writes go through to both tiers and deletes invalidate both. L2 is
+// written first, so that a failed write never leaves L1 ahead of it.
+//
+// A read racing with a write on another instance can promote a value that is about to be
+// replaced; l1TTL bounds how long such a value is served.
+type TieredCache struct {
+	tenantID string
+	l1       *LRUCache
+	l2       CacheSystem
+	l1TTL    time.Duration // longest an entry stays in L1, 0 to follow its L2 expiry
+}
+
+func NewTieredCache(tenantID string, l1 *LRUCache, l2 CacheSystem, l1TTL time.Duration) *TieredCache {
+	return &TieredCache{tenantID: tenantID, l1: l1, l2: l2, l1TTL: l1TTL}
+}
+
+// TieredL1 returns the L1 of the tiered system for the tenant, nil when the tenant does not exist.
+// It is created on first use with the capacity and eviction policy of the tenant cache, but
+// holds its own keys, so that the tiered and in-memory systems neither see nor clear each
+// other's entries. It is not persisted, L2 holds the data.
+func (ftc *FixedTenantsCaches) TieredL1(tenantID string) *LRUCache {
+	ftc.lock.RLock()
+	l1 := ftc.tieredCaches[tenantID]
+	ftc.lock.RUnlock()
+	if l1 != nil {
+		return l1
+	}
+
+	ftc.lock.Lock()
+	defer ftc.lock.Unlock()
+	tenantCache, exists := ftc.caches[tenantID]
+	if !exists {
+		return nil
+	}
+	if l1 = ftc.tieredCaches[tenantID]; l1 != nil {
+		return l1
+	}
+	_, capacity, _ := tenantCache.Stats()
+	l1, err := NewCacheWithPolicy(capacity, ftc.defaultTTL, config.AppConfig.EvictionPolicyFor(tenantID))
+	if err != nil {
+		l1 = NewLRUCache(capacity, ftc.defaultTTL)
+	}
+	if ftc.invalidations != nil {
+		l1.invalidations.Store(&invalidationOutbox{tenantID: tenantID, tiered: true, queue: ftc.invalidations})
+	}
+	ftc.tieredCaches[tenantID] = l1
+	return l1
+}
+
+// record counts a lookup served by the tier
+func (t *TieredCache) record(tier string) {
+	metrices.TieredCacheLookups.WithLabelValues(t.tenantID, tier).Inc()
+}
+
+// Get returns the value from L1, or from L2 after promoting it to L1
+func (t *TieredCache) Get(ctx context.Context, key string) (interface{}, error) {
+	value, _, _, err := t.GetWithTTL(ctx, key)
+	return value, err
+}
+
+// GetWithTTL returns the value with the TTL of the tier that served it. Promoted entries keep
+// their L2 expiry unless l1TTL is shorter.
+func (t *TieredCache) GetWithTTL(ctx context.Context, key string) (interface{}, time.Duration, time.Time, error) {
+	item, err := t.GetItem(ctx, key)
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	return item.Value, item.TTL(), item.ExpiryTime, nil
+}
+
+// GetItem returns the item from L1, or from L2 after promoting it to L1
+func (t *TieredCache) GetItem(ctx context.Context, key string) (Item, error) {
+	item, err := t.l1.GetItem(ctx, key)
+	if err == nil {
+		t.record(TierL1)
+		return item, nil
+	}
+	if err != utils.NotFound {
+		return Item{}, err
+	}
+
+	item, err = t.l2.GetItem(ctx, key)
+	if err == utils.NotFound {
+		t.record(TierMiss)
+		return Item{}, err
+	}
+	if err != nil {
+		return Item{}, err
+	}
+	t.record(TierL2)
+	t.promote(key, item)
+	return item, nil
+}
+
+// GetMany returns the values found in L1 and looks the others up in L2 with one batch. Batches
+// do not carry the L2 expiry, so their L2 hits are only promoted when l1TTL bounds their life.
+func (t *TieredCache) GetMany(ctx context.Context, keys []string) (map[string]interface{}, error) {
+	values, err := t.l1.GetMany(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	missing := make([]string, 0, len(keys)-len(values))
+	for _, key := range keys {
+		if _, found := values[key]; !found {
+			missing = append(missing, key)
+		}
+	}
+	for range values {
+		t.record(TierL1)
+	}
+	if len(missing) == 0 {
+		return values, nil
+	}
+
+	l2Values, err := t.l2.GetMany(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range missing {
+		value, found := l2Values[key]
+		if !found {
+			t.record(TierMiss)
+			continue
+		}
+		t.record(TierL2)
+		values[key] = value
+		if t.l1TTL > 0 {
+			t.promote(key, Item{Value: value})
+		}
+	}
+	return values, nil
+}
+
+// promote copies an L2 hit to L1. A zero expiry time stands for an L2 entry without expiry,
+// which stays in L1 for l1TTL or else the default TTL of L1.
+func (t *TieredCache) promote(key string, item Item) {
+	expiryTime := item.ExpiryTime
+	raw, err := json.Marshal(item.Value)
+	if err != nil {
+		logrus.Errorf("Error marshalling value for key %s: %v", key, err)
+		return
+	}
+	now := time.Now()
+	if expiryTime.IsZero() {
+		expiryTime = CalculateExpiryTime(t.l1.defaultTTL)
+	}
+	if t.l1TTL > 0 && now.Add(t.l1TTL).Before(expiryTime) {
+		expiryTime = now.Add(t.l1TTL)
+	}
+	ttl := time.Duration(math.Ceil(expiryTime.Sub(now).Seconds()))
+	if ttl <= 0 {
+		return
+	}
+
+	shard := t.l1.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	softExpiry := item.SoftExpiry
+	if !softExpiry.Before(expiryTime) {
+		softExpiry = time.Time{}
+	}
+	if err := t.l1.setUntil(shard, key, raw, ttl, expiryTime, softExpiry, item.Version, nil); err != nil {
+		logrus.Debugf("Key %s not promoted to L1: %v", key, err)
+	}
+}
+
+// l1TTLFor bounds a TTL in seconds by l1TTL
+func (t *TieredCache) l1TTLFor(ttl time.Duration) time.Duration {
+	ttl = t.l1.ttlOrDefault(ttl)
+	if bound := time.Duration(t.l1TTL.Seconds()); bound > 0 && bound < ttl {
+		return bound
+	}
+	return ttl
+}
+
+// Set writes the value to L2, then to L1. When L1 cannot hold it the stale L1 entry is dropped,
+// the value is still served from L2.
+func (t *TieredCache) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	return t.SetWithSoftTTL(ctx, key, value, 0, ttl)
+}
+
+// SetWithSoftTTL is Set with a soft TTL, which L1 keeps unless its own bound is shorter
+func (t *TieredCache) SetWithSoftTTL(ctx context.Context, key string, value interface{}, softTTL time.Duration, ttl time.Duration) error {
+	_, err := t.SetIf(ctx, key, value, softTTL, ttl, Condition{})
+	return err
+}
+
+// SetIf checks the condition against L2, which holds the versions, and writes L1 with the
+// version of the new L2 entry. A failed condition drops L1, which may be behind L2.
+func (t *TieredCache) SetIf(ctx context.Context, key string, value interface{}, softTTL time.Duration, ttl time.Duration, condition Condition) (uint64, error) {
+	version, err := t.l2.SetIf(ctx, key, value, softTTL, ttl, condition)
+	return t.writeL1(key, value, softTTL, ttl, nil, version, err)
+}
+
+// writeL1 follows a write to L2 that returned the version and error, writing L1 with the tags
+func (t *TieredCache) writeL1(key string, value interface{}, softTTL time.Duration, ttl time.Duration, tags []string, version uint64, err error) (uint64, error) {
+	if err != nil {
+		if err == utils.PreconditionFailed {
+			t.invalidate(key)
+		}
+		return 0, err
+	}
+	if version == 0 { // L1 would not carry the L2 version
+		t.invalidate(key)
+		return 0, nil
+	}
+	if err := t.l1.setVersion(key, value, softTTL, t.l1TTLFor(ttl), version, tags); err != nil {
+		logrus.Debugf("Key %s not written to L1: %v", key, err)
+		t.invalidate(key)
+	}
+	return version, nil
+}
+
+// Incr adds delta to the counter in L2 and drops it from L1, which does not know its expiry
+func (t *TieredCache) Incr(ctx context.Context, key string, delta int64, initial int64, ttl time.Duration) (int64, error) {
+	value, err := t.l2.Incr(ctx, key, delta, initial, ttl)
+	t.invalidate(key)
+	return value, err
+}
+
+// SetMany writes the items to L2, then to L1
+func (t *TieredCache) SetMany(ctx context.Context, items []CacheData) error {
+	if err := t.l2.SetMany(ctx, items); err != nil {
+		return err
+	}
+	l1Items := make([]CacheData, len(items))
+	for i, item := range items {
+		l1Items[i] = item
+		l1Items[i].TTL = t.l1TTLFor(item.TTL)
+	}
+	if err := t.l1.SetMany(ctx, l1Items); err != nil {
+		logrus.Debugf("%d keys not written to L1: %v", len(items), err)
+		for _, item := range items {
+			t.invalidate(item.Key)
+		}
+	}
+	return nil
+}
+
+// invalidate drops a key from L1 only, here and in the other replicas
+func (t *TieredCache) invalidate(key string) {
+	shard := t.l1.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	if _, err := t.l1.delete(shard, key); err != nil {
+		logrus.Errorf("Error invalidating key %s in L1: %v", key, err)
+	}
+	t.l1.broadcast(Invalidation{Keys: []string{key}})
+}
+
+// Delete removes the key from both tiers. It is not found only when neither tier had it.
+func (t *TieredCache) Delete(ctx context.Context, key string) error {
+	err := t.l2.Delete(ctx, key)
+	if err != nil && err != utils.NotFound {
+		return err
+	}
+	if l1Err := t.l1.Delete(ctx, key); l1Err != utils.NotFound {
+		return l1Err
+	}
+	return err
+}
+
+// DeleteIf checks the condition against L2 and drops the key from L1 either way
+func (t *TieredCache) DeleteIf(ctx context.Context, key string, condition Condition) error {
+	if condition.IsZero() {
+		return t.Delete(ctx, key)
+	}
+	err := t.l2.DeleteIf(ctx, key, condition)
+	t.invalidate(key)
+	return err
+}
+
+// DeleteMany removes the keys from both tiers and reports how many of them existed in L2
+func (t *TieredCache) DeleteMany(ctx context.Context, keys []string) (int, error) {
+	deleted, err := t.l2.DeleteMany(ctx, keys)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := t.l1.DeleteMany(ctx, keys); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// Clear clears L2, then L1. The in-memory cache of the tenant is not the L1, so it is kept.
+func (t *TieredCache) Clear(ctx context.Context) error {
+	if err := t.l2.Clear(ctx); err != nil {
+		return err
+	}
+	return t.l1.Clear(ctx)
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"path/filepath"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -15,14 +16,70 @@ type Config struct {
 	CacheSystems          []string `mapstructure:"CacheSystems"`
 	MemoryUsagePercentage float64  `mapstructure:"MemoryUsagePercentage"`
 	IP                    string   `mapstructure:"IP"`
+	OperationTimeout      int      `mapstructure:"OperationTimeout"`    // per backend operation, in milliseconds
+	EvictionPolicy        string   `mapstructure:"EvictionPolicy"`      // lru, lfu, fifo, sieve or wtinylfu
+	ShardCount            int      `mapstructure:"ShardCount"`          // lock-striped shards per in-memory cache
+	JanitorInterval       int      `mapstructure:"JanitorInterval"`     // active expiry of the in-memory caches, in milliseconds
+	MemoryCheckInterval   int      `mapstructure:"MemoryCheckInterval"` // tenant capacity checks, in milliseconds
+	MetricsInterval       int      `mapstructure:"MetricsInterval"`     // in-memory usage gauges, in milliseconds
+	SnapshotDir           string   `mapstructure:"SnapshotDir"`         // snapshots of the in-memory caches, empty disables them
+	SnapshotInterval      int      `mapstructure:"SnapshotInterval"`    // in milliseconds
+	AOFDir                string   `mapstructure:"AOFDir"`              // append-only logs of the durable tenants
+	AOFRewriteMinSize     int64    `mapstructure:"AOFRewriteMinSize"`   // in bytes, logs are compacted once they doubled past it
+	TieredL1TTL           int      `mapstructure:"TieredL1TTL"`         // longest an entry stays in the in-memory tier, in seconds (0: its Redis TTL)
+	Tenants               map[string]TenantConfig `mapstructure:"Tenants"`
+	Loaders               []LoaderConfig          `mapstructure:"Loaders"`
+	Invalidation          InvalidationConfig      `mapstructure:"Invalidation"`
 	Redis      RedisConfig
     Memcache   MemcacheConfig
 }
 
+// TenantConfig holds the settings that can be overridden per tenant.
+// Viper lowercases map keys, so tenant IDs are matched case-insensitively.
+type TenantConfig struct {
+	EvictionPolicy string `mapstructure:"EvictionPolicy"`
+	AOF            bool   `mapstructure:"AOF"`      // log every write to an append-only log replayed at startup
+	AOFFsync       string `mapstructure:"AOFFsync"` // always, everysec (default) or never
+
+	// In-memory capacity: a quota in bytes, or a share of the memory left by the quotas in
+	// proportion to the weight (1 by default), never below the minimum
+	Quota       int     `mapstructure:"Quota"`
+	Weight      float64 `mapstructure:"Weight"`
+	MinCapacity int     `mapstructure:"MinCapacity"`
+
+	// Redis database of the tenant when the Redis tenant namespace is database
+	RedisDB int `mapstructure:"RedisDB"`
+}
+
+// LoaderConfig describes the HTTP origin the keys starting with Prefix are loaded from on a miss.
+// URL may contain {key}, the key without the prefix, and {tenantID}.
+type LoaderConfig struct {
+	Prefix  string `mapstructure:"Prefix"`
+	URL     string `mapstructure:"URL"`
+	TTL     int    `mapstructure:"TTL"`     // seconds the loaded value is cached, 0 for the default TTL
+	SoftTTL int    `mapstructure:"SoftTTL"` // seconds after which it is served stale and refreshed, 0 for never
+	Grace   int    `mapstructure:"Grace"`   // seconds it is kept past its TTL, served only when the origin fails
+	Timeout int    `mapstructure:"Timeout"` // origin request, in milliseconds (0 for the operation timeout)
+}
+
+// InvalidationConfig describes how the replicas of the service tell each other about the changes
+// of their in-memory caches: over Redis pub/sub when Redis is configured, otherwise by posting
+// them to every peer.
+type InvalidationConfig struct {
+	Enabled    bool     `mapstructure:"Enabled"`
+	Channel    string   `mapstructure:"Channel"`    // Redis pub/sub channel, cache:invalidations by default
+	Peers      []string `mapstructure:"Peers"`      // base URLs of the other replicas, used without Redis
+	InstanceID string   `mapstructure:"InstanceID"` // unique per replica, generated when empty
+	Timeout    int      `mapstructure:"Timeout"`    // per publication, in milliseconds (0 for the operation timeout)
+	Secret     string   `mapstructure:"Secret"`     // shared by the peers, required to post invalidations without Redis
+}
+
 type RedisConfig struct {
     Address  string `mapstructure:"address"`
     Password string `mapstructure:"password"`
     Database int    `mapstructure:"database"`
+    // How tenants are kept apart: prefix (default) or database
+    TenantNamespace string `mapstructure:"tenantNamespace"`
 }
 
 type MemcacheConfig struct {
@@ -32,6 +89,20 @@ type MemcacheConfig struct {
 
 var AppConfig Config
 
+// TenantConfigFor returns the overrides of a tenant, empty if it has none.
+func (c Config) TenantConfigFor(tenantID string) TenantConfig {
+	return c.Tenants[strings.ToLower(tenantID)]
+}
+
+// EvictionPolicyFor returns the in-memory eviction policy of a tenant: its own override if set,
+// otherwise the global one.
+func (c Config) EvictionPolicyFor(tenantID string) string {
+	if tenant := c.TenantConfigFor(tenantID); tenant.EvictionPolicy != "" {
+		return tenant.EvictionPolicy
+	}
+	return c.EvictionPolicy
+}
+
 func LoadConfig(configFile string) {
 	absPath, err := filepath.Abs(configFile)
 	if err != nil {
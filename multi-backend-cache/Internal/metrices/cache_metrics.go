@@ -0,0 +1,35 @@
+package metrices
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Gauges describing the memory accounted by each in-memory tenant cache.
+var (
+	InMemoryUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "inmemory_cache_used_bytes",
+		Help: "Bytes accounted to the entries of an in-memory tenant cache",
+	}, []string{"tenant"})
+	InMemoryCapacityBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "inmemory_cache_capacity_bytes",
+		Help: "Byte budget of an in-memory tenant cache",
+	}, []string{"tenant"})
+	InMemoryEntries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "inmemory_cache_entries",
+		Help: "Number of entries held by an in-memory tenant cache",
+	}, []string{"tenant"})
+)
+
+// Lookups of the tiered cache, by the tier that served them ("l1", "l2" or "miss").
+var TieredCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "tiered_cache_lookups_total",
+	Help: "Lookups of the tiered cache by the tier that served them, or miss",
+}, []string{"tenant", "tier"})
+
+// Reads that joined a backend call or load already in flight for the same key.
+var CoalescedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "coalesced_requests_total",
+	Help: "Reads served by a backend call or load started by a concurrent read of the same key",
+}, []string{"system"})
+
+func init() {
+	prometheus.MustRegister(InMemoryUsedBytes, InMemoryCapacityBytes, InMemoryEntries, TieredCacheLookups, CoalescedRequests)
+}
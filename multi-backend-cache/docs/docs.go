@@ -15,32 +15,846 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/admin/snapshot": {
+            "get": {
+                "description": "Report when the in-memory caches were last snapshotted, null if never",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get the last snapshot time",
+                "operationId": "get-snapshot",
+                "responses": {
+                    "200": {
+                        "description": "time of the last snapshot"
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    }
+                }
+            },
+            "post": {
+                "description": "Write a snapshot of every in-memory tenant cache to the snapshot directory",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Snapshot the in-memory caches",
+                "operationId": "take-snapshot",
+                "responses": {
+                    "200": {
+                        "description": "time of the snapshot"
+                    },
+                    "400": {
+                        "description": "Snapshots are not configured"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    }
+                }
+            }
+        },
+        "/admin/tenants": {
+            "get": {
+                "description": "List the in-memory tenants with their capacity and usage",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "List tenants",
+                "operationId": "list-tenants",
+                "responses": {
+                    "200": {
+                        "description": "tenants"
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    }
+                }
+            },
+            "post": {
+                "description": "Create an in-memory tenant, with an explicit capacity or sharing the memory left by the others, and rebalance the existing tenants",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Create a tenant",
+                "operationId": "create-tenant",
+                "parameters": [
+                    {
+                        "description": "Tenant to create",
+                        "name": "payload",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handler.TenantPayload"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "status: ok"
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "409": {
+                        "description": "Tenant already exists"
+                    }
+                }
+            }
+        },
+        "/admin/tenants/{tenantID}": {
+            "put": {
+                "description": "Give a tenant an explicit capacity, or 0 to share the memory left by the others again, and rebalance the other tenants",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Resize a tenant",
+                "operationId": "resize-tenant",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Tenant ID",
+                        "name": "tenantID",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "New capacity",
+                        "name": "payload",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handler.TenantPayload"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "status: ok"
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "404": {
+                        "description": "Tenant Not Found"
+                    }
+                }
+            },
+            "delete": {
+                "description": "Delete an in-memory tenant with its data, snapshot and append-only log, and give its memory back to the other tenants",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Delete a tenant",
+                "operationId": "delete-tenant",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Tenant ID",
+                        "name": "tenantID",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "status: ok"
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "404": {
+                        "description": "Tenant Not Found"
+                    }
+                }
+            }
+        },
         "/cache": {
             "post": {
-                "description": "Set a value in the cache with a specified key and TTL (Time-To-Live)",
+                "description": "Set a value in the cache with a specified key, TTL (Time-To-Live) and optional soft TTL after which it is served as stale. Tags group entries that DELETE /cache/tags/{tag} invalidates together. With If-Match or If-None-Match the write only applies when the current entry matches, the ETag of the new entry is returned when the backend knows it",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Set value in cache",
+                "operationId": "set-cache-value",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Cache Type",
+                        "name": "system",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "upsert (default), add to only create the entry or replace to only update it",
+                        "name": "mode",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Write only if the entry has one of these ETags, * if it exists",
+                        "name": "If-Match",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Write only if the entry has none of these ETags, * if it does not exist",
+                        "name": "If-None-Match",
+                        "in": "header"
+                    },
+                    {
+                        "description": "Cache Payload",
+                        "name": "payload",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/cache.CacheData"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "status: ok"
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "404": {
+                        "description": "Not Found"
+                    },
+                    "409": {
+                        "description": "Entry exists in add mode, or is missing in replace mode"
+                    },
+                    "412": {
+                        "description": "Entry does not match the expected version"
+                    },
+                    "413": {
+                        "description": "Entry exceeds the cache capacity"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    },
+                    "501": {
+                        "description": "Cache system cannot tag entries"
+                    }
+                }
+            },
+            "delete": {
+                "description": "Start a job deleting every key matching a glob pattern (Redis syntax: *, ?, [a-z], \\ to escape) in the background. The keys are deleted in batches, Redis unlinks the keys of each SCAN page. The job and its progress are read from the Location header. Memcache cannot list its keys",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Delete keys by pattern",
+                "operationId": "delete-cache-by-pattern",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Cache Type",
+                        "name": "system",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Glob pattern",
+                        "name": "match",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "$ref": "#/definitions/handler.Job"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    },
+                    "501": {
+                        "description": "Not Implemented"
+                    },
+                    "503": {
+                        "description": "Server is shutting down"
+                    }
+                }
+            }
+        },
+        "/cache/TTL/{key}": {
+            "get": {
+                "description": "Retrieve a value, its remaining TTL in seconds and its absolute expiry time. Entries without an expiry report a TTL of -1",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get value from cache by key along with its TTL",
+                "operationId": "get-cache-with-ttl-by-key",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Cache Key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Cache Type",
+                        "name": "system",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "value, ttl and expiry_time"
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "404": {
+                        "description": "Not Found"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    }
+                }
+            }
+        },
+        "/cache/batch/delete": {
+            "post": {
+                "description": "Delete several keys in one request and report how many of them existed",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Delete multiple values from cache",
+                "operationId": "batch-delete-cache",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Cache Type",
+                        "name": "system",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "description": "Keys to delete",
+                        "name": "payload",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handler.BatchKeysPayload"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "number of deleted keys"
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    }
+                }
+            }
+        },
+        "/cache/batch/get": {
+            "post": {
+                "description": "Retrieve the values of several keys in one request. Keys that do not exist are listed under \"missing\"",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get multiple values from cache",
+                "operationId": "batch-get-cache",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Cache Type",
+                        "name": "system",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "description": "Keys to fetch",
+                        "name": "payload",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handler.BatchKeysPayload"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "values and missing keys"
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    }
+                }
+            }
+        },
+        "/cache/batch/set": {
+            "post": {
+                "description": "Set several key/value pairs in one request, each with its own TTL",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Set multiple values in cache",
+                "operationId": "batch-set-cache",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Cache Type",
+                        "name": "system",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "description": "Items to store",
+                        "name": "payload",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handler.BatchSetPayload"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "status: ok"
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "413": {
+                        "description": "Entry exceeds the cache capacity"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    }
+                }
+            }
+        },
+        "/cache/clear": {
+            "put": {
+                "description": "clear caches for the provided cache type. When tenants are enabled only the keys of the tenant are removed",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Clear all caches",
+                "operationId": "clear-cache",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Cache Type",
+                        "name": "system",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Tenant ID",
+                        "name": "tenantID",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "status: ok"
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "404": {
+                        "description": "Not Found"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    }
+                }
+            }
+        },
+        "/cache/jobs/{id}": {
+            "get": {
+                "description": "Read the status and progress of a job started by DELETE /cache. Finished jobs are kept for an hour",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get a job",
+                "operationId": "get-job",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Job ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Cache Type",
+                        "name": "system",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/handler.Job"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found"
+                    }
+                }
+            }
+        },
+        "/cache/keys": {
+            "get": {
+                "description": "Page through the keys matching a glob pattern (Redis syntax: *, ?, [a-z], \\ to escape). Pass the returned cursor to get the next page; an empty cursor means the scan is complete. Keys that exist for the whole scan are listed at least once, Redis may list a key twice. Memcache cannot list its keys",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "List keys",
+                "operationId": "list-cache-keys",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Cache Type",
+                        "name": "system",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Glob pattern, all keys by default",
+                        "name": "match",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Cursor returned by the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Keys per page, 100 by default",
+                        "name": "count",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "keys and next cursor"
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    },
+                    "501": {
+                        "description": "Not Implemented"
+                    }
+                }
+            }
+        },
+        "/cache/tags/{tag}": {
+            "delete": {
+                "description": "Delete every entry written with the tag by POST /cache. Memcache cannot count the entries, which read as missing from then on and are left to expire",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Invalidate a tag",
+                "operationId": "invalidate-tag",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Tag",
+                        "name": "tag",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Cache Type",
+                        "name": "system",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "status: ok, and the number of deleted entries when known"
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    },
+                    "501": {
+                        "description": "Not Implemented"
+                    }
+                }
+            }
+        },
+        "/cache/{key}": {
+            "get": {
+                "description": "Retrieve a value from the cache using the provided key and cache type. The X-Cache-Status header tells whether it was a HIT, a STALE value being refreshed, or a MISS loaded from the origin",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get value from cache by key",
+                "operationId": "get-cache-by-key",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Cache Key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Cache Type",
+                        "name": "system",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "status: ok"
+                    },
+                    "400": {
+                        "description": "Bas Request"
+                    },
+                    "404": {
+                        "description": "Not Found"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    },
+                    "502": {
+                        "description": "Read-through origin failed"
+                    }
+                }
+            },
+            "delete": {
+                "description": "Delete a value from the cache using the provided key and cache type. With If-Match or If-None-Match the delete only applies when the current entry matches",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Delete value from cache by key",
+                "operationId": "delete-cache-by-key",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Cache Key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Cache Type",
+                        "name": "system",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Delete only if the entry has one of these ETags",
+                        "name": "If-Match",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Delete only if the entry has none of these ETags",
+                        "name": "If-None-Match",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "status: ok"
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "404": {
+                        "description": "Not Found"
+                    },
+                    "412": {
+                        "description": "Entry does not match the expected version"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    }
+                }
+            }
+        },
+        "/cache/{key}/incr": {
+            "post": {
+                "description": "Atomically add delta (1 by default, negative to decrement) to the integer stored at the key. A missing key is created as initial + delta with the TTL; an existing counter keeps its expiry. Memcache counters never go below 0",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Increment a counter",
+                "operationId": "incr-cache",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Cache Key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Cache Type",
+                        "name": "system",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "description": "Delta, initial value and TTL",
+                        "name": "payload",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/handler.IncrPayload"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "value of the counter"
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "409": {
+                        "description": "Value is not an integer or the result overflows"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    }
+                }
+            }
+        },
+        "/events": {
+            "get": {
+                "description": "Stream the set, delete, expire, evict and clear events of the cache system as Server-Sent Events, named after their type, with the key and time as JSON data. match filters the keys with a glob pattern (Redis syntax: *, ?, [a-z], \\ to escape). Redis events come from its keyspace notifications, which need notify-keyspace-events to include K$gxe, and do not include clears. A client that falls behind misses events. Memcache cannot stream its changes",
+                "produces": [
+                    "text/event-stream"
+                ],
+                "summary": "Stream change events",
+                "operationId": "stream-events",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Cache Type",
+                        "name": "system",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Glob pattern, all keys by default",
+                        "name": "match",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/cache.Event"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    },
+                    "501": {
+                        "description": "Not Implemented"
+                    }
+                }
+            }
+        },
+        "/internal/invalidations": {
+            "post": {
+                "description": "Drop the keys, the tag or the whole in-memory cache or tiered L1 of a tenant changed by another replica. Posted by the peers when the replicas share invalidations without Redis, with the secret they share",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Set value in cache",
-                "operationId": "set-cache-value",
+                "summary": "Apply an invalidation of another replica",
+                "operationId": "apply-invalidation",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Cache Type",
-                        "name": "system",
-                        "in": "query",
+                        "description": "Secret shared by the peers",
+                        "name": "X-Invalidation-Secret",
+                        "in": "header",
                         "required": true
                     },
                     {
-                        "description": "Cache Payload",
+                        "description": "Invalidation",
                         "name": "payload",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/cache.CacheData"
+                            "$ref": "#/definitions/cache.Invalidation"
                         }
                     }
                 ],
@@ -51,44 +865,60 @@ const docTemplate = `{
                     "400": {
                         "description": "Bad Request"
                     },
-                    "404": {
-                        "description": "Not Found"
-                    },
-                    "500": {
-                        "description": "Internal Server Error"
+                    "401": {
+                        "description": "Unauthorized"
                     }
                 }
             }
         },
-        "/cache/clear": {
-            "put": {
-                "description": "clear caches for the provided cache type",
+        "/locks/{name}": {
+            "post": {
+                "description": "Take the named lock for a lease of ttl milliseconds. The response holds the owner token, needed to refresh and release the lock, and a fencing token that grows with every acquisition. In-memory and Memcache leases are rounded up to the second",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Clear all caches",
-                "operationId": "clear-cache",
+                "summary": "Acquire a lock",
+                "operationId": "acquire-lock",
                 "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Lock Name",
+                        "name": "name",
+                        "in": "path",
+                        "required": true
+                    },
                     {
                         "type": "string",
                         "description": "Cache Type",
                         "name": "system",
                         "in": "query",
                         "required": true
+                    },
+                    {
+                        "description": "Lease in milliseconds",
+                        "name": "payload",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handler.LockPayload"
+                        }
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": "status: ok"
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/cache.Lease"
+                        }
                     },
                     "400": {
                         "description": "Bad Request"
                     },
-                    "404": {
-                        "description": "Not Found"
+                    "409": {
+                        "description": "Lock is held by another owner"
                     },
                     "500": {
                         "description": "Internal Server Error"
@@ -96,22 +926,22 @@ const docTemplate = `{
                 }
             }
         },
-        "/cache/{key}": {
-            "get": {
-                "description": "Retrieve a value from the cache using the provided key and cache type",
+        "/locks/{name}/refresh": {
+            "post": {
+                "description": "Extend the lease of the owner to ttl milliseconds from now",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Get value from cache by key",
-                "operationId": "get-cache-by-key",
+                "summary": "Refresh a lock",
+                "operationId": "refresh-lock",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Cache Key",
-                        "name": "key",
+                        "description": "Lock Name",
+                        "name": "name",
                         "in": "path",
                         "required": true
                     },
@@ -121,38 +951,52 @@ const docTemplate = `{
                         "name": "system",
                         "in": "query",
                         "required": true
+                    },
+                    {
+                        "description": "Owner and lease in milliseconds",
+                        "name": "payload",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handler.LockPayload"
+                        }
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": "status: ok"
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/cache.Lease"
+                        }
                     },
                     "400": {
-                        "description": "Bas Request"
+                        "description": "Bad Request"
                     },
-                    "404": {
-                        "description": "Not Found"
+                    "409": {
+                        "description": "Lock is not held by this owner"
                     },
                     "500": {
                         "description": "Internal Server Error"
                     }
                 }
-            },
-            "delete": {
-                "description": "Delete a value from the cache using the provided key and cache type",
+            }
+        },
+        "/locks/{name}/release": {
+            "post": {
+                "description": "Free the lock held by the owner",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Delete value from cache by key",
-                "operationId": "delete-cache-by-key",
+                "summary": "Release a lock",
+                "operationId": "release-lock",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Cache Key",
-                        "name": "key",
+                        "description": "Lock Name",
+                        "name": "name",
                         "in": "path",
                         "required": true
                     },
@@ -162,6 +1006,15 @@ const docTemplate = `{
                         "name": "system",
                         "in": "query",
                         "required": true
+                    },
+                    {
+                        "description": "Owner",
+                        "name": "payload",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handler.LockPayload"
+                        }
                     }
                 ],
                 "responses": {
@@ -171,8 +1024,8 @@ const docTemplate = `{
                     "400": {
                         "description": "Bad Request"
                     },
-                    "404": {
-                        "description": "Not Found"
+                    "409": {
+                        "description": "Lock is not held by this owner"
                     },
                     "500": {
                         "description": "Internal Server Error"
@@ -189,6 +1042,26 @@ const docTemplate = `{
                     "type": "string",
                     "example": "1"
                 },
+                "soft_ttl": {
+                    "description": "seconds after which the value is served stale, 0 for never",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/time.Duration"
+                        }
+                    ],
+                    "example": 30
+                },
+                "tags": {
+                    "description": "invalidated together by DELETE /cache/tags/:tag, only with POST /cache",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    },
+                    "example": [
+                        "product:42",
+                        "user:7"
+                    ]
+                },
                 "ttl": {
                     "allOf": [
                         {
@@ -200,6 +1073,183 @@ const docTemplate = `{
                 "value": {}
             }
         },
+        "cache.Event": {
+            "type": "object",
+            "properties": {
+                "key": {
+                    "description": "empty for a clear",
+                    "type": "string",
+                    "example": "1"
+                },
+                "time": {
+                    "type": "string"
+                },
+                "type": {
+                    "type": "string",
+                    "example": "set"
+                }
+            }
+        },
+        "cache.Invalidation": {
+            "type": "object",
+            "properties": {
+                "clear": {
+                    "type": "boolean"
+                },
+                "keys": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "origin": {
+                    "description": "instance ID of the replica that made the change",
+                    "type": "string"
+                },
+                "tag": {
+                    "type": "string"
+                },
+                "tenantID": {
+                    "type": "string"
+                },
+                "tiered": {
+                    "description": "the change is to the tiered L1 of the tenant rather than its in-memory cache",
+                    "type": "boolean"
+                }
+            }
+        },
+        "cache.Lease": {
+            "type": "object",
+            "properties": {
+                "expiry_time": {
+                    "type": "string"
+                },
+                "fence": {
+                    "description": "grows with every acquisition, 0 on refresh",
+                    "type": "integer"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "owner": {
+                    "description": "token proving ownership",
+                    "type": "string"
+                }
+            }
+        },
+        "handler.BatchKeysPayload": {
+            "type": "object",
+            "properties": {
+                "keys": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    },
+                    "example": [
+                        "1",
+                        "2",
+                        "3"
+                    ]
+                }
+            }
+        },
+        "handler.BatchSetPayload": {
+            "type": "object",
+            "properties": {
+                "items": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/cache.CacheData"
+                    }
+                }
+            }
+        },
+        "handler.IncrPayload": {
+            "type": "object",
+            "properties": {
+                "delta": {
+                    "description": "1 when omitted, negative to decrement",
+                    "type": "integer",
+                    "example": 1
+                },
+                "initial": {
+                    "type": "integer",
+                    "example": 0
+                },
+                "ttl": {
+                    "description": "only applied when the counter is created",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/time.Duration"
+                        }
+                    ],
+                    "example": 100
+                }
+            }
+        },
+        "handler.Job": {
+            "type": "object",
+            "properties": {
+                "batches": {
+                    "description": "pages of the key space done so far",
+                    "type": "integer"
+                },
+                "deleted": {
+                    "description": "keys deleted so far",
+                    "type": "integer"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "finished_at": {
+                    "description": "nil while the job runs",
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "match": {
+                    "type": "string",
+                    "example": "session:*"
+                },
+                "started_at": {
+                    "type": "string"
+                },
+                "status": {
+                    "type": "string",
+                    "example": "running"
+                }
+            }
+        },
+        "handler.LockPayload": {
+            "type": "object",
+            "properties": {
+                "owner": {
+                    "description": "returned on acquisition, required to refresh and release",
+                    "type": "string",
+                    "example": "3f2b9c0e8d7a41f6a5b4c3d2e1f00112"
+                },
+                "ttl": {
+                    "description": "lease, in milliseconds",
+                    "type": "integer",
+                    "example": 30000
+                }
+            }
+        },
+        "handler.TenantPayload": {
+            "type": "object",
+            "properties": {
+                "capacity": {
+                    "description": "in bytes, 0 shares the memory left by the other tenants",
+                    "type": "integer",
+                    "example": 1048576
+                },
+                "tenantID": {
+                    "type": "string",
+                    "example": "tenant4"
+                }
+            }
+        },
         "time.Duration": {
             "type": "integer",
             "enum": [
@@ -210,26 +1260,7 @@ const docTemplate = `{
                 1000000,
                 1000000000,
                 60000000000,
-                3600000000000,
-                -9223372036854775808,
-                9223372036854775807,
-                1,
-                1000,
-                1000000,
-                1000000000,
-                60000000000,
-                3600000000000,
-                -9223372036854775808,
-                9223372036854775807,
-                1,
-                1000,
-                1000000,
-                1000000000,
-                60000000000,
-                3600000000000,
-                1,
-                1000,
-                1000000
+                3600000000000
             ],
             "x-enum-varnames": [
                 "minDuration",
@@ -239,26 +1270,7 @@ const docTemplate = `{
                 "Millisecond",
                 "Second",
                 "Minute",
-                "Hour",
-                "minDuration",
-                "maxDuration",
-                "Nanosecond",
-                "Microsecond",
-                "Millisecond",
-                "Second",
-                "Minute",
-                "Hour",
-                "minDuration",
-                "maxDuration",
-                "Nanosecond",
-                "Microsecond",
-                "Millisecond",
-                "Second",
-                "Minute",
-                "Hour",
-                "Nanosecond",
-                "Microsecond",
-                "Millisecond"
+                "Hour"
             ]
         }
     }
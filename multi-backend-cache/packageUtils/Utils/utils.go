@@ -8,6 +8,17 @@ import (
 )
 
 var NotFound = errors.New("Key Does not exist")
+var TooLarge = errors.New("Entry exceeds the cache capacity")
+var TenantNotFound = errors.New("Tenant Not Found")
+var TenantExists = errors.New("Tenant already exists")
+var PreconditionFailed = errors.New("Entry does not match the expected version")
+var NotInteger = errors.New("Value is not an integer or the result overflows")
+var Locked = errors.New("Lock is held by another owner")
+var NotOwner = errors.New("Lock is not held by this owner")
+var InvalidCursor = errors.New("Invalid scan cursor")
+var NotSupported = errors.New("Operation not supported by this cache system")
+var ReservedKey = errors.New("Key is reserved by the cache")
+var ShuttingDown = errors.New("Server is shutting down")
 
 // RespondJSON sends a JSON response with status code
 func RespondJSON(w http.ResponseWriter, status int, data interface{}) {
@@ -8,12 +8,16 @@ import (
 	"multi-backend-cache/Internal/config"
 	"multi-backend-cache/Internal/metrices"
 	_ "multi-backend-cache/docs"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/pbnjay/memory"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
 )
@@ -46,6 +50,16 @@ func main() {
 	tenantCaches = cache.NewFixedTenantsCaches(isTenantBased, totalCacheMemory, time.Duration(defaultTTL))
 	cacheSystem := handler.NewServer(tenantCaches, redisCache, memCache)
 
+	// Tell the other replicas about the changes of the in-memory caches
+	var invalidationBus cache.InvalidationBus
+	if invalidationConfig := config.AppConfig.Invalidation; invalidationConfig.Enabled {
+		invalidationBus = cache.NewInvalidationBus(invalidationConfig, redisCache)
+		if _, ok := invalidationBus.(*cache.PeerInvalidationBus); ok && invalidationConfig.Secret == "" {
+			logrus.Fatal("Invalidation.Secret must be set to share the invalidations with the peers")
+		}
+		tenantCaches.EnableInvalidation(invalidationConfig, invalidationBus)
+	}
+
 	router := gin.Default()
 
 	host := fmt.Sprintf("http://%s:8080/swagger/doc.json", config.AppConfig.IP)
@@ -59,22 +73,58 @@ func main() {
 
 	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
+	// Admin routes, registered before the cache system validation
+	router.POST("/admin/snapshot", cacheSystem.SnapshotHandler)
+	router.GET("/admin/snapshot", cacheSystem.SnapshotStatusHandler)
+	router.GET("/admin/tenants", cacheSystem.ListTenantsHandler)
+	router.POST("/admin/tenants", cacheSystem.CreateTenantHandler)
+	router.PUT("/admin/tenants/:tenantID", cacheSystem.ResizeTenantHandler)
+	router.DELETE("/admin/tenants/:tenantID", cacheSystem.DeleteTenantHandler)
+
+	// Invalidations posted by the other replicas, when they share them without Redis
+	if _, ok := invalidationBus.(*cache.PeerInvalidationBus); ok {
+		router.POST(cache.InvalidationPath, cacheSystem.InvalidationHandler)
+	}
+
 	router.Use(handler.ValidateCacheSystem())
 
-	// Middleware for "inmemory" system
-	router.Use(func(c *gin.Context) {
-		if system := c.Query("system"); system == "inmemory" && isTenantBased {
-			handler.ValidateTenant()(c)
-		}
-		c.Next()
-	})
+	// Every cache system is scoped to the tenant, so the tenant is validated for all of them
+	if isTenantBased {
+		router.Use(handler.ValidateTenant(tenantCaches))
+	}
 
 	// Cache System routes
+	router.GET("/cache/keys", cacheSystem.ListKeysHandler)
+	router.DELETE("/cache/tags/:tag", cacheSystem.InvalidateTagHandler)
 	router.GET("/cache/:key", cacheSystem.GetCacheHandler)
-	//router.GET("/cache/TTL/:key", cacheSystem.GetCacheWithTTLHandler)
+	router.GET("/cache/TTL/:key", cacheSystem.GetCacheWithTTLHandler)
 	router.POST("/cache", cacheSystem.SetCacheHandler)
 	router.DELETE("/cache/:key", cacheSystem.DeleteCacheHandler)
+	router.DELETE("/cache", cacheSystem.DeleteMatchingHandler)
+	router.GET("/cache/jobs/:id", cacheSystem.GetJobHandler)
+	router.POST("/cache/:key/incr", cacheSystem.IncrCacheHandler)
 	router.PUT("/cache/clear", cacheSystem.ClearCacheHandler)
+	router.POST("/cache/batch/get", cacheSystem.BatchGetCacheHandler)
+	router.POST("/cache/batch/set", cacheSystem.BatchSetCacheHandler)
+	router.POST("/cache/batch/delete", cacheSystem.BatchDeleteCacheHandler)
+
+	// Change events
+	router.GET("/events", cacheSystem.EventsHandler)
+
+	// Lock routes
+	router.POST("/locks/:name", cacheSystem.AcquireLockHandler)
+	router.POST("/locks/:name/refresh", cacheSystem.RefreshLockHandler)
+	router.POST("/locks/:name/release", cacheSystem.ReleaseLockHandler)
+
+	// Stop the jobs, take a last snapshot and stop the background goroutines on shutdown
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		cacheSystem.Shutdown()
+		tenantCaches.Close()
+		os.Exit(0)
+	}()
 
 	// Start the HTTP server
 	addr := ":8080"
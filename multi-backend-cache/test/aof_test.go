@@ -0,0 +1,115 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"multi-backend-cache/Internal/cache"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Opens a cache backed by the append-only log at path
+func openDurableCache(t *testing.T, path string, fsync string, minRewriteSize int64) (*cache.LRUCache, int) {
+	lru := cache.NewLRUCache(1<<20, 60)
+	t.Cleanup(lru.Close)
+	replayed, err := lru.EnableAppendLog(path, fsync, minRewriteSize)
+	assert.NoError(t, err)
+	return lru, replayed
+}
+
+// Writes are replayed in order after a restart
+func TestAppendLogReplay(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "tenant.aof")
+
+	lru, replayed := openDurableCache(t, path, cache.FsyncAlways, 0)
+	assert.Equal(t, 0, replayed)
+	assert.NoError(t, lru.Set(ctx, "a", "first", 60))
+	assert.NoError(t, lru.Set(ctx, "b", "value", 60))
+	assert.NoError(t, lru.SetMany(ctx, []cache.CacheData{{Key: "c", Value: 3, TTL: 60}}))
+	assert.NoError(t, lru.Delete(ctx, "b"))
+	assert.NoError(t, lru.Set(ctx, "a", "second", 60))
+	assert.Error(t, lru.Delete(ctx, "missing")) // misses are not logged
+	lru.Close()
+
+	lru, replayed = openDurableCache(t, path, cache.FsyncAlways, 0)
+	assert.Equal(t, 5, replayed)
+	value, err := lru.Get(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "second", value)
+	_, err = lru.Get(ctx, "b")
+	assert.Error(t, err)
+	value, err = lru.Get(ctx, "c")
+	assert.NoError(t, err)
+	assert.Equal(t, float64(3), value)
+
+	assert.NoError(t, lru.Clear(ctx))
+	assert.NoError(t, lru.Set(ctx, "d", "after clear", 60))
+	lru.Close()
+
+	lru, _ = openDurableCache(t, path, cache.FsyncEverySec, 0)
+	defer lru.Close()
+	_, _, entries := lru.Stats()
+	assert.Equal(t, 1, entries)
+}
+
+// A record torn by a crash is dropped from the log
+func TestAppendLogTornTail(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "tenant.aof")
+	lru, _ := openDurableCache(t, path, cache.FsyncAlways, 0)
+	assert.NoError(t, lru.Set(ctx, "a", "value", 60))
+	lru.Close()
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	assert.NoError(t, err)
+	file.WriteString(`{"op":"set","key":"b","val`)
+	file.Close()
+
+	lru, replayed := openDurableCache(t, path, cache.FsyncNever, 0)
+	defer lru.Close()
+	assert.Equal(t, 1, replayed)
+	truncated, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, info.Size(), truncated.Size())
+}
+
+// The log is compacted in the background once it doubled past the minimum rewrite size
+func TestAppendLogRewrite(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "tenant.aof")
+	lru, _ := openDurableCache(t, path, cache.FsyncNever, 4096)
+	for i := 0; i < 60; i++ { // about 5KB of records for five keys
+		assert.NoError(t, lru.Set(ctx, fmt.Sprintf("k%d", i%5), i, 60))
+	}
+	assert.Eventually(t, func() bool {
+		content, err := os.ReadFile(path)
+		return err == nil && !strings.Contains(string(content), `"value":0,`) // the first write was compacted away
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.NoError(t, lru.Set(ctx, "k0", "last", 60))
+	lru.Close()
+
+	lru, replayed := openDurableCache(t, path, cache.FsyncNever, 4096)
+	defer lru.Close()
+	assert.Less(t, replayed, 60)
+	value, err := lru.Get(ctx, "k0")
+	assert.NoError(t, err)
+	assert.Equal(t, "last", value)
+	value, err = lru.Get(ctx, "k4")
+	assert.NoError(t, err)
+	assert.Equal(t, float64(59), value)
+}
+
+func TestAppendLogUnknownFsync(t *testing.T) {
+	lru := cache.NewLRUCache(4096, 60)
+	defer lru.Close()
+	_, err := lru.EnableAppendLog(filepath.Join(t.TempDir(), "tenant.aof"), "sometimes", 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,95 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"multi-backend-cache/Internal/cache"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Builds a cache of the given policy that holds exactly capacity entries of the size used by fillKeys
+func newPolicyCache(t *testing.T, policy string, capacity int) *cache.LRUCache {
+	entrySize := cache.CalculateSize("k00", []byte(`"value"`))
+	lru, err := cache.NewCacheWithPolicy(capacity*entrySize, 60, policy)
+	assert.NoError(t, err)
+	t.Cleanup(lru.Close)
+	return lru
+}
+
+func cachedKeys(lru *cache.LRUCache, keys ...string) []string {
+	var found []string
+	for _, key := range keys {
+		if _, err := lru.Get(context.Background(), key); err == nil {
+			found = append(found, key)
+		}
+	}
+	return found
+}
+
+func TestUnknownEvictionPolicy(t *testing.T) {
+	_, err := cache.NewCacheWithPolicy(1024, 60, "random")
+	assert.Error(t, err)
+}
+
+// Checks which of three full entries each policy evicts after k00 was read twice and k01 once
+func TestEvictionPolicies(t *testing.T) {
+	tests := []struct {
+		policy  string
+		evicted string
+	}{
+		{cache.PolicyLRU, "k02"},   // least recently used
+		{cache.PolicyFIFO, "k00"},  // oldest insertion, reads are ignored
+		{cache.PolicyLFU, "k02"},   // never read
+		{cache.PolicySIEVE, "k02"}, // the only entry without its visited bit
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			ctx := context.Background()
+			lru := newPolicyCache(t, tt.policy, 3)
+			for i := 0; i < 3; i++ {
+				assert.NoError(t, lru.Set(ctx, fmt.Sprintf("k%02d", i), "value", 60))
+			}
+			lru.Get(ctx, "k00")
+			lru.Get(ctx, "k00")
+			lru.Get(ctx, "k01")
+
+			assert.NoError(t, lru.Set(ctx, "k03", "value", 60))
+
+			remaining := cachedKeys(lru, "k00", "k01", "k02", "k03")
+			assert.Len(t, remaining, 3)
+			assert.NotContains(t, remaining, tt.evicted)
+			used, capacity, _ := lru.Stats()
+			assert.LessOrEqual(t, used, capacity)
+		})
+	}
+}
+
+// A scan of one-hit keys must not flush a frequently read hot set under W-TinyLFU and SIEVE
+func TestEvictionPoliciesResistScans(t *testing.T) {
+	for _, policy := range []string{cache.PolicyWTinyLFU, cache.PolicySIEVE} {
+		t.Run(policy, func(t *testing.T) {
+			ctx := context.Background()
+			lru := newPolicyCache(t, policy, 20)
+			hot := []string{"k00", "k01", "k02", "k03", "k04"}
+			for _, key := range hot {
+				assert.NoError(t, lru.Set(ctx, key, "value", 60))
+			}
+			for round := 0; round < 5; round++ {
+				cachedKeys(lru, hot...)
+			}
+
+			for i := 10; i < 60; i++ {
+				assert.NoError(t, lru.Set(ctx, fmt.Sprintf("k%02d", i), "value", 60))
+				if i%20 == 0 {
+					cachedKeys(lru, hot...)
+				}
+			}
+
+			assert.ElementsMatch(t, hot, cachedKeys(lru, hot...))
+			used, capacity, _ := lru.Stats()
+			assert.LessOrEqual(t, used, capacity)
+		})
+	}
+}
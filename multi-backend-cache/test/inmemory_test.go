@@ -1,14 +1,20 @@
 package test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	handler "multi-backend-cache/Internal/Handler"
 	"multi-backend-cache/Internal/cache"
 	"multi-backend-cache/Internal/config"
+	utils "multi-backend-cache/packageUtils/Utils"
 	"net/http"
 	"net/http/httptest"
-	"reflect"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -24,42 +30,151 @@ func TestIsExpired(t *testing.T) {
 }
 
 func TestCalculateSize(t *testing.T) {
-	// Create a CacheData instance
-	cacheData := &cache.CacheData{
-		Key:        "test_key",
-		Value:      "test_value",
-		TTL:        60,
-		ExpiryTime: time.Now().Add(time.Second * 10),
+	// Sizes grow byte for byte with the key and the encoded value
+	base := cache.CalculateSize("", nil)
+	assert.Greater(t, base, 0, "every entry carries a fixed overhead")
+	assert.Equal(t, base+len("test_key")+len(`"test_value"`), cache.CalculateSize("test_key", []byte(`"test_value"`)))
+	assert.Equal(t, base+1+1000, cache.CalculateSize("k", make([]byte, 1000)))
+}
+
+// Test that eviction keeps the used bytes within the configured capacity
+func TestInMemCapacityAccounting(t *testing.T) {
+	ctx := context.Background()
+	entrySize := cache.CalculateSize("k0", []byte(`"0123456789"`))
+	lru := cache.NewLRUCache(3*entrySize, 10)
+	defer lru.Close()
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, lru.Set(ctx, fmt.Sprintf("k%d", i), "0123456789", 10))
+	}
+	used, capacity, entries := lru.Stats()
+	assert.Equal(t, 3*entrySize, used)
+	assert.Equal(t, 3*entrySize, capacity)
+	assert.Equal(t, 3, entries)
+
+	// The least recently used keys were evicted
+	_, err := lru.Get(ctx, "k0")
+	assert.Error(t, err)
+	_, err = lru.Get(ctx, "k4")
+	assert.NoError(t, err)
+
+	// A value larger than the whole cache is rejected instead of flushing it
+	assert.Equal(t, utils.TooLarge, lru.Set(ctx, "big", strings.Repeat("x", 4*entrySize), 10))
+	_, _, entries = lru.Stats()
+	assert.Equal(t, 3, entries)
+}
+
+// Concurrent writers, readers and deleters on a sharded cache keep its accounting consistent
+func TestInMemConcurrentAccess(t *testing.T) {
+	ctx := context.Background()
+	lru := cache.NewLRUCache(1<<20, 10) // large enough to be split over several shards
+	defer lru.Close()
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := fmt.Sprintf("w%d-k%d", worker, i%50)
+				assert.NoError(t, lru.Set(ctx, key, i, 10))
+				lru.Get(ctx, key)
+				if i%7 == 0 {
+					lru.Delete(ctx, key)
+				}
+			}
+		}(worker)
 	}
+	wg.Wait()
+
+	used, capacity, entries := lru.Stats()
+	assert.Equal(t, 1<<20, capacity)
+	assert.LessOrEqual(t, used, capacity)
+	assert.Equal(t, entries, len(lru.GetAllCache()))
+	value, err := lru.Get(ctx, "w0-k49")
+	assert.NoError(t, err)
+	assert.Equal(t, float64(499), value)
+}
+
+// Expired entries are removed by the janitor without being read
+func TestInMemActiveExpiry(t *testing.T) {
+	config.AppConfig.JanitorInterval = 50
+	defer func() { config.AppConfig.JanitorInterval = 0 }()
+	ctx := context.Background()
+	lru := cache.NewLRUCache(1<<20, 10)
+	defer lru.Close()
+
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, lru.Set(ctx, fmt.Sprintf("short%d", i), i, 1))
+	}
+	assert.NoError(t, lru.Set(ctx, "long", "value", 60))
+
+	assert.Eventually(t, func() bool {
+		_, _, entries := lru.Stats()
+		return entries == 1
+	}, 3*time.Second, 50*time.Millisecond)
+	used, _, _ := lru.Stats()
+	assert.Equal(t, cache.CalculateSize("long", []byte(`"value"`)), used)
+}
+
+// Closing the caches stops their background goroutines
+func TestInMemClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	tenantCaches := newTenantCaches(t, false, 4096)
+	assert.Greater(t, runtime.NumGoroutine(), before)
 
-	// Call the calculateSize function
-	size := cache.CalculateSize(cacheData)
-	expectedSize := int(reflect.TypeOf(*cacheData).Size())
-	if size != expectedSize {
-		t.Errorf("Expected size: %d, got: %d", expectedSize, size)
+	tenantCaches.Close()
+	tenantCaches.Close() // closing twice is harmless
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
 	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before)
 }
 
-// Function to set up Inmemory router, with capacity as 300 bytes and TTL to 10s
-func setupInMemoryRouter() *gin.Engine {
+// Function to create tenant caches with a TTL of 10s, closed when the test ends so that their
+// goroutines are gone before the next test changes the configuration
+func newTenantCaches(t *testing.T, isTenantBased bool, totalCacheMemory int) *cache.FixedTenantsCaches {
+	tenantCaches := cache.NewFixedTenantsCaches(isTenantBased, totalCacheMemory, 10)
+	t.Cleanup(tenantCaches.Close)
+	return tenantCaches
+}
+
+// Function to set up Inmemory router, with capacity as 4KB and TTL to 10s
+func setupInMemoryRouter(t *testing.T) *gin.Engine {
 	// config.LoadConfig("../Internal/config/config.yaml")
 	config.AppConfig.IsTenantBased = false
-	inmemorycache := cache.NewFixedTenantsCaches(false, 300, 10)
-	cacheSystemType := handler.NewServer(inmemorycache, nil, nil)
+	return newInMemoryRouter(newTenantCaches(t, false, 4096))
+}
+
+// Function to set up a router serving the in-memory cache routes over the tenant caches
+func newInMemoryRouter(tenantCaches *cache.FixedTenantsCaches) *gin.Engine {
+	cacheSystemType := handler.NewServer(tenantCaches, nil, nil)
 	router := gin.Default()
 
+	router.GET("/cache/keys", cacheSystemType.ListKeysHandler)
+	router.DELETE("/cache/tags/:tag", cacheSystemType.InvalidateTagHandler)
 	router.GET("/cache/:key", cacheSystemType.GetCacheHandler)
 	router.POST("/cache", cacheSystemType.SetCacheHandler)
 	router.DELETE("/cache/:key", cacheSystemType.DeleteCacheHandler)
-	// router.GET("/cache/TTL/:key", cacheSystemType.GetCacheWithTTLHandler)
+	router.DELETE("/cache", cacheSystemType.DeleteMatchingHandler)
+	router.GET("/cache/jobs/:id", cacheSystemType.GetJobHandler)
+	router.POST("/cache/:key/incr", cacheSystemType.IncrCacheHandler)
+	router.GET("/cache/TTL/:key", cacheSystemType.GetCacheWithTTLHandler)
 	router.PUT("/cache/clear", cacheSystemType.ClearCacheHandler)
+	router.POST("/cache/batch/get", cacheSystemType.BatchGetCacheHandler)
+	router.POST("/cache/batch/set", cacheSystemType.BatchSetCacheHandler)
+	router.POST("/cache/batch/delete", cacheSystemType.BatchDeleteCacheHandler)
+	router.GET("/events", cacheSystemType.EventsHandler)
+	router.POST("/locks/:name", cacheSystemType.AcquireLockHandler)
+	router.POST("/locks/:name/refresh", cacheSystemType.RefreshLockHandler)
+	router.POST("/locks/:name/release", cacheSystemType.ReleaseLockHandler)
 
 	return router
 }
 
 // Test for set function
 func TestInMemPostCacheHandler(t *testing.T) {
-	router := setupInMemoryRouter()
+	router := setupInMemoryRouter(t)
 
 	t.Run("Valid Data", func(t *testing.T) {
 		w := httptest.NewRecorder()
@@ -91,7 +206,7 @@ func TestInMemPostCacheHandler(t *testing.T) {
 
 // Test for get function
 func TestInMemGetCacheHandler(t *testing.T) {
-	router := setupInMemoryRouter()
+	router := setupInMemoryRouter(t)
 
 	// First, post a cache entry
 	w := httptest.NewRecorder()
@@ -148,7 +263,7 @@ func TestInMemGetCacheHandler(t *testing.T) {
 
 // Test to check deleteAPI
 func TestInMemDeleteCacheHandler(t *testing.T) {
-	router := setupInMemoryRouter()
+	router := setupInMemoryRouter(t)
 
 	// First, post a cache entry
 	w := httptest.NewRecorder()
@@ -185,7 +300,7 @@ func TestInMemDeleteCacheHandler(t *testing.T) {
 
 // Test for data expiry with default TTL
 func TestInMemoryDataExpiryWithDefaultTTL(t *testing.T) {
-	router := setupInMemoryRouter()
+	router := setupInMemoryRouter(t)
 
 	w := httptest.NewRecorder()
 	reqBodyExpiry := `{"key": "10", "value": "sessions"}`
@@ -213,7 +328,7 @@ func TestInMemoryDataExpiryWithDefaultTTL(t *testing.T) {
 
 // Test to check clear API
 func TestInMemClearCacheHandler(t *testing.T) {
-	router := setupInMemoryRouter()
+	router := setupInMemoryRouter(t)
 
 	// First, post a cache entry
 	w := httptest.NewRecorder()
@@ -247,41 +362,604 @@ func TestInMemClearCacheHandler(t *testing.T) {
 	assert.Equal(t, http.StatusNotFound, w.Code)
 }
 
-// unc TestGetCacheWithTTLHandler(t *testing.T) {
-// 	router := setupInMemoryRouter()
-
-// 	// First, post a cache entry
-// 	w := httptest.NewRecorder()
-// 	reqBody := `{"key": "2", "value": "session", "ttl": 300}`
-// 	req, _ := http.NewRequest("POST", "/cache?system=inmemory", strings.NewReader(reqBody))
-// 	req.Header.Set("Content-Type", "application/json")
-// 	router.ServeHTTP(w, req)
-// 	assert.Equal(t, http.StatusOK, w.Code)
-
-// 	// Then, get the cache entry
-// 	w = httptest.NewRecorder()
-// 	req, _ = http.NewRequest("GET", "/cache/TTL/2?system=inmemory", nil)
-// 	router.ServeHTTP(w, req)
-// 	assert.Equal(t, http.StatusOK, w.Code)
-
-// 	// Parse the response body
-// 	type CacheDataTemp struct {
-// 		Key        string      `json:"key"`
-// 		Value      interface{} `json:"value"`
-// 		TTL        float64     `json:"ttl"` // Changed TTL type to float64 for unmarshaling
-// 		ExpiryTime time.Time   `json:"expiry_time"`
-// 	}
-// 	var response CacheDataTemp
-// 	err := json.Unmarshal(w.Body.Bytes(), &response)
-// 	assert.NoError(t, err)
-
-// 	expectedExpiryTime := time.Now().Add(300 * time.Second)
-
-// 	// Allow a margin of error in the expiry time due to processing delays
-// 	marginOfError := 2 * time.Second
-// 	assert.WithinDuration(t, expectedExpiryTime, response.ExpiryTime, marginOfError)
-// 	tolerance := 2.0
-// 	assert.Equal(t, "session", response.Value)
-// 	expectedTTL := expectedExpiryTime.Sub(time.Now()).Seconds()
-// 	assert.InDelta(t, time.Duration(expectedTTL), time.Duration(response.TTL), tolerance) //added tolerance for delays
-// }
+// Test that a cancelled request context is honoured by the in-memory backend
+func TestInMemCancelledContext(t *testing.T) {
+	lru := cache.NewLRUCache(300, 10)
+	defer lru.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := lru.Set(ctx, "1", "value", 10)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	_, err = lru.Get(ctx, "1")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	_, err = lru.Get(context.Background(), "1")
+	assert.Error(t, err, "set with a cancelled context must not store the value")
+}
+
+// Test for get with TTL function
+func TestGetCacheWithTTLHandler(t *testing.T) {
+	router := setupInMemoryRouter(t)
+
+	// First, post a cache entry
+	w := httptest.NewRecorder()
+	reqBody := `{"key": "2", "value": "session", "ttl": 300}`
+	req, _ := http.NewRequest("POST", "/cache?system=inmemory", strings.NewReader(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Then, get the cache entry
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/cache/TTL/2?system=inmemory", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Parse the response body
+	type CacheDataTemp struct {
+		Key        string      `json:"key"`
+		Value      interface{} `json:"value"`
+		TTL        float64     `json:"ttl"` // Changed TTL type to float64 for unmarshaling
+		ExpiryTime time.Time   `json:"expiry_time"`
+	}
+	var response CacheDataTemp
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+
+	expectedExpiryTime := time.Now().Add(300 * time.Second)
+
+	// Allow a margin of error in the expiry time due to processing delays
+	marginOfError := 2 * time.Second
+	assert.WithinDuration(t, expectedExpiryTime, response.ExpiryTime, marginOfError)
+	tolerance := 2.0
+	assert.Equal(t, "session", response.Value)
+	expectedTTL := time.Until(expectedExpiryTime).Seconds()
+	assert.InDelta(t, expectedTTL, response.TTL, tolerance) //added tolerance for delays
+
+	t.Run("InValid Key", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/cache/TTL/3?system=inmemory", nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+// Test for batch set, get and delete
+func TestInMemBatchHandlers(t *testing.T) {
+	router := setupInMemoryRouter(t)
+
+	w := httptest.NewRecorder()
+	reqBody := `{"items": [{"key": "b1", "value": "one", "ttl": 300}, {"key": "b2", "value": {"id": 2}, "ttl": 300}]}`
+	req, _ := http.NewRequest("POST", "/cache/batch/set?system=inmemory", strings.NewReader(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	t.Run("Get existing and missing keys", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/cache/batch/get?system=inmemory", strings.NewReader(`{"keys": ["b1", "b2", "b3"]}`))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"values": {"b1": "one", "b2": {"id": 2}}, "missing": ["b3"]}`, w.Body.String())
+	})
+
+	t.Run("Empty batch", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/cache/batch/get?system=inmemory", strings.NewReader(`{"keys": []}`))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Delete keys", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/cache/batch/delete?system=inmemory", strings.NewReader(`{"keys": ["b1", "b3"]}`))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"deleted": 1}`, w.Body.String())
+
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/cache/b1?system=inmemory", nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+// Entries set with a soft TTL turn stale after it and are still returned until their TTL
+func TestInMemSoftTTL(t *testing.T) {
+	ctx := context.Background()
+	lru := cache.NewLRUCache(1<<20, 10)
+	defer lru.Close()
+	assert.NoError(t, lru.SetWithSoftTTL(ctx, "1", "session", 1, 60))
+	assert.NoError(t, lru.SetMany(ctx, []cache.CacheData{{Key: "2", Value: "cart", TTL: 60, SoftTTL: 1}}))
+	// A soft TTL not shorter than the TTL never turns the entry stale
+	assert.NoError(t, lru.SetWithSoftTTL(ctx, "3", "profile", 60, 60))
+
+	for _, key := range []string{"1", "2", "3"} {
+		item, err := lru.GetItem(ctx, key)
+		assert.NoError(t, err)
+		assert.False(t, item.Stale())
+	}
+	time.Sleep(1100 * time.Millisecond)
+	for key, stale := range map[string]bool{"1": true, "2": true, "3": false} {
+		item, err := lru.GetItem(ctx, key)
+		assert.NoError(t, err)
+		assert.Equal(t, stale, item.Stale(), key)
+		assert.WithinDuration(t, time.Now().Add(59*time.Second), item.ExpiryTime, 2*time.Second)
+	}
+}
+
+// Writes and deletes with If-Match or If-None-Match only apply to the entry they expect
+func TestInMemConditionalWrites(t *testing.T) {
+	router := setupInMemoryRouter(t)
+	request := func(method string, url string, body string, header string, etag string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if header != "" {
+			req.Header.Set(header, etag)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// If-None-Match: * only creates the entry
+	w := request("POST", "/cache?system=inmemory", `{"key": "v", "value": 1, "ttl": 300}`, "If-None-Match", "*")
+	assert.Equal(t, http.StatusOK, w.Code)
+	first := w.Header().Get("ETag")
+	assert.NotEmpty(t, first)
+	w = request("POST", "/cache?system=inmemory", `{"key": "v", "value": 2, "ttl": 300}`, "If-None-Match", "*")
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+	w = request("GET", "/cache/v?system=inmemory", "", "", "")
+	assert.Equal(t, first, w.Header().Get("ETag"))
+
+	// Only the writer holding the current ETag wins
+	w = request("POST", "/cache?system=inmemory", `{"key": "v", "value": 2, "ttl": 300}`, "If-Match", first)
+	assert.Equal(t, http.StatusOK, w.Code)
+	second := w.Header().Get("ETag")
+	assert.NotEqual(t, first, second)
+	w = request("POST", "/cache?system=inmemory", `{"key": "v", "value": 3, "ttl": 300}`, "If-Match", first)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	w = request("GET", "/cache/v?system=inmemory", "", "", "")
+	assert.Equal(t, "2\n", w.Body.String())
+	assert.Equal(t, second, w.Header().Get("ETag"))
+
+	// If-Match never matches a missing entry, nor a weak tag
+	w = request("POST", "/cache?system=inmemory", `{"key": "w", "value": 1, "ttl": 300}`, "If-Match", "*")
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	w = request("POST", "/cache?system=inmemory", `{"key": "v", "value": 3, "ttl": 300}`, "If-Match", "W/"+second)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	w = request("POST", "/cache?system=inmemory", `{"key": "v", "value": 3, "ttl": 300}`, "If-Match", "12")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request("DELETE", "/cache/v?system=inmemory", "", "If-Match", first)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	w = request("DELETE", "/cache/v?system=inmemory", "", "If-Match", first+", "+second)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = request("DELETE", "/cache/v?system=inmemory", "", "If-None-Match", second)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// Concurrent increments are not lost, and only integers can be incremented
+func TestInMemIncrCacheHandler(t *testing.T) {
+	router := setupInMemoryRouter(t)
+	incr := func(key string, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/cache/"+key+"/incr?system=inmemory", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := incr("hits", `{"delta": 5, "initial": 10, "ttl": 300}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"value": 15}`, w.Body.String())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			incr("hits", "")
+		}()
+	}
+	wg.Wait()
+	w = incr("hits", `{"delta": -65}`)
+	assert.JSONEq(t, `{"value": 0}`, w.Body.String())
+
+	// The counter is a plain value, which keeps the TTL it was created with
+	req, _ := http.NewRequest("GET", "/cache/TTL/hits?system=inmemory", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var body map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, float64(0), body["value"])
+	assert.Greater(t, body["ttl"], float64(290))
+
+	req, _ = http.NewRequest("POST", "/cache?system=inmemory", strings.NewReader(`{"key": "name", "value": "Ada", "ttl": 300}`))
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	w = incr("name", "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = incr("hits", `{"delta": 9223372036854775807}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = incr("hits", `{"delta": 1}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+// Pages smaller than the shards return every key exactly once
+func TestInMemScanPages(t *testing.T) {
+	ctx := context.Background()
+	lru := cache.NewLRUCache(1<<20, 10) // large enough to be split over several shards
+	defer lru.Close()
+	want := make([]string, 500)
+	for i := range want {
+		want[i] = fmt.Sprintf("key:%03d", i)
+		assert.NoError(t, lru.Set(ctx, want[i], i, 300))
+	}
+
+	got := []string{}
+	cursor := ""
+	for pages := 0; ; pages++ {
+		keys, next, err := lru.Scan(ctx, cursor, "", 7)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(keys), 7)
+		got = append(got, keys...)
+		if cursor = next; cursor == "" {
+			break
+		}
+		assert.Less(t, pages, 200, "the scan must end")
+	}
+	assert.Len(t, got, len(want))
+	assert.ElementsMatch(t, want, got)
+}
+
+// Add only creates entries and replace only updates them, answering 409 otherwise
+func TestInMemWriteModes(t *testing.T) {
+	router := setupInMemoryRouter(t)
+	set := func(mode string, value string) int {
+		body := `{"key": "job", "value": "` + value + `", "ttl": 300}`
+		req, _ := http.NewRequest("POST", "/cache?system=inmemory&mode="+mode, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusConflict, set("replace", "a"))
+	assert.Equal(t, http.StatusOK, set("add", "a"))
+	assert.Equal(t, http.StatusConflict, set("add", "b"))
+	assert.Equal(t, http.StatusOK, set("replace", "c"))
+	assert.Equal(t, http.StatusOK, set("upsert", "d"))
+	assert.Equal(t, http.StatusBadRequest, set("merge", "e"))
+
+	req, _ := http.NewRequest("GET", "/cache/job?system=inmemory", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "\"d\"\n", w.Body.String())
+
+	// Only one of concurrent adds wins
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	created := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"key": "dedup", "value": %d, "ttl": 300}`, i)
+			req, _ := http.NewRequest("POST", "/cache?system=inmemory&mode=add", strings.NewReader(body))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code == http.StatusOK {
+				lock.Lock()
+				created++
+				lock.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, created)
+}
+
+func TestInMemListKeys(t *testing.T) {
+	router := setupInMemoryRouter(t)
+	want := []string{}
+	// Few enough keys for the 4096 bytes of the cache
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("user:%02d", i)
+		want = append(want, key)
+		body := `{"key": "` + key + `", "value": "v", "ttl": 300}`
+		req, _ := http.NewRequest("POST", "/cache?system=inmemory", strings.NewReader(body))
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	for _, key := range []string{"order:1", "user:x", "user:[1]"} {
+		body := `{"key": "` + key + `", "value": "v", "ttl": 300}`
+		req, _ := http.NewRequest("POST", "/cache?system=inmemory", strings.NewReader(body))
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	list := func(query string) (int, []string, string) {
+		req, _ := http.NewRequest("GET", "/cache/keys?system=inmemory&"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var page struct {
+			Keys   []string `json:"keys"`
+			Cursor string   `json:"cursor"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &page)
+		return w.Code, page.Keys, page.Cursor
+	}
+
+	t.Run("Pages until the cursor is empty", func(t *testing.T) {
+		got := []string{}
+		cursor := ""
+		for pages := 0; ; pages++ {
+			code, keys, next := list("match=user:[0-9][0-9]&count=3&cursor=" + cursor)
+			assert.Equal(t, http.StatusOK, code)
+			assert.LessOrEqual(t, len(keys), 3)
+			got = append(got, keys...)
+			if cursor = next; cursor == "" {
+				break
+			}
+			assert.Less(t, pages, 10, "the scan must end")
+		}
+		assert.ElementsMatch(t, want, got)
+	})
+
+	t.Run("Glob patterns", func(t *testing.T) {
+		_, keys, _ := list("match=order:*")
+		assert.Equal(t, []string{"order:1"}, keys)
+		_, keys, _ = list("match=user:?")
+		assert.Equal(t, []string{"user:x"}, keys)
+		_, keys, _ = list("match=user:[^0-9]")
+		assert.Equal(t, []string{"user:x"}, keys)
+		_, keys, _ = list(`match=user:\[1\]`)
+		assert.Equal(t, []string{"user:[1]"}, keys)
+		_, keys, _ = list("match=*")
+		assert.Len(t, keys, 13)
+	})
+
+	t.Run("Invalid requests", func(t *testing.T) {
+		code, _, _ := list("cursor=not-a-cursor")
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _, _ = list("count=0")
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _, _ = list("count=1001")
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+}
+
+func TestInMemTags(t *testing.T) {
+	router := setupInMemoryRouter(t)
+	request := func(method string, url string, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	for key, tags := range map[string]string{
+		"product:42":         `["product:42"]`,
+		"product:42:reviews": `["product:42", "user:7"]`,
+		"user:7":             `["user:7"]`,
+		"home":               `[]`,
+	} {
+		w := request("POST", "/cache?system=inmemory", `{"key": "`+key+`", "value": "v", "ttl": 300, "tags": `+tags+`}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	w := request("DELETE", "/cache/tags/product:42?system=inmemory", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "ok", "deleted": 2}`, w.Body.String())
+	for key, code := range map[string]int{"product:42": 404, "product:42:reviews": 404, "user:7": 200, "home": 200} {
+		assert.Equal(t, code, request("GET", "/cache/"+key+"?system=inmemory", "").Code, key)
+	}
+
+	// Writing a key again keeps its tags
+	request("POST", "/cache?system=inmemory", `{"key": "user:7", "value": "w", "ttl": 300}`)
+	w = request("DELETE", "/cache/tags/user:7?system=inmemory", "")
+	assert.JSONEq(t, `{"status": "ok", "deleted": 1}`, w.Body.String())
+	assert.Equal(t, http.StatusNotFound, request("GET", "/cache/user:7?system=inmemory", "").Code)
+
+	t.Run("Invalid tags", func(t *testing.T) {
+		w := request("POST", "/cache?system=inmemory", `{"key": "k", "value": "v", "tags": ["a b"]}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w = request("POST", "/cache?system=inmemory", `{"key": "k", "value": "v", "tags": [""]}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w = request("POST", "/cache/batch/set?system=inmemory", `{"items": [{"key": "k", "value": "v", "tags": ["a"]}]}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Tag keys are reserved", func(t *testing.T) {
+		w := request("POST", "/cache?system=inmemory", `{"key": "__tag__:user:7", "value": "v"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, http.StatusBadRequest, request("GET", "/cache/__tag__:user:7?system=inmemory", "").Code)
+		w = request("POST", "/cache/batch/get?system=inmemory", `{"keys": ["__tag__:user:7"]}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Evicted entries leave the tag", func(t *testing.T) {
+		ctx := context.Background()
+		entrySize := cache.CalculateSize("k0", []byte(`"0123456789"`))
+		lru := cache.NewLRUCache(3*entrySize, 10)
+		defer lru.Close()
+		for i := 0; i < 5; i++ {
+			_, err := lru.SetTagged(ctx, fmt.Sprintf("k%d", i), "0123456789", 0, 10, cache.Condition{}, []string{"batch"})
+			assert.NoError(t, err)
+		}
+		deleted, err := lru.InvalidateTag(ctx, "batch")
+		assert.NoError(t, err)
+		assert.Equal(t, 3, deleted)
+		_, _, entries := lru.Stats()
+		assert.Equal(t, 0, entries)
+	})
+}
+
+func TestInMemDeleteMatching(t *testing.T) {
+	router := setupInMemoryRouter(t)
+	request := func(method string, url string, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	for _, key := range []string{"session:1", "session:2", "session:3", "sessions", "user:1"} {
+		w := request("POST", "/cache?system=inmemory", `{"key": "`+key+`", "value": "v", "ttl": 300}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	w := request("DELETE", "/cache?system=inmemory&match=session:*", "")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.NotContains(t, w.Body.String(), "finished_at", "a running job has not finished")
+	var job handler.Job
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+	assert.NotEmpty(t, job.ID)
+	location := w.Header().Get("Location")
+	assert.Equal(t, "/cache/jobs/"+job.ID+"?system=inmemory", location)
+
+	// The job runs in the background
+	assert.Eventually(t, func() bool {
+		w := request("GET", location, "")
+		json.Unmarshal(w.Body.Bytes(), &job)
+		return w.Code == http.StatusOK && job.Status != handler.JobRunning
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, handler.JobDone, job.Status)
+	assert.Equal(t, 3, job.Deleted)
+	assert.NotNil(t, job.FinishedAt)
+	for key, code := range map[string]int{"session:1": 404, "session:2": 404, "session:3": 404, "sessions": 200, "user:1": 200} {
+		assert.Equal(t, code, request("GET", "/cache/"+key+"?system=inmemory", "").Code, key)
+	}
+
+	t.Run("Invalid requests", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, request("DELETE", "/cache?system=inmemory", "").Code)
+		assert.Equal(t, http.StatusNotFound, request("GET", "/cache/jobs/unknown?system=inmemory", "").Code)
+		// Jobs are only visible to their own cache system
+		assert.Equal(t, http.StatusNotFound, request("GET", "/cache/jobs/"+job.ID+"?system=redis", "").Code)
+	})
+}
+
+// A backend deleting one page of keys, then waiting for its context on the next
+type interruptedDeleter struct {
+	*cache.LRUCache
+	waiting chan struct{}
+}
+
+func (d *interruptedDeleter) DeleteMatching(ctx context.Context, cursor string, match string, count int) (int, string, error) {
+	if cursor == "" {
+		return 2, "next", nil
+	}
+	close(d.waiting)
+	<-ctx.Done()
+	return 0, "", ctx.Err()
+}
+
+// Jobs interrupted by the shutdown of the server are cancelled with the keys they deleted so far,
+// and no job starts afterwards
+func TestDeleteMatchingShutdown(t *testing.T) {
+	lru := cache.NewLRUCache(1<<20, 10)
+	defer lru.Close()
+	deleter := &interruptedDeleter{LRUCache: lru, waiting: make(chan struct{})}
+	server := handler.NewServer(newTenantCaches(t, false, 1<<20), deleter, nil)
+	router := gin.Default()
+	router.DELETE("/cache", server.DeleteMatchingHandler)
+	router.GET("/cache/jobs/:id", server.GetJobHandler)
+	request := func(method string, url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("DELETE", "/cache?system=redis&match=session:*")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var job handler.Job
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+	<-deleter.waiting
+	server.Shutdown()
+
+	w = request("GET", w.Header().Get("Location"))
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+	assert.Equal(t, handler.JobCancelled, job.Status)
+	assert.Equal(t, 2, job.Deleted)
+	assert.Equal(t, utils.ShuttingDown.Error(), job.Error)
+	assert.NotNil(t, job.FinishedAt)
+
+	assert.Equal(t, http.StatusServiceUnavailable, request("DELETE", "/cache?system=redis&match=session:*").Code)
+}
+
+func TestInMemWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	entrySize := cache.CalculateSize("user:0", []byte(`"0123456789"`))
+	lru := cache.NewLRUCache(2*entrySize, 10)
+	defer lru.Close()
+	events, err := lru.Watch(ctx, "user:*")
+	assert.NoError(t, err)
+	next := func() cache.Event {
+		select {
+		case event := <-events:
+			return cache.Event{Type: event.Type, Key: event.Key}
+		case <-time.After(3 * time.Second):
+			return cache.Event{}
+		}
+	}
+
+	lru.Set(ctx, "user:1", "0123456789", 10)
+	lru.Set(ctx, "item:1", "0123456789", 10) // not watched
+	lru.Delete(ctx, "user:1")
+	lru.Set(ctx, "user:2", "0123456789", 10)
+	lru.Set(ctx, "user:3", "0123456789", 10) // evicts item:1
+	lru.Set(ctx, "user:4", "0123456789", 10) // evicts user:2
+	lru.Set(ctx, "user:5", "0123456789", 1)  // evicts user:3
+	for _, want := range []cache.Event{
+		{Type: cache.EventSet, Key: "user:1"},
+		{Type: cache.EventDelete, Key: "user:1"},
+		{Type: cache.EventSet, Key: "user:2"},
+		{Type: cache.EventSet, Key: "user:3"},
+		{Type: cache.EventSet, Key: "user:4"},
+		{Type: cache.EventEvict, Key: "user:2"},
+		{Type: cache.EventSet, Key: "user:5"},
+		{Type: cache.EventEvict, Key: "user:3"},
+		{Type: cache.EventExpire, Key: "user:5"}, // removed by the janitor
+	} {
+		assert.Equal(t, want, next())
+	}
+	lru.Clear(ctx)
+	assert.Equal(t, cache.Event{Type: cache.EventClear}, next())
+
+	// The channel is closed once the context is done
+	cancel()
+	assert.Eventually(t, func() bool {
+		_, open := <-events
+		return !open
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestInMemEventsHandler(t *testing.T) {
+	server := httptest.NewServer(setupInMemoryRouter(t))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events?system=inmemory&match=user:*")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	for _, key := range []string{"order:1", "user:1"} {
+		body := `{"key": "` + key + `", "value": "v", "ttl": 300}`
+		post, err := http.Post(server.URL+"/cache?system=inmemory", "application/json", strings.NewReader(body))
+		assert.NoError(t, err)
+		post.Body.Close()
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "event:set\n", line)
+	line, err = reader.ReadString('\n')
+	assert.NoError(t, err)
+	var event cache.Event
+	assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &event))
+	assert.Equal(t, "user:1", event.Key)
+}
@@ -2,12 +2,16 @@ package test
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	handler "multi-backend-cache/Internal/Handler"
 	"multi-backend-cache/Internal/cache"
 	"multi-backend-cache/Internal/config"
+	utils "multi-backend-cache/packageUtils/Utils"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -15,26 +19,30 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-// Function to set up Inmemory router, with capacity as 300 bytes and TTL to 10s
-func setupInMemoryTenantRouter() *gin.Engine {
+// Function to set up Inmemory router, with capacity as 4KB per tenant and TTL to 10s
+func setupInMemoryTenantRouter(t *testing.T) *gin.Engine {
 	config.LoadConfig("../Internal/config/config.yaml")
 	config.AppConfig.IsTenantBased = true
-	inmemorycache := cache.NewFixedTenantsCaches(true, 900, 10)
+	config.AppConfig.SnapshotDir = "" // keep the tests independent of earlier runs
+	inmemorycache := newTenantCaches(t, true, 3*4096)
 	cacheSystemType := handler.NewServer(inmemorycache, nil, nil)
 	router := gin.Default()
-	router.Use(handler.ValidateTenant())
+	router.Use(handler.ValidateTenant(inmemorycache))
 	router.GET("/cache/:key", cacheSystemType.GetCacheHandler)
 	router.POST("/cache", cacheSystemType.SetCacheHandler)
 	router.DELETE("/cache/:key", cacheSystemType.DeleteCacheHandler)
-	// router.GET("/cache/TTL/:key", cacheSystemType.GetCacheWithTTLHandler)
+	router.GET("/cache/TTL/:key", cacheSystemType.GetCacheWithTTLHandler)
 	router.PUT("/cache/clear", cacheSystemType.ClearCacheHandler)
+	router.POST("/cache/batch/get", cacheSystemType.BatchGetCacheHandler)
+	router.POST("/cache/batch/set", cacheSystemType.BatchSetCacheHandler)
+	router.POST("/cache/batch/delete", cacheSystemType.BatchDeleteCacheHandler)
 
 	return router
 }
 
 // Test for set function
 func TestInMemTenantPostCacheHandler(t *testing.T) {
-	router := setupInMemoryTenantRouter()
+	router := setupInMemoryTenantRouter(t)
 
 	t.Run("Valid Data", func(t *testing.T) {
 		w := httptest.NewRecorder()
@@ -81,7 +89,7 @@ func TestInMemTenantPostCacheHandler(t *testing.T) {
 
 // Test for get function
 func TestInMemTenantGetCacheHandler(t *testing.T) {
-	router := setupInMemoryTenantRouter()
+	router := setupInMemoryTenantRouter(t)
 
 	// First, post a cache entry
 	w := httptest.NewRecorder()
@@ -126,7 +134,7 @@ func TestInMemTenantGetCacheHandler(t *testing.T) {
 
 // Test to check deleteAPI
 func TestInMemTenantDeleteCacheHandler(t *testing.T) {
-	router := setupInMemoryTenantRouter()
+	router := setupInMemoryTenantRouter(t)
 
 	// post a cache entry in tenant 1
 	w := httptest.NewRecorder()
@@ -171,7 +179,7 @@ func TestInMemTenantDeleteCacheHandler(t *testing.T) {
 
 // Test for data expiry with default TTL
 func TestInMemoryTenantDataExpiryWithDefaultTTL(t *testing.T) {
-	router := setupInMemoryTenantRouter()
+	router := setupInMemoryTenantRouter(t)
 
 	w := httptest.NewRecorder()
 	reqBodyExpiry := `{"key": "10", "value": "sessions"}`
@@ -199,7 +207,7 @@ func TestInMemoryTenantDataExpiryWithDefaultTTL(t *testing.T) {
 
 // Test to check clear API
 func TestInMemTenantClearCacheHandler(t *testing.T) {
-	router := setupInMemoryTenantRouter()
+	router := setupInMemoryTenantRouter(t)
 
 	// First, post a cache entry in tenant1
 	w := httptest.NewRecorder()
@@ -258,3 +266,217 @@ func TestInMemTenantClearCacheHandler(t *testing.T) {
 	router.ServeHTTP(w, req)
 	assert.Equal(t, http.StatusOK, w.Code)
 }
+
+// Sends an admin request and returns the recorder
+func tenantRequest(router *gin.Engine, method string, url string, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// Returns the capacity of every tenant listed by the admin API
+func tenantCapacities(t *testing.T, router *gin.Engine) map[string]int {
+	w := tenantRequest(router, "GET", "/admin/tenants", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var listing struct {
+		Tenants []cache.TenantInfo `json:"tenants"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &listing))
+	capacities := make(map[string]int)
+	for _, tenant := range listing.Tenants {
+		capacities[tenant.TenantID] = tenant.Capacity
+	}
+	return capacities
+}
+
+// Tenants created, resized and deleted at runtime are rebalanced and seen by the tenant validation
+func TestInMemTenantProvisioning(t *testing.T) {
+	config.LoadConfig("../Internal/config/config.yaml")
+	config.AppConfig.IsTenantBased = true
+	config.AppConfig.SnapshotDir = ""
+	config.AppConfig.MemoryUsagePercentage = 0 // keep the total memory fixed
+	tenantCaches := newTenantCaches(t, true, 3*32768)
+	server := handler.NewServer(tenantCaches, nil, nil)
+	router := gin.Default()
+	router.GET("/admin/tenants", server.ListTenantsHandler)
+	router.POST("/admin/tenants", server.CreateTenantHandler)
+	router.PUT("/admin/tenants/:tenantID", server.ResizeTenantHandler)
+	router.DELETE("/admin/tenants/:tenantID", server.DeleteTenantHandler)
+	router.Use(handler.ValidateTenant(tenantCaches))
+	router.GET("/cache/:key", server.GetCacheHandler)
+	router.POST("/cache", server.SetCacheHandler)
+
+	assert.Equal(t, map[string]int{"tenant1": 32768, "tenant2": 32768, "tenant3": 32768}, tenantCapacities(t, router))
+
+	t.Run("Create", func(t *testing.T) {
+		w := tenantRequest(router, "POST", "/admin/tenants", `{"tenantID": "tenant4"}`)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, map[string]int{"tenant1": 24576, "tenant2": 24576, "tenant3": 24576, "tenant4": 24576}, tenantCapacities(t, router))
+
+		w = tenantRequest(router, "POST", "/cache?system=inmemory&tenantID=tenant4", `{"key": "1", "value": "session", "ttl": 300}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = tenantRequest(router, "POST", "/admin/tenants", `{"tenantID": "tenant4"}`)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		w = tenantRequest(router, "POST", "/admin/tenants", `{"tenantID": "../tenant"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Resize", func(t *testing.T) {
+		w := tenantRequest(router, "PUT", "/admin/tenants/tenant1", `{"capacity": 49152}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, map[string]int{"tenant1": 49152, "tenant2": 16384, "tenant3": 16384, "tenant4": 16384}, tenantCapacities(t, router))
+
+		w = tenantRequest(router, "PUT", "/admin/tenants/tenant1", `{"capacity": 1048576}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w = tenantRequest(router, "PUT", "/admin/tenants/tenant9", `{"capacity": 8192}`)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		w := tenantRequest(router, "DELETE", "/admin/tenants/tenant4", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, map[string]int{"tenant1": 49152, "tenant2": 24576, "tenant3": 24576}, tenantCapacities(t, router))
+
+		w = tenantRequest(router, "GET", "/cache/1?system=inmemory&tenantID=tenant4", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Contains(t, w.Body.String(), "Tenant Not Found")
+		w = tenantRequest(router, "DELETE", "/admin/tenants/tenant4", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+// Quotas are fixed, the other tenants split the rest by weight without going below their minimum
+func TestInMemTenantQuotas(t *testing.T) {
+	config.LoadConfig("../Internal/config/config.yaml")
+	config.AppConfig.IsTenantBased = true
+	config.AppConfig.SnapshotDir = ""
+	config.AppConfig.MemoryUsagePercentage = 0
+	config.AppConfig.Tenants = map[string]config.TenantConfig{
+		"tenant1": {Quota: 40960},
+		"tenant2": {Weight: 3},
+		"tenant3": {MinCapacity: 20480},
+	}
+	defer func() { config.AppConfig.Tenants = nil }()
+	tenantCaches := newTenantCaches(t, true, 3*32768)
+
+	capacities := func() map[string]int {
+		capacities := make(map[string]int)
+		for _, tenant := range tenantCaches.Tenants() {
+			capacities[tenant.TenantID] = tenant.Capacity
+		}
+		return capacities
+	}
+	// tenant3 would get a quarter of the 57344 bytes left, below its minimum
+	assert.Equal(t, map[string]int{"tenant1": 40960, "tenant2": 36864, "tenant3": 20480}, capacities())
+
+	t.Run("Resize", func(t *testing.T) {
+		assert.NoError(t, tenantCaches.ResizeTenant("tenant1", 24576))
+		assert.Equal(t, map[string]int{"tenant1": 24576, "tenant2": 53248, "tenant3": 20480}, capacities())
+		// Back to the configured quota
+		assert.NoError(t, tenantCaches.ResizeTenant("tenant1", 0))
+		assert.Equal(t, map[string]int{"tenant1": 40960, "tenant2": 36864, "tenant3": 20480}, capacities())
+	})
+
+	t.Run("Minimums", func(t *testing.T) {
+		config.AppConfig.Tenants["tenant4"] = config.TenantConfig{MinCapacity: 40000}
+		assert.Error(t, tenantCaches.AddTenant("tenant4", 0))
+		assert.Error(t, tenantCaches.ResizeTenant("tenant3", 8192))
+		assert.Equal(t, map[string]int{"tenant1": 40960, "tenant2": 36864, "tenant3": 20480}, capacities())
+	})
+}
+
+// A tenant removed and added again starts empty, even when the two race: the ID stays reserved
+// until the append-only log of the removed tenant is gone
+func TestInMemTenantReAdd(t *testing.T) {
+	config.LoadConfig("../Internal/config/config.yaml")
+	config.AppConfig.IsTenantBased = true
+	config.AppConfig.SnapshotDir = ""
+	config.AppConfig.MemoryUsagePercentage = 0
+	config.AppConfig.AOFDir = t.TempDir()
+	config.AppConfig.Tenants = map[string]config.TenantConfig{"tenant4": {AOF: true, AOFFsync: cache.FsyncAlways}}
+	defer func() { config.AppConfig.Tenants = nil }()
+	tenantCaches := newTenantCaches(t, true, 3*32768)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				err := tenantCaches.AddTenant("tenant4", 0)
+				if err == utils.TenantExists {
+					continue
+				}
+				if !assert.NoError(t, err) {
+					return
+				}
+				tenantCache := tenantCaches.GetCache("tenant4")
+				_, err = tenantCache.Get(ctx, "1")
+				assert.Equal(t, utils.NotFound, err, "the data of the removed tenant came back")
+				assert.NoError(t, tenantCache.Set(ctx, "1", "session", 300))
+				assert.NoError(t, tenantCaches.RemoveTenant("tenant4"))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Function to set up a tenant based router in front of the remote backends
+func setupRemoteTenantRouter(t *testing.T) *gin.Engine {
+	config.LoadConfig("../Internal/config/config.yaml")
+	config.AppConfig.IsTenantBased = true
+	config.AppConfig.SnapshotDir = ""
+	tenantCaches := newTenantCaches(t, true, 3*4096)
+	redisCache := cache.NewRedisCache("localhost:6379", "", 0, 10*time.Second)
+	memCache := cache.NewMemCache("localhost:11211", 10)
+	server := handler.NewServer(tenantCaches, redisCache, memCache)
+	router := gin.Default()
+	router.Use(handler.ValidateTenant(tenantCaches))
+	router.GET("/cache/:key", server.GetCacheHandler)
+	router.POST("/cache", server.SetCacheHandler)
+	router.PUT("/cache/clear", server.ClearCacheHandler)
+	router.POST("/cache/batch/get", server.BatchGetCacheHandler)
+	return router
+}
+
+// Shared by the Redis and memcache tests, which need a running server
+func testRemoteTenantIsolation(t *testing.T, system string) {
+	router := setupRemoteTenantRouter(t)
+	defer func() { config.AppConfig.IsTenantBased = false }()
+
+	for _, tenantID := range []string{"tenant1", "tenant2"} {
+		w := tenantRequest(router, "POST", "/cache?system="+system+"&tenantID="+tenantID, `{"key": "1", "value": "`+tenantID+`", "ttl": 300}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	w := tenantRequest(router, "GET", "/cache/1?system="+system+"&tenantID=tenant2", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"tenant2"`, w.Body.String())
+	w = tenantRequest(router, "POST", "/cache/batch/get?system="+system+"&tenantID=tenant1", `{"keys": ["1"]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"tenant1"`)
+
+	w = tenantRequest(router, "PUT", "/cache/clear?system="+system+"&tenantID=tenant1", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = tenantRequest(router, "GET", "/cache/1?system="+system+"&tenantID=tenant1", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = tenantRequest(router, "GET", "/cache/1?system="+system+"&tenantID=tenant2", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+// Unknown tenants are rejected for every cache system, before any backend is reached
+func TestRemoteTenantValidation(t *testing.T) {
+	router := setupRemoteTenantRouter(t)
+	defer func() { config.AppConfig.IsTenantBased = false }()
+
+	for _, system := range []string{"redis", "memcache"} {
+		w := tenantRequest(router, "GET", "/cache/1?system="+system+"&tenantID=tenant9", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Contains(t, w.Body.String(), "Tenant Not Found")
+		w = tenantRequest(router, "PUT", "/cache/clear?system="+system, "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	}
+}
@@ -0,0 +1,210 @@
+package test
+
+import (
+	"context"
+	handler "multi-backend-cache/Internal/Handler"
+	"multi-backend-cache/Internal/cache"
+	"multi-backend-cache/Internal/config"
+	utils "multi-backend-cache/packageUtils/Utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// The secret shared by the replicas of the tests
+const replicaSecret = "replica-secret"
+
+// A replica of the service: its tenant caches and the server receiving the invalidations of its peers
+type replica struct {
+	caches *cache.FixedTenantsCaches
+	server *httptest.Server
+}
+
+// Function to start replicas of the service, each receiving the invalidations of its peers
+func startReplicas(t *testing.T, count int) []*replica {
+	config.AppConfig.IsTenantBased = false
+	config.AppConfig.Invalidation.Secret = replicaSecret
+	replicas := make([]*replica, count)
+	for i := range replicas {
+		tenantCaches := newTenantCaches(t, false, 1<<20)
+		router := gin.Default()
+		router.POST(cache.InvalidationPath, handler.NewServer(tenantCaches, nil, nil).InvalidationHandler)
+		r := &replica{caches: tenantCaches, server: httptest.NewServer(router)}
+		t.Cleanup(r.server.Close)
+		replicas[i] = r
+	}
+	return replicas
+}
+
+// Function to make every replica post its invalidations to the others
+func connectReplicas(replicas []*replica) {
+	for i, r := range replicas {
+		var peers []string
+		for j, peer := range replicas {
+			if j != i {
+				peers = append(peers, peer.server.URL)
+			}
+		}
+		r.caches.EnableInvalidation(config.InvalidationConfig{Peers: peers, Timeout: 1000}, cache.NewPeerInvalidationBus(peers, replicaSecret))
+	}
+}
+
+// Reports whether the default tenant cache of the replica holds the key
+func holds(r *replica, key string) bool {
+	_, err := r.caches.GetCache(cache.DefaultTenant).Get(context.Background(), key)
+	return err == nil
+}
+
+// Writes on one replica drop the key from the others, which do not echo the invalidation back
+func TestInvalidationBus(t *testing.T) {
+	replicas := startReplicas(t, 3)
+	ctx := context.Background()
+	for _, r := range replicas {
+		lru := r.caches.GetCache(cache.DefaultTenant)
+		assert.NoError(t, lru.Set(ctx, "user:1", "old", 60))
+		assert.NoError(t, lru.Set(ctx, "user:2", "old", 60))
+	}
+	assert.NoError(t, replicas[2].caches.GetCache(cache.DefaultTenant).Set(ctx, "user:3", "old", 60))
+	connectReplicas(replicas)
+
+	writer := replicas[0].caches.GetCache(cache.DefaultTenant)
+	assert.NoError(t, writer.Set(ctx, "user:1", "new", 60))
+	assert.Eventually(t, func() bool { return !holds(replicas[1], "user:1") && !holds(replicas[2], "user:1") }, 2*time.Second, 10*time.Millisecond)
+	value, err := writer.Get(ctx, "user:1")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", value)
+
+	assert.NoError(t, replicas[1].caches.GetCache(cache.DefaultTenant).Set(ctx, "user:2", "new", 60))
+	assert.Eventually(t, func() bool { return !holds(replicas[0], "user:2") && !holds(replicas[2], "user:2") }, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, holds(replicas[1], "user:2"), "the writer keeps its own value")
+
+	// A delete is shared even when the replica did not hold the key
+	assert.ErrorIs(t, writer.Delete(ctx, "user:3"), utils.NotFound)
+	assert.Eventually(t, func() bool { return !holds(replicas[2], "user:3") }, 2*time.Second, 10*time.Millisecond)
+}
+
+// Tags and clears travel the bus like keys
+func TestInvalidationBusTagsAndClear(t *testing.T) {
+	replicas := startReplicas(t, 2)
+	ctx := context.Background()
+	reader := replicas[1].caches.GetCache(cache.DefaultTenant)
+	_, err := reader.SetTagged(ctx, "user:1", "1", 0, 60, cache.Condition{}, []string{"users"})
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Set(ctx, "item:1", "1", 60))
+	connectReplicas(replicas)
+
+	writer := replicas[0].caches.GetCache(cache.DefaultTenant)
+	_, err = writer.InvalidateTag(ctx, "users")
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return !holds(replicas[1], "user:1") }, 2*time.Second, 10*time.Millisecond)
+	assert.True(t, holds(replicas[1], "item:1"))
+
+	assert.NoError(t, writer.Clear(ctx))
+	assert.Eventually(t, func() bool { return !holds(replicas[1], "item:1") }, 2*time.Second, 10*time.Millisecond)
+}
+
+// Changes to a tiered L1 drop the key from the tiered L1 of the other replicas only
+func TestInvalidationBusTieredL1(t *testing.T) {
+	replicas := startReplicas(t, 2)
+	ctx := context.Background()
+	for _, r := range replicas {
+		assert.NoError(t, r.caches.GetCache(cache.DefaultTenant).Set(ctx, "user:1", "memory", 60))
+		assert.NoError(t, r.caches.TieredL1(cache.DefaultTenant).Set(ctx, "user:1", "tiered", 60))
+	}
+	connectReplicas(replicas)
+
+	assert.NoError(t, replicas[0].caches.TieredL1(cache.DefaultTenant).Set(ctx, "user:1", "new", 60))
+	assert.Eventually(t, func() bool {
+		_, err := replicas[1].caches.TieredL1(cache.DefaultTenant).Get(ctx, "user:1")
+		return err == utils.NotFound
+	}, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, holds(replicas[1], "user:1"), "the in-memory cache keeps its entry")
+}
+
+// The locks of the in-memory caches belong to each replica: taking a lock on one replica leaves
+// the lease and the fencing counter of the same lock on the others alone
+func TestInvalidationBusLocks(t *testing.T) {
+	replicas := startReplicas(t, 2)
+	connectReplicas(replicas)
+	ctx := context.Background()
+	lockers := []cache.Locker{
+		cache.LockerFor(replicas[0].caches.GetCache(cache.DefaultTenant)),
+		cache.LockerFor(replicas[1].caches.GetCache(cache.DefaultTenant)),
+	}
+
+	held, err := lockers[1].Acquire(ctx, "cron", time.Minute)
+	assert.NoError(t, err)
+	_, err = lockers[0].Acquire(ctx, "cron", time.Minute)
+	assert.NoError(t, err)
+	other, err := lockers[0].Acquire(ctx, "report", time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, lockers[0].Release(ctx, "report", other.Owner))
+
+	// Once a later change has gone through the bus, the earlier ones have too
+	assert.NoError(t, replicas[1].caches.GetCache(cache.DefaultTenant).Set(ctx, "user:1", "old", 60))
+	assert.NoError(t, replicas[0].caches.GetCache(cache.DefaultTenant).Set(ctx, "user:1", "new", 60))
+	assert.Eventually(t, func() bool { return !holds(replicas[1], "user:1") }, 2*time.Second, 10*time.Millisecond)
+
+	_, err = lockers[1].Acquire(ctx, "cron", time.Minute)
+	assert.ErrorIs(t, err, utils.Locked, "the lease of the replica is kept")
+	assert.NoError(t, lockers[1].Release(ctx, "cron", held.Owner))
+	next, err := lockers[1].Acquire(ctx, "cron", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, held.Fence+1, next.Fence, "the fencing counter of the replica is kept")
+
+	// Invalidations naming reserved keys are ignored
+	replicas[1].caches.ApplyInvalidation(cache.Invalidation{Origin: "peer", TenantID: cache.DefaultTenant, Keys: []string{"__lock__:cron"}})
+	_, err = lockers[1].Acquire(ctx, "cron", time.Minute)
+	assert.ErrorIs(t, err, utils.Locked)
+}
+
+// Function to post an invalidation to a replica with the secret given
+func postInvalidation(t *testing.T, r *replica, secret string, body string) int {
+	req, _ := http.NewRequest("POST", r.server.URL+cache.InvalidationPath, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		req.Header.Set(cache.InvalidationSecretHeader, secret)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// The peer endpoint rejects invalidations without origin or tenant
+func TestInvalidationHandler(t *testing.T) {
+	replicas := startReplicas(t, 1)
+	connectReplicas(replicas)
+	for body, code := range map[string]int{
+		`{"origin": "peer", "tenantID": "defaultTenant", "keys": ["1"]}`: http.StatusOK,
+		`{"tenantID": "defaultTenant", "keys": ["1"]}`:                   http.StatusBadRequest,
+		`{"origin": "peer"}`: http.StatusBadRequest,
+		`not json`:           http.StatusBadRequest,
+	} {
+		assert.Equal(t, code, postInvalidation(t, replicas[0], replicaSecret, body), body)
+	}
+}
+
+// Invalidations without the secret of the peers are rejected before they are applied
+func TestInvalidationHandlerSecret(t *testing.T) {
+	replicas := startReplicas(t, 1)
+	connectReplicas(replicas)
+	assert.NoError(t, replicas[0].caches.GetCache(cache.DefaultTenant).Set(context.Background(), "user:1", "1", 60))
+	clear := `{"origin": "peer", "tenantID": "defaultTenant", "clear": true}`
+
+	assert.Equal(t, http.StatusUnauthorized, postInvalidation(t, replicas[0], "", clear))
+	assert.Equal(t, http.StatusUnauthorized, postInvalidation(t, replicas[0], "wrong", clear))
+	assert.True(t, holds(replicas[0], "user:1"))
+
+	// Without a configured secret nothing is accepted
+	config.AppConfig.Invalidation.Secret = ""
+	assert.Equal(t, http.StatusUnauthorized, postInvalidation(t, replicas[0], "", clear))
+	assert.True(t, holds(replicas[0], "user:1"))
+}
@@ -0,0 +1,224 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"multi-backend-cache/Internal/config"
+	"multi-backend-cache/Internal/metrices"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// Function to set up an in-memory router whose "user:" keys are read through from origin,
+// turning stale after softTTL seconds, and whose "user:grace:" keys expire after a second but
+// are kept two more for when the origin fails
+func setupReadThroughRouter(t *testing.T, origin string, softTTL int) *gin.Engine {
+	config.LoadConfig("../Internal/config/config.yaml")
+	config.AppConfig.IsTenantBased = false
+	config.AppConfig.SnapshotDir = ""
+	config.AppConfig.Loaders = []config.LoaderConfig{
+		{Prefix: "user:", URL: origin + "/users/{key}", TTL: 300, SoftTTL: softTTL},
+		{Prefix: "user:broken:", URL: origin + "/broken/{key}"},
+		{Prefix: "user:grace:", URL: origin + "/users/{key}", TTL: 1, Grace: 2},
+		{Prefix: "item:", URL: origin + "/items?id={key}&lang=en"},
+	}
+	return newInMemoryRouter(newTenantCaches(t, false, 1<<20))
+}
+
+// Misses are loaded from the origin once, then served from the cache with the loader TTL
+func TestReadThrough(t *testing.T) {
+	var requests atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/users/42":
+			fmt.Fprint(w, `{"name": "Ada"}`)
+		case "/users/a b":
+			fmt.Fprint(w, `"escaped"`)
+		case "/broken/1":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/items":
+			json.NewEncoder(w).Encode(r.URL.Query())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer origin.Close()
+	router := setupReadThroughRouter(t, origin.URL, 0)
+	defer func() { config.AppConfig.Loaders = nil }()
+
+	t.Run("Load", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			w := tenantRequest(router, "GET", "/cache/user:42?system=inmemory", "")
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.JSONEq(t, `{"name": "Ada"}`, w.Body.String())
+		}
+		assert.Equal(t, int32(1), requests.Load())
+
+		w := tenantRequest(router, "GET", "/cache/TTL/user:42?system=inmemory", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"ttl":299`)
+	})
+
+	t.Run("Escape", func(t *testing.T) {
+		w := tenantRequest(router, "GET", "/cache/user:a%20b?system=inmemory", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `"escaped"`+"\n", w.Body.String())
+
+		// Placeholders in the query cannot add parameters
+		w = tenantRequest(router, "GET", "/cache/item:a%26lang=fr%26admin=1?system=inmemory", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"id": ["a&lang=fr&admin=1"], "lang": ["en"]}`, w.Body.String())
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		w := tenantRequest(router, "GET", "/cache/user:7?system=inmemory", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		// Keys outside every loader prefix never reach the origin
+		before := requests.Load()
+		w = tenantRequest(router, "GET", "/cache/session:1?system=inmemory", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Equal(t, before, requests.Load())
+	})
+
+	t.Run("OriginError", func(t *testing.T) {
+		w := tenantRequest(router, "GET", "/cache/user:broken:1?system=inmemory", "")
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+	})
+}
+
+// Concurrent misses on one key share a single backend call and a single load
+func TestReadThroughCoalescing(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		fmt.Fprint(w, `{"name": "Ada"}`)
+	}))
+	defer origin.Close()
+	router := setupReadThroughRouter(t, origin.URL, 0)
+	defer func() { config.AppConfig.Loaders = nil }()
+
+	const readers = 20
+	before := testutil.ToFloat64(metrices.CoalescedRequests.WithLabelValues("inmemory"))
+	var wg sync.WaitGroup
+	codes := make([]int, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = tenantRequest(router, "GET", "/cache/user:42?system=inmemory", "").Code
+		}(i)
+	}
+	// Wait for every reader to join the load before letting the origin answer
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if testutil.ToFloat64(metrices.CoalescedRequests.WithLabelValues("inmemory")) == before+readers-1 {
+			break
+		}
+	}
+	close(release)
+	wg.Wait()
+
+	for _, code := range codes {
+		assert.Equal(t, http.StatusOK, code)
+	}
+	assert.Equal(t, int32(1), requests.Load())
+	assert.Equal(t, before+readers-1, testutil.ToFloat64(metrices.CoalescedRequests.WithLabelValues("inmemory")))
+}
+
+// Past their soft TTL, loaded values are served stale while they are refreshed, and keep being
+// served when the origin fails
+func TestReadThroughStale(t *testing.T) {
+	var version atomic.Int32
+	var failing atomic.Bool
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, version.Add(1))
+	}))
+	defer origin.Close()
+	router := setupReadThroughRouter(t, origin.URL, 1)
+	defer func() { config.AppConfig.Loaders = nil }()
+
+	w := tenantRequest(router, "GET", "/cache/user:42?system=inmemory", "")
+	assert.Equal(t, "MISS", w.Header().Get("X-Cache-Status"))
+	assert.Equal(t, "1\n", w.Body.String())
+	w = tenantRequest(router, "GET", "/cache/user:42?system=inmemory", "")
+	assert.Equal(t, "HIT", w.Header().Get("X-Cache-Status"))
+
+	time.Sleep(1100 * time.Millisecond)
+	w = tenantRequest(router, "GET", "/cache/user:42?system=inmemory", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "STALE", w.Header().Get("X-Cache-Status"))
+	assert.Equal(t, "1\n", w.Body.String())
+	// The background refresh replaces the value
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if w = tenantRequest(router, "GET", "/cache/user:42?system=inmemory", ""); w.Body.String() == "2\n" {
+			break
+		}
+	}
+	assert.Equal(t, "HIT", w.Header().Get("X-Cache-Status"))
+	assert.Equal(t, "2\n", w.Body.String())
+
+	failing.Store(true)
+	time.Sleep(1100 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		w = tenantRequest(router, "GET", "/cache/user:42?system=inmemory", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "STALE", w.Header().Get("X-Cache-Status"))
+		assert.Equal(t, "2\n", w.Body.String())
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Past their TTL, values kept for the grace period of their loader are reloaded first, and only
+// served when the origin fails
+func TestReadThroughGrace(t *testing.T) {
+	var version atomic.Int32
+	var failing atomic.Bool
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, version.Add(1))
+	}))
+	defer origin.Close()
+	router := setupReadThroughRouter(t, origin.URL, 0)
+	defer func() { config.AppConfig.Loaders = nil }()
+
+	w := tenantRequest(router, "GET", "/cache/user:grace:42?system=inmemory", "")
+	assert.Equal(t, "MISS", w.Header().Get("X-Cache-Status"))
+	assert.Equal(t, "1\n", w.Body.String())
+
+	time.Sleep(1100 * time.Millisecond)
+	failing.Store(true)
+	w = tenantRequest(router, "GET", "/cache/user:grace:42?system=inmemory", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "STALE", w.Header().Get("X-Cache-Status"))
+	assert.Equal(t, "1\n", w.Body.String())
+
+	// Once the origin answers again, the value past its TTL is not served
+	failing.Store(false)
+	w = tenantRequest(router, "GET", "/cache/user:grace:42?system=inmemory", "")
+	assert.Equal(t, "MISS", w.Header().Get("X-Cache-Status"))
+	assert.Equal(t, "2\n", w.Body.String())
+
+	// Past the grace period, the failure of the origin is returned
+	failing.Store(true)
+	time.Sleep(3100 * time.Millisecond)
+	w = tenantRequest(router, "GET", "/cache/user:grace:42?system=inmemory", "")
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+}
@@ -0,0 +1,177 @@
+package test
+
+import (
+	"bufio"
+	"encoding/json"
+	"multi-backend-cache/Internal/cache"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// Sends a lock request and decodes the lease it returns
+func lockRequest(router *gin.Engine, path string, body string) (int, cache.Lease) {
+	req, _ := http.NewRequest("POST", path+"?system=inmemory", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var lease cache.Lease
+	json.Unmarshal(w.Body.Bytes(), &lease)
+	return w.Code, lease
+}
+
+// Only the owner of a lease can refresh and release it, and fencing tokens grow
+func TestLockLease(t *testing.T) {
+	router := setupInMemoryRouter(t)
+
+	code, lease := lockRequest(router, "/locks/cron", `{"ttl": 60000}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotEmpty(t, lease.Owner)
+	assert.Greater(t, lease.Fence, int64(0))
+	assert.WithinDuration(t, time.Now().Add(time.Minute), lease.ExpiryTime, 2*time.Second)
+
+	code, _ = lockRequest(router, "/locks/cron", `{"ttl": 60000}`)
+	assert.Equal(t, http.StatusConflict, code)
+	code, _ = lockRequest(router, "/locks/cron", `{}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = lockRequest(router, "/locks/cron/refresh", `{"owner": "intruder", "ttl": 60000}`)
+	assert.Equal(t, http.StatusConflict, code)
+	code, refreshed := lockRequest(router, "/locks/cron/refresh", `{"owner": "`+lease.Owner+`", "ttl": 120000}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.WithinDuration(t, time.Now().Add(2*time.Minute), refreshed.ExpiryTime, 2*time.Second)
+
+	code, _ = lockRequest(router, "/locks/cron/release", `{"owner": "intruder"}`)
+	assert.Equal(t, http.StatusConflict, code)
+	code, _ = lockRequest(router, "/locks/cron/release", `{"owner": "`+lease.Owner+`"}`)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = lockRequest(router, "/locks/cron/release", `{"owner": "`+lease.Owner+`"}`)
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, next := lockRequest(router, "/locks/cron", `{"ttl": 60000}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Greater(t, next.Fence, lease.Fence)
+}
+
+// A lease that expired can be taken by another owner, and the old owner cannot release it
+func TestLockExpiry(t *testing.T) {
+	router := setupInMemoryRouter(t)
+
+	code, lease := lockRequest(router, "/locks/report", `{"ttl": 500}`)
+	assert.Equal(t, http.StatusOK, code)
+	time.Sleep(1100 * time.Millisecond) // in-memory leases are rounded up to the second
+
+	code, next := lockRequest(router, "/locks/report", `{"ttl": 60000}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotEqual(t, lease.Owner, next.Owner)
+	code, _ = lockRequest(router, "/locks/report/release", `{"owner": "`+lease.Owner+`"}`)
+	assert.Equal(t, http.StatusConflict, code)
+}
+
+// Only one of the workers racing for a lock gets it
+func TestLockContention(t *testing.T) {
+	router := setupInMemoryRouter(t)
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	acquired := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code, _ := lockRequest(router, "/locks/nightly", `{"ttl": 60000}`); code == http.StatusOK {
+				lock.Lock()
+				acquired++
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, acquired)
+}
+
+// A lock named after the fencing counter of another lock does not share it
+func TestLockFenceNamespace(t *testing.T) {
+	router := setupInMemoryRouter(t)
+
+	code, first := lockRequest(router, "/locks/x", `{"ttl": 60000}`)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = lockRequest(router, "/locks/x:fence", `{"ttl": 60000}`)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = lockRequest(router, "/locks/x/release", `{"owner": "`+first.Owner+`"}`)
+	assert.Equal(t, http.StatusOK, code)
+	code, second := lockRequest(router, "/locks/x", `{"ttl": 60000}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, first.Fence+1, second.Fence)
+
+	code, _ = lockRequest(router, "/locks/a%20b", `{"ttl": 60000}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+// The keys of the locks cannot be reached from the key routes, and a clear keeps the locks
+func TestLockReservedKeys(t *testing.T) {
+	router := setupInMemoryRouter(t)
+
+	code, lease := lockRequest(router, "/locks/cron", `{"ttl": 60000}`)
+	assert.Equal(t, http.StatusOK, code)
+
+	for _, method := range []string{"GET", "DELETE"} {
+		for _, key := range []string{"__lock__:cron", "__fence__:cron"} {
+			req, _ := http.NewRequest(method, "/cache/"+key+"?system=inmemory", nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusBadRequest, w.Code, method+" "+key)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/cache/keys?system=inmemory", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "cron")
+
+	req, _ = http.NewRequest("PUT", "/cache/clear?system=inmemory", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	code, _ = lockRequest(router, "/locks/cron", `{"ttl": 60000}`)
+	assert.Equal(t, http.StatusConflict, code)
+	code, _ = lockRequest(router, "/locks/cron/release", `{"owner": "`+lease.Owner+`"}`)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+// Watchers of every key see the changes of the keys, not those of the leases and fencing counters
+func TestLockEvents(t *testing.T) {
+	server := httptest.NewServer(setupInMemoryRouter(t))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events?system=inmemory")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	post := func(path string, body string) {
+		resp, err := http.Post(server.URL+path+"?system=inmemory", "application/json", strings.NewReader(body))
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+	}
+	post("/locks/cron", `{"ttl": 60000}`)
+	post("/cache", `{"key": "user:1", "value": "v", "ttl": 300}`)
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "event:set\n", line)
+	line, err = reader.ReadString('\n')
+	assert.NoError(t, err)
+	var event cache.Event
+	assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &event))
+	assert.Equal(t, "user:1", event.Key)
+}
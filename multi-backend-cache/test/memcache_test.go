@@ -1,12 +1,21 @@
 package test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"fmt"
+	"io"
 	handler "multi-backend-cache/Internal/Handler"
 	"multi-backend-cache/Internal/cache"
+	utils "multi-backend-cache/packageUtils/Utils"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -20,11 +29,16 @@ func setupMemcacheRouter() *gin.Engine {
 	cacheSystemType := handler.NewServer(nil, nil, MemCache)
 	router := gin.Default()
 
+	router.GET("/cache/keys", cacheSystemType.ListKeysHandler)
+	router.DELETE("/cache", cacheSystemType.DeleteMatchingHandler)
 	router.GET("/cache/:key", cacheSystemType.GetCacheHandler)
 	router.POST("/cache", cacheSystemType.SetCacheHandler)
 	router.DELETE("/cache/:key", cacheSystemType.DeleteCacheHandler)
-	// router.GET("/cache/TTL/:key", cacheSystemType.GetCacheWithTTLHandler)
+	router.GET("/cache/TTL/:key", cacheSystemType.GetCacheWithTTLHandler)
 	router.PUT("/cache/clear", cacheSystemType.ClearCacheHandler)
+	router.POST("/cache/batch/get", cacheSystemType.BatchGetCacheHandler)
+	router.POST("/cache/batch/set", cacheSystemType.BatchSetCacheHandler)
+	router.POST("/cache/batch/delete", cacheSystemType.BatchDeleteCacheHandler)
 
 	return router
 }
@@ -196,3 +210,318 @@ func TestClearMemCacheHandler(t *testing.T) {
 	router.ServeHTTP(w, req)
 	assert.Equal(t, http.StatusNotFound, w.Code)
 }
+
+// Test for get with TTL using a stub server speaking the memcache meta protocol
+func TestMemcacheGetWithTTL(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			switch line {
+			case "mg session t v\r\n":
+				conn.Write([]byte("VA 9 t42\r\n\"session\"\r\n"))
+			case "mg forever t v\r\n":
+				conn.Write([]byte("VA 2 t-1\r\n10\r\n"))
+			default:
+				conn.Write([]byte("EN\r\n"))
+			}
+			conn.Close()
+		}
+	}()
+
+	memCache := cache.NewMemCache(listener.Addr().String(), 10)
+
+	t.Run("Valid Key", func(t *testing.T) {
+		value, ttl, expiryTime, err := memCache.GetWithTTL(context.Background(), "session")
+		assert.NoError(t, err)
+		assert.Equal(t, "session", value)
+		assert.Equal(t, 42*time.Second, ttl)
+		assert.WithinDuration(t, time.Now().Add(42*time.Second), expiryTime, 2*time.Second)
+	})
+	t.Run("Key without expiry", func(t *testing.T) {
+		value, ttl, expiryTime, err := memCache.GetWithTTL(context.Background(), "forever")
+		assert.NoError(t, err)
+		assert.Equal(t, float64(10), value)
+		assert.Equal(t, cache.NoExpiry, ttl)
+		assert.True(t, expiryTime.IsZero())
+	})
+	t.Run("InValid Key", func(t *testing.T) {
+		_, _, _, err := memCache.GetWithTTL(context.Background(), "missing")
+		assert.Error(t, err)
+	})
+}
+
+// Test for the CAS ID reported as version by a plain get and the conditional delete, using a
+// stub server speaking the memcache text and meta protocols on long-lived connections
+func TestMemcacheVersions(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	var lock sync.Mutex
+	var commands []string
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					lock.Lock()
+					commands = append(commands, strings.TrimSpace(line))
+					lock.Unlock()
+					switch {
+					case line == "gets session\r\n":
+						conn.Write([]byte("VALUE session 0 9 7\r\n\"session\"\r\nEND\r\n"))
+					case strings.HasPrefix(line, "gets "):
+						conn.Write([]byte("END\r\n"))
+					case line == "md session C7\r\n":
+						conn.Write([]byte("HD\r\n"))
+					default:
+						conn.Write([]byte("EN\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+
+	memCache := cache.NewMemCache(listener.Addr().String(), 10)
+	ctx := context.Background()
+	item, err := memCache.GetItem(ctx, "session")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), item.Version)
+
+	assert.Equal(t, utils.PreconditionFailed, memCache.DeleteIf(ctx, "session", cache.Condition{IfMatch: []uint64{8}}))
+	assert.Equal(t, utils.PreconditionFailed, memCache.DeleteIf(ctx, "missing", cache.Condition{IfExists: true}))
+	assert.NoError(t, memCache.DeleteIf(ctx, "session", cache.Condition{IfMatch: []uint64{7}}))
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, "gets session", commands[0], "reads use the plain get")
+	assert.Equal(t, "md session C7", commands[len(commands)-1])
+}
+
+// Meta commands reuse their connections, and a server that does not answer cannot hold them
+// past the network timeout of the client
+func TestMemcacheMetaConnections(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == "mg session t v\r\n" {
+						conn.Write([]byte("VA 9 t42\r\n\"session\"\r\n"))
+					} // other commands are never answered
+				}
+			}()
+		}
+	}()
+
+	memCache := cache.NewMemCache(listener.Addr().String(), 10)
+	for i := 0; i < 3; i++ {
+		_, ttl, _, err := memCache.GetWithTTL(context.Background(), "session")
+		assert.NoError(t, err)
+		assert.Equal(t, 42*time.Second, ttl)
+	}
+	assert.Equal(t, int32(1), accepted.Load())
+
+	start := time.Now()
+	_, _, _, err = memCache.GetWithTTL(context.Background(), "silent")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+// Writes return the CAS ID of the new item as version, using a stub server that keeps the items
+// set with the meta protocol and returns them to plain gets
+func TestMemcacheSetVersions(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	type stubItem struct {
+		value []byte
+		cas   uint64
+	}
+	var lock sync.Mutex
+	items := make(map[string]stubItem)
+	var lastCAS uint64
+	serve := func(reader *bufio.Reader, conn net.Conn) error {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		lock.Lock()
+		defer lock.Unlock()
+		switch fields[0] {
+		case "gets":
+			if item, found := items[fields[1]]; found {
+				fmt.Fprintf(conn, "VALUE %s 0 %d %d\r\n%s\r\n", fields[1], len(item.value), item.cas, item.value)
+			}
+			_, err = conn.Write([]byte("END\r\n"))
+		case "ms":
+			size, _ := strconv.Atoi(fields[2])
+			value := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, value); err != nil {
+				return err
+			}
+			current, found := items[fields[1]]
+			status := ""
+			for _, flag := range fields[3:] {
+				switch {
+				case flag == "ME" && found, flag == "MR" && !found:
+					status = "NS"
+				case strings.HasPrefix(flag, "C") && flag != fmt.Sprintf("C%d", current.cas):
+					status = "EX"
+				}
+			}
+			if status == "" {
+				lastCAS++
+				items[fields[1]] = stubItem{value: value[:size], cas: lastCAS}
+				status = fmt.Sprintf("HD c%d", lastCAS)
+			}
+			_, err = conn.Write([]byte(status + "\r\n"))
+		default:
+			_, err = conn.Write([]byte("ERROR\r\n"))
+		}
+		return err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					if err := serve(reader, conn); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	memCache := cache.NewMemCache(listener.Addr().String(), 10)
+	ctx := context.Background()
+	version, err := memCache.SetIf(ctx, "session", "a", 0, 300, cache.Condition{})
+	assert.NoError(t, err)
+	assert.NotZero(t, version)
+	item, err := memCache.GetItem(ctx, "session")
+	assert.NoError(t, err)
+	assert.Equal(t, version, item.Version)
+
+	_, err = memCache.SetIf(ctx, "session", "b", 0, 300, cache.Condition{IfAbsent: true})
+	assert.Equal(t, utils.PreconditionFailed, err)
+	_, err = memCache.SetIf(ctx, "session", "b", 0, 300, cache.Condition{IfMatch: []uint64{version + 100}})
+	assert.Equal(t, utils.PreconditionFailed, err)
+
+	matched, err := memCache.SetIf(ctx, "session", "b", 0, 300, cache.Condition{IfMatch: []uint64{version}})
+	assert.NoError(t, err)
+	assert.NotEqual(t, version, matched)
+	item, err = memCache.GetItem(ctx, "session")
+	assert.NoError(t, err)
+	assert.Equal(t, "b", item.Value)
+	assert.Equal(t, matched, item.Version)
+
+	added, err := memCache.SetIf(ctx, "cart", "c", 0, 300, cache.Condition{IfNoneMatch: []uint64{version}})
+	assert.NoError(t, err)
+	assert.NotZero(t, added)
+}
+
+// An increment racing with other clients adding and deleting the counter is retried until it
+// is done, using a stub server that loses the counter several times in a row
+func TestMemcacheIncrRetries(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	var increments atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch fields := strings.Fields(line); fields[0] {
+					case "incr":
+						if increments.Add(1) <= 5 {
+							conn.Write([]byte("NOT_FOUND\r\n"))
+						} else {
+							conn.Write([]byte("42\r\n"))
+						}
+					case "add":
+						size, _ := strconv.Atoi(fields[4])
+						io.ReadFull(reader, make([]byte, size+2))
+						conn.Write([]byte("NOT_STORED\r\n"))
+					default:
+						conn.Write([]byte("ERROR\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+
+	memCache := cache.NewMemCache(listener.Addr().String(), 10)
+	value, err := memCache.Incr(context.Background(), "hits", 1, 0, 300)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), value)
+	assert.Equal(t, int32(6), increments.Load())
+}
+
+// Tenants sharing the memcache server see only their own keys, and clearing one keeps the others
+// Memcache cannot list its keys, nor delete them by pattern, which needs no server to answer
+func TestMemcacheListKeys(t *testing.T) {
+	router := setupMemcacheRouter()
+	req, _ := http.NewRequest("GET", "/cache/keys?system=memcache", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+
+	req, _ = http.NewRequest("DELETE", "/cache?system=memcache&match=session:*", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
+
+func TestMemcacheTenantIsolation(t *testing.T) {
+	testRemoteTenantIsolation(t, "memcache")
+}
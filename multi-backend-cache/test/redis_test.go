@@ -22,8 +22,13 @@ func setupRedisRouter() *gin.Engine {
 	router.GET("/cache/:key", cacheSystemType.GetCacheHandler)
 	router.POST("/cache", cacheSystemType.SetCacheHandler)
 	router.DELETE("/cache/:key", cacheSystemType.DeleteCacheHandler)
-	// router.GET("/cache/TTL/:key", cacheSystemType.GetCacheWithTTLHandler)
+	router.GET("/cache/TTL/:key", cacheSystemType.GetCacheWithTTLHandler)
 	router.PUT("/cache/clear", cacheSystemType.ClearCacheHandler)
+	router.POST("/cache/batch/get", cacheSystemType.BatchGetCacheHandler)
+	router.POST("/cache/batch/set", cacheSystemType.BatchSetCacheHandler)
+	router.POST("/cache/batch/delete", cacheSystemType.BatchDeleteCacheHandler)
+	router.GET("/cache/keys", cacheSystemType.ListKeysHandler)
+	router.DELETE("/cache/tags/:tag", cacheSystemType.InvalidateTagHandler)
 
 	return router
 }
@@ -200,3 +205,67 @@ func TestClearCacheHandler(t *testing.T) {
 	router.ServeHTTP(w, req)
 	assert.Equal(t, http.StatusNotFound, w.Code)
 }
+
+// Test for get with TTL function
+func TestRedisGetCacheWithTTLHandler(t *testing.T) {
+	router := setupRedisRouter()
+
+	w := httptest.NewRecorder()
+	reqBody := `{"key": "5", "value": "session", "ttl": 300}`
+	req, _ := http.NewRequest("POST", "/cache?system=redis", strings.NewReader(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	t.Run("Valid Key", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/cache/TTL/5?system=redis", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "session")
+		assert.Contains(t, w.Body.String(), "expiry_time")
+	})
+
+	t.Run("InValid Key", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/cache/TTL/6?system=redis", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+// Tenants sharing the Redis database see only their own keys, and clearing one keeps the others
+func TestRedisTenantIsolation(t *testing.T) {
+	testRemoteTenantIsolation(t, "redis")
+}
+
+// A tagged write rejected by its condition does not tag the entry it left alone, and the tag
+// sets are not listed
+func TestRedisTagsRejectedWrites(t *testing.T) {
+	router := setupRedisRouter()
+	request := func(method string, url string, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	request("PUT", "/cache/clear?system=redis", "")
+
+	w := request("POST", "/cache?system=redis", `{"key": "owner", "value": "first", "ttl": 300}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = request("POST", "/cache?system=redis&mode=add", `{"key": "owner", "value": "second", "ttl": 300, "tags": ["batch"]}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = request("POST", "/cache?system=redis&mode=add", `{"key": "fresh", "value": "v", "ttl": 300, "tags": ["batch"]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = request("GET", "/cache/keys?system=redis", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "__tag__")
+
+	w = request("DELETE", "/cache/tags/batch?system=redis", "")
+	assert.JSONEq(t, `{"status": "ok", "deleted": 1}`, w.Body.String())
+	assert.Equal(t, http.StatusOK, request("GET", "/cache/owner?system=redis", "").Code)
+	assert.Equal(t, http.StatusNotFound, request("GET", "/cache/fresh?system=redis", "").Code)
+}
@@ -0,0 +1,138 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	handler "multi-backend-cache/Internal/Handler"
+	"multi-backend-cache/Internal/cache"
+	"multi-backend-cache/Internal/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// A restored snapshot keeps values, expiry times and recency, and skips expired entries
+func TestSnapshotRestore(t *testing.T) {
+	ctx := context.Background()
+	entrySize := cache.CalculateSize("k0", []byte(`"value"`))
+	lru := cache.NewLRUCache(3*entrySize, 10)
+	defer lru.Close()
+	for _, key := range []string{"k0", "k1", "k2"} {
+		assert.NoError(t, lru.Set(ctx, key, "value", 60))
+	}
+	lru.Get(ctx, "k0") // k1 is now the least recently used
+
+	var snapshot bytes.Buffer
+	written, err := lru.Snapshot(&snapshot)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, written)
+
+	restoredCache := cache.NewLRUCache(3*entrySize, 10)
+	defer restoredCache.Close()
+	restored, err := restoredCache.Restore(bytes.NewReader(snapshot.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, restored)
+
+	_, _, expiryTime, err := lru.GetWithTTL(ctx, "k2")
+	assert.NoError(t, err)
+	_, _, restoredExpiryTime, err := restoredCache.GetWithTTL(ctx, "k2")
+	assert.NoError(t, err)
+	assert.True(t, expiryTime.Equal(restoredExpiryTime))
+
+	assert.NoError(t, restoredCache.Set(ctx, "k3", "value", 60))
+	_, err = restoredCache.Get(ctx, "k1")
+	assert.Error(t, err)
+
+	t.Run("Expired entries are skipped", func(t *testing.T) {
+		shortLived := cache.NewLRUCache(4096, 10)
+		defer shortLived.Close()
+		assert.NoError(t, shortLived.Set(ctx, "short", "value", 1))
+		assert.NoError(t, shortLived.Set(ctx, "long", "value", 60))
+		var snapshot bytes.Buffer
+		_, err := shortLived.Snapshot(&snapshot)
+		assert.NoError(t, err)
+
+		time.Sleep(1100 * time.Millisecond)
+		restoredCache := cache.NewLRUCache(4096, 10)
+		defer restoredCache.Close()
+		restored, err := restoredCache.Restore(&snapshot)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, restored)
+	})
+
+	t.Run("Soft expiry is kept, and left out when there is none", func(t *testing.T) {
+		softCache := cache.NewLRUCache(4096, 10)
+		defer softCache.Close()
+		assert.NoError(t, softCache.SetWithSoftTTL(ctx, "soft", "value", 30, 60))
+		assert.NoError(t, softCache.Set(ctx, "hard", "value", 60))
+		var snapshot bytes.Buffer
+		_, err := softCache.Snapshot(&snapshot)
+		assert.NoError(t, err)
+		for _, line := range strings.Split(strings.TrimSpace(snapshot.String()), "\n") {
+			assert.Equal(t, strings.Contains(line, `"key":"soft"`), strings.Contains(line, `"softexpiry"`), line)
+		}
+
+		restoredCache := cache.NewLRUCache(4096, 10)
+		defer restoredCache.Close()
+		_, err = restoredCache.Restore(&snapshot)
+		assert.NoError(t, err)
+		item, err := softCache.GetItem(ctx, "soft")
+		assert.NoError(t, err)
+		restoredItem, err := restoredCache.GetItem(ctx, "soft")
+		assert.NoError(t, err)
+		assert.True(t, item.SoftExpiry.Equal(restoredItem.SoftExpiry))
+		restoredItem, err = restoredCache.GetItem(ctx, "hard")
+		assert.NoError(t, err)
+		assert.True(t, restoredItem.SoftExpiry.IsZero())
+	})
+}
+
+// The admin endpoint writes a snapshot that the next tenant caches restore on startup
+func TestSnapshotHandlers(t *testing.T) {
+	config.AppConfig.IsTenantBased = false
+	config.AppConfig.SnapshotDir = t.TempDir()
+	defer func() { config.AppConfig.SnapshotDir = "" }()
+
+	tenantCaches := newTenantCaches(t, false, 4096)
+	server := handler.NewServer(tenantCaches, nil, nil)
+	router := gin.Default()
+	router.POST("/cache", server.SetCacheHandler)
+	router.POST("/admin/snapshot", server.SnapshotHandler)
+	router.GET("/admin/snapshot", server.SnapshotStatusHandler)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/snapshot", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"last_snapshot":null`)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/cache?system=inmemory", strings.NewReader(`{"key": "1", "value": "session", "ttl": 300}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/admin/snapshot", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/admin/snapshot", nil)
+	router.ServeHTTP(w, req)
+	var status map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.NotNil(t, status["last_snapshot"])
+	tenantCaches.Close()
+
+	restarted := newTenantCaches(t, false, 4096)
+	value, err := restarted.GetCache(cache.DefaultTenant).Get(context.Background(), "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "session", value)
+}
@@ -0,0 +1,174 @@
+package test
+
+import (
+	"context"
+	"multi-backend-cache/Internal/cache"
+	"multi-backend-cache/Internal/config"
+	"multi-backend-cache/Internal/metrices"
+	utils "multi-backend-cache/packageUtils/Utils"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns the number of lookups of the tenant served by the tier
+func tieredLookups(tenantID string, tier string) float64 {
+	return testutil.ToFloat64(metrices.TieredCacheLookups.WithLabelValues(tenantID, tier))
+}
+
+// Reads are served by L1, then by L2 with promotion; writes and deletes reach both tiers.
+// An in-memory cache stands in for Redis as L2.
+func TestTieredCache(t *testing.T) {
+	ctx := context.Background()
+	l1 := cache.NewLRUCache(1<<20, 10)
+	defer l1.Close()
+	l2 := cache.NewLRUCache(1<<20, 10)
+	defer l2.Close()
+	tiered := cache.NewTieredCache("tiered", l1, l2, 0)
+
+	t.Run("WriteThrough", func(t *testing.T) {
+		assert.NoError(t, tiered.Set(ctx, "1", "session", 300))
+		for _, tier := range []cache.CacheSystem{l1, l2} {
+			value, err := tier.Get(ctx, "1")
+			assert.NoError(t, err)
+			assert.Equal(t, "session", value)
+		}
+		before := tieredLookups("tiered", cache.TierL1)
+		value, err := tiered.Get(ctx, "1")
+		assert.NoError(t, err)
+		assert.Equal(t, "session", value)
+		assert.Equal(t, before+1, tieredLookups("tiered", cache.TierL1))
+	})
+
+	t.Run("Promote", func(t *testing.T) {
+		assert.NoError(t, l2.Set(ctx, "2", "profile", 300))
+		_, _, l2Expiry, err := l2.GetWithTTL(ctx, "2")
+		assert.NoError(t, err)
+		before := tieredLookups("tiered", cache.TierL2)
+		value, err := tiered.Get(ctx, "2")
+		assert.NoError(t, err)
+		assert.Equal(t, "profile", value)
+		assert.Equal(t, before+1, tieredLookups("tiered", cache.TierL2))
+
+		// Promoted with the expiry of L2
+		_, _, l1Expiry, err := l1.GetWithTTL(ctx, "2")
+		assert.NoError(t, err)
+		assert.WithinDuration(t, l2Expiry, l1Expiry, time.Second)
+	})
+
+	t.Run("Miss", func(t *testing.T) {
+		before := tieredLookups("tiered", cache.TierMiss)
+		_, err := tiered.Get(ctx, "missing")
+		assert.Equal(t, utils.NotFound, err)
+		assert.Equal(t, before+1, tieredLookups("tiered", cache.TierMiss))
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		assert.NoError(t, tiered.Delete(ctx, "1"))
+		for _, tier := range []cache.CacheSystem{l1, l2} {
+			_, err := tier.Get(ctx, "1")
+			assert.Equal(t, utils.NotFound, err)
+		}
+		assert.Equal(t, utils.NotFound, tiered.Delete(ctx, "1"))
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		assert.NoError(t, tiered.SetMany(ctx, []cache.CacheData{{Key: "3", Value: "a", TTL: 300}, {Key: "4", Value: "b", TTL: 300}}))
+		assert.NoError(t, l1.Delete(ctx, "4"))
+		values, err := tiered.GetMany(ctx, []string{"3", "4", "5"})
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{"3": "a", "4": "b"}, values)
+		deleted, err := tiered.DeleteMany(ctx, []string{"3", "4", "5"})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, deleted)
+	})
+}
+
+// L1TTL bounds how long promoted and written entries stay in memory
+func TestTieredCacheL1TTL(t *testing.T) {
+	ctx := context.Background()
+	l1 := cache.NewLRUCache(1<<20, 10)
+	defer l1.Close()
+	l2 := cache.NewLRUCache(1<<20, 10)
+	defer l2.Close()
+	tiered := cache.NewTieredCache("tiered-ttl", l1, l2, 2*time.Second)
+
+	assert.NoError(t, tiered.Set(ctx, "1", "session", 300))
+	_, ttl, _, err := l1.GetWithTTL(ctx, "1")
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, ttl, 2*time.Second)
+
+	assert.NoError(t, l2.Set(ctx, "2", "profile", 300))
+	_, err = tiered.Get(ctx, "2")
+	assert.NoError(t, err)
+	_, ttl, _, err = l1.GetWithTTL(ctx, "2")
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, ttl, 2*time.Second)
+
+	// Batch hits in L2 are promoted when the L1 TTL bounds them
+	assert.NoError(t, l2.Set(ctx, "3", "cart", 300))
+	_, err = tiered.GetMany(ctx, []string{"3"})
+	assert.NoError(t, err)
+	_, err = l1.Get(ctx, "3")
+	assert.NoError(t, err)
+}
+
+// Both tiers carry the version of L2, against which the conditions are checked
+func TestTieredCacheVersions(t *testing.T) {
+	ctx := context.Background()
+	l1 := cache.NewLRUCache(1<<20, 10)
+	defer l1.Close()
+	l2 := cache.NewLRUCache(1<<20, 10)
+	defer l2.Close()
+	tiered := cache.NewTieredCache("tiered-versions", l1, l2, 0)
+
+	version, err := tiered.SetIf(ctx, "1", "session", 0, 300, cache.Condition{IfAbsent: true})
+	assert.NoError(t, err)
+	for _, tier := range []cache.CacheSystem{l1, l2, tiered} {
+		item, err := tier.GetItem(ctx, "1")
+		assert.NoError(t, err)
+		assert.Equal(t, version, item.Version)
+	}
+
+	// A write to L2 alone leaves L1 behind; the failed condition drops it
+	assert.NoError(t, l2.Set(ctx, "1", "profile", 300))
+	_, err = tiered.SetIf(ctx, "1", "cart", 0, 300, cache.Condition{IfMatch: []uint64{version}})
+	assert.Equal(t, utils.PreconditionFailed, err)
+	item, err := tiered.GetItem(ctx, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "profile", item.Value)
+
+	assert.NoError(t, tiered.DeleteIf(ctx, "1", cache.Condition{IfMatch: []uint64{item.Version}}))
+	_, err = l1.Get(ctx, "1")
+	assert.Equal(t, utils.NotFound, err)
+}
+
+// The tiered system has an L1 of its own per tenant: it neither sees nor clears the keys of the
+// in-memory system
+func TestTieredL1(t *testing.T) {
+	config.AppConfig.IsTenantBased = false
+	tenantCaches := newTenantCaches(t, false, 1<<20)
+	ctx := context.Background()
+	inMemory := tenantCaches.GetCache(cache.DefaultTenant)
+	l1 := tenantCaches.TieredL1(cache.DefaultTenant)
+	assert.NotSame(t, inMemory, l1)
+	assert.Same(t, l1, tenantCaches.TieredL1(cache.DefaultTenant))
+	assert.Nil(t, tenantCaches.TieredL1("unknown"))
+
+	l2 := cache.NewLRUCache(1<<20, 10)
+	defer l2.Close()
+	tiered := cache.NewTieredCache(cache.DefaultTenant, l1, l2, 0)
+	assert.NoError(t, inMemory.Set(ctx, "1", "memory", 300))
+	assert.NoError(t, tiered.Set(ctx, "2", "tiered", 300))
+	_, err := tiered.Get(ctx, "1")
+	assert.Equal(t, utils.NotFound, err)
+	_, err = inMemory.Get(ctx, "2")
+	assert.Equal(t, utils.NotFound, err)
+
+	assert.NoError(t, tiered.Clear(ctx))
+	value, err := inMemory.Get(ctx, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "memory", value)
+}